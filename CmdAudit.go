@@ -0,0 +1,50 @@
+package main
+
+import (
+	"CDN77-DNS/audit"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// list the audit records of the rules overlapping a prefix
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	logFile := flags.String("log", "audit.jsonl", "JSON Lines audit log written by serve -audit-log")
+	prefixStr := flags.String("prefix", "::/0", "only list changes of rules containing or inside this prefix")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	prefix, err := netip.ParsePrefix(*prefixStr)
+	if err != nil {
+		return fmt.Errorf("failed to parse prefix '%s': %w", *prefixStr, err)
+	}
+
+	file, err := os.Open(*logFile)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log '%s': %w", *logFile, err)
+	}
+	defer file.Close()
+	records, err := audit.Query(file, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		fmt.Printf("%s  serial %d  %-12s %s %s -> %s  (%s)\n", record.Time.Format(time.RFC3339), record.Serial, record.Actor,
+			record.Prefix, formatAuditPoP(record.Before, record.BeforeTarget), formatAuditPoP(record.After, record.AfterTarget), record.Source)
+	}
+	return nil
+}
+
+func formatAuditPoP(popID *uint16, target string) string {
+	if popID == nil {
+		return "none"
+	}
+	if target != "" {
+		return "PoP " + target
+	}
+	return fmt.Sprintf("PoP %d", *popID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"flag"
+	"fmt"
+	"math/big"
+)
+
+// report how the answers changed between two routing tables
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	oldFile := flags.String("old", "", "routing data file before the change")
+	newFile := flags.String("new", "", "routing data file after the change")
+	popOnly := flags.Bool("pop-only", false, "report PoP changes only, ignore scope changes")
+	out := flags.String("out", "", "output file (stdout if empty)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *oldFile == "" || *newFile == "" {
+		return fmt.Errorf("both -old and -new must be given")
+	}
+
+	before := optimised.NewData()
+	if err := before.LoadRoutingData(*oldFile); err != nil {
+		return err
+	}
+	after := optimised.NewData()
+	if err := after.LoadRoutingData(*newFile); err != nil {
+		return err
+	}
+	diff := optimised.Diff(before, after, *popOnly)
+
+	file, err := createOutput(*out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, change := range diff.Changes {
+		fmt.Fprintf(w, "%s %s -> %s\n", change.Prefix, formatAnswer(change.Before, *popOnly), formatAnswer(change.After, *popOnly))
+	}
+	if len(diff.PoPs) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, delta := range diff.PoPs {
+		fmt.Fprintf(w, "PoP %d: gained %s, lost %s\n", delta.PoP, formatSpace(delta.Gained), formatSpace(delta.Lost))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write diff: %w", err)
+	}
+	return file.Close()
+}
+
+func formatAnswer(answer optimised.Answer, popOnly bool) string {
+	if answer.Scope < 0 {
+		return "no match"
+	}
+	pop := fmt.Sprintf("PoP %d", answer.PoP)
+	if answer.Weights != "" {
+		pop = "PoPs " + answer.Weights
+	}
+	if popOnly {
+		return pop
+	}
+	return fmt.Sprintf("%s scope /%d", pop, answer.Scope)
+}
+
+// address counts are huge, show them as the size of the closest prefix as well
+func formatSpace(addresses *big.Int) string {
+	if addresses.Sign() == 0 {
+		return "0"
+	}
+	// 2^(128 - len) addresses make a /len
+	prefixLen := 128 - (addresses.BitLen() - 1)
+	return fmt.Sprintf("%s addresses (~/%d)", addresses, prefixLen)
+}
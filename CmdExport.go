@@ -0,0 +1,34 @@
+package main
+
+import (
+	"CDN77-DNS/optimised"
+	"flag"
+	"fmt"
+)
+
+// rewrite a routing table in canonical form
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	in := flags.String("in", "routing-data.txt", "routing data file to export")
+	out := flags.String("out", "", "output file, replaced atomically (stdout if empty)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	d := optimised.NewData()
+	if err := d.LoadRoutingData(*in); err != nil {
+		return err
+	}
+
+	if *out != "" && *out != "-" {
+		return d.ExportRoutingData(*out)
+	}
+	file, err := createOutput(*out)
+	if err != nil {
+		return err
+	}
+	if err := d.WriteRoutingData(file); err != nil {
+		return fmt.Errorf("failed to write routing data: %w", err)
+	}
+	return nil
+}
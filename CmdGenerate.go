@@ -0,0 +1,45 @@
+package main
+
+import (
+	"CDN77-DNS/rum"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// generate a routing table from RUM latency measurements
+func runGenerate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	in := flags.String("in", "rum.csv", "CSV of 'subnet,pop,median_rtt_ms,samples' measurements")
+	out := flags.String("out", "", "output file (stdout if empty)")
+	minSamples := flags.Int("min-samples", rum.DefaultOptions.MinSamples, "measurements with fewer samples are ignored")
+	minMargin := flags.Float64("min-margin", rum.DefaultOptions.MinMargin, "fraction by which the best PoP must beat the runner-up, subnets below it get no rule")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	measurements, err := rum.LoadCSV(*in)
+	if err != nil {
+		return err
+	}
+	generated, report, err := rum.Generate(measurements, rum.Options{MinSamples: *minSamples, MinMargin: *minMargin})
+	if err != nil {
+		return err
+	}
+
+	file, err := createOutput(*out)
+	if err != nil {
+		return err
+	}
+	if err := generated.WriteRoutingData(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write generated table: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// the table may be on stdout, the summary goes next to it
+	fmt.Fprintf(os.Stderr, "%d subnets: %d chosen, %d with too few samples, %d without a clear winner -> %d rules\n",
+		report.Subnets, report.Chosen, report.LowSamples, report.Ambiguous, report.Rules)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"CDN77-DNS/admin"
+	"CDN77-DNS/optimised"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// replay a query log against a routing table and report rule usage
+func runHits(args []string) error {
+	flags := flag.NewFlagSet("hits", flag.ContinueOnError)
+	in := flags.String("in", "routing-data.txt", "routing data file to load")
+	queries := flags.String("queries", "", "file with one ECS subnet (CIDR) or address per line")
+	top := flags.Int("top", 10, "number of hottest prefixes to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *queries == "" {
+		return fmt.Errorf("-queries must be given")
+	}
+	if *top < 0 {
+		return fmt.Errorf("-top must not be negative")
+	}
+
+	d := optimised.NewData()
+	if err := d.LoadRoutingData(*in); err != nil {
+		return err
+	}
+	d.EnableHitCounters(true)
+
+	file, err := os.Open(*queries)
+	if err != nil {
+		return fmt.Errorf("failed to open queries file '%s': %w", *queries, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ecs, err := admin.ParseECS(line)
+		if err != nil {
+			return err
+		}
+		d.Route(ecs)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading queries file '%s': %w", *queries, err)
+	}
+
+	report := d.HitReport(*top)
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "hottest %d prefixes:\n", len(report.Hottest))
+	for _, rule := range report.Hottest {
+		fmt.Fprintf(w, "  %s %d: %d hits\n", rule.Prefix, rule.PoP, rule.Hits)
+	}
+	fmt.Fprintf(w, "unused rules (%d):\n", len(report.Unused))
+	for _, rule := range report.Unused {
+		fmt.Fprintf(w, "  %s %d\n", rule.Prefix, rule.PoP)
+	}
+	return w.Flush()
+}
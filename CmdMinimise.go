@@ -0,0 +1,37 @@
+package main
+
+import (
+	"CDN77-DNS/optimised"
+	"flag"
+	"fmt"
+)
+
+// minimise a routing table into an equivalent smaller rule set
+func runMinimise(args []string) error {
+	flags := flag.NewFlagSet("minimise", flag.ContinueOnError)
+	in := flags.String("in", "routing-data.txt", "routing data file to minimise")
+	out := flags.String("out", "", "output file (stdout if empty)")
+	keepScope := flags.Bool("keep-scope", false, "keep the returned scope identical for every address (only drop rules that are never matched)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	d := optimised.NewData()
+	if err := d.LoadRoutingData(*in); err != nil {
+		return err
+	}
+	minimised, err := d.Minimise(*keepScope)
+	if err != nil {
+		return err
+	}
+
+	file, err := createOutput(*out)
+	if err != nil {
+		return err
+	}
+	if err := minimised.WriteRoutingData(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write minimised table: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"CDN77-DNS/admin"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// list the table versions kept by a running server and roll back to one of them through its admin API
+func runRollback(args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	adminURL := flags.String("admin", "http://localhost:8053", "base URL of the admin API")
+	serial := flags.Uint64("serial", 0, "serial of the version to publish again (only lists the versions if 0)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// the token is read from the environment so it does not show up in the process list
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return fmt.Errorf("ADMIN_TOKEN must be set to an admin API bearer token")
+	}
+
+	var history admin.History
+	if *serial == 0 {
+		if err := adminRequest(http.MethodGet, *adminURL+"/versions", token, &history); err != nil {
+			return err
+		}
+	} else {
+		if err := adminRequest(http.MethodPost, fmt.Sprintf("%s/versions/%d/rollback", *adminURL, *serial), token, &history); err != nil {
+			return err
+		}
+		fmt.Printf("rolled back to serial %d, now serving serial %d\n", *serial, history.Serial)
+	}
+
+	for _, v := range history.Versions {
+		marker := " "
+		if v.Serial == history.Serial {
+			marker = "*"
+		}
+		fmt.Printf("%s %6d  %s  %s\n", marker, v.Serial, v.Published.Format(time.RFC3339), v.Source)
+	}
+	return nil
+}
+
+// send an authenticated admin API request and decode the JSON response into out
+func adminRequest(method, url, token string, out any) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for '%s': %w", url, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response of %s %s: %w", method, url, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, apiErr.Error)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", method, url, err)
+	}
+	return nil
+}
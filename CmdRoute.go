@@ -0,0 +1,49 @@
+package main
+
+import (
+	"CDN77-DNS/admin"
+	"CDN77-DNS/optimised"
+	"CDN77-DNS/registry"
+	"flag"
+	"fmt"
+)
+
+// answer a single ECS subnet from a routing table, or from the registry table serving a query name
+func runRoute(args []string) error {
+	flags := flag.NewFlagSet("route", flag.ContinueOnError)
+	in := flags.String("in", "routing-data.txt", "routing data file to load")
+	registryConfig := flags.String("registry", "", "registry config, the table is picked by -qname instead of -in")
+	qname := flags.String("qname", "", "query name used to pick the registry table")
+	ecsStr := flags.String("ecs", "", "ECS subnet (CIDR) or address to route")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ecs, err := admin.ParseECS(*ecsStr)
+	if err != nil {
+		return err
+	}
+
+	d := optimised.NewData()
+	if *registryConfig != "" {
+		r, err := registry.Load(*registryConfig)
+		if err != nil {
+			return err
+		}
+		table, ok := r.Lookup(*qname)
+		if !ok {
+			return fmt.Errorf("no table serves '%s'", *qname)
+		}
+		fmt.Printf("table %s\n", table.Name)
+		d = table.Data
+	} else if err := d.LoadRoutingData(*in); err != nil {
+		return err
+	}
+
+	pop, scope := d.Route(ecs)
+	if scope < 0 {
+		fmt.Printf("%s: no rule\n", ecs)
+		return nil
+	}
+	fmt.Printf("%s: PoP %d scope /%d\n", ecs, pop, scope)
+	return nil
+}
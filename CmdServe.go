@@ -0,0 +1,468 @@
+package main
+
+import (
+	"CDN77-DNS/admin"
+	"CDN77-DNS/audit"
+	"CDN77-DNS/dns"
+	"CDN77-DNS/dnstap"
+	"CDN77-DNS/journal"
+	"CDN77-DNS/metrics"
+	"CDN77-DNS/optimised"
+	"CDN77-DNS/prober"
+	"CDN77-DNS/registry"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// run the routing table as a long lived service, SIGHUP reloads the routing data
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	routingFile := flags.String("routing", "routing-data.txt", "routing data file, reloaded on SIGHUP")
+	registryFile := flags.String("registry", "", "file of 'name routing-data-file zone [zone...]' tables the DNS server picks from by query name instead of -routing and -dns-zones, all reloaded on SIGHUP")
+	metricsAddr := flags.String("metrics-addr", ":9153", "listen address of the Prometheus /metrics endpoint")
+	adminAddr := flags.String("admin-addr", "", "listen address of the admin API (disabled if empty)")
+	adminTokens := flags.String("admin-tokens", "", "file with 'actor token' lines accepted by the admin API")
+	journalDir := flags.String("journal", "", "directory of the write-ahead journal that makes admin API changes survive restarts (disabled if empty)")
+	compactEvery := flags.Duration("journal-compact", 10*time.Minute, "how often the journal records are folded into one")
+	auditLog := flags.String("audit-log", "", "JSON Lines file the audit records of rule changes are appended to")
+	auditSlog := flags.Bool("audit-slog", false, "log the audit records of rule changes as structured log entries on stderr")
+	hitCounters := flags.Bool("hit-counters", false, "count the lookups of every rule, reported by the admin API at GET /hits")
+	history := flags.Int("history", optimised.DefaultHistoryLimit, "number of published table versions kept for rollback")
+	expireEvery := flags.Duration("expire", time.Minute, "how often rules whose not-after time has passed are removed from the table")
+	probesFile := flags.String("probes", "", "file of 'PoP kind target [options]' health checks whose results mark PoPs up or down (disabled if empty)")
+	probeInterval := flags.Duration("probe-interval", prober.DefaultSettings.Interval, "default interval between two probes of a check")
+	probeTimeout := flags.Duration("probe-timeout", prober.DefaultSettings.Timeout, "default timeout of a probe")
+	probeRise := flags.Int("probe-rise", prober.DefaultSettings.Rise, "default number of consecutive passing probes that bring a check back up")
+	probeFall := flags.Int("probe-fall", prober.DefaultSettings.Fall, "default number of consecutive failing probes that take a check down")
+	capacityFile := flags.String("capacity", "", "file of 'PoP limit=N spill=F overflow=PoP,PoP' lines, PoPs over their limit spill to their overflow PoPs")
+	loadFile := flags.String("load-reports", "", "file of 'PoP load' lines re-read every -load-interval (load can also be pushed through the admin API)")
+	loadInterval := flags.Duration("load-interval", 10*time.Second, "how often the -load-reports file is read")
+	dnsAddr := flags.String("dns-addr", "", "UDP and TCP listen address of the DNS server (disabled if empty)")
+	dnsZones := flags.String("dns-zones", ".", "comma separated zones the DNS server answers from the routing table")
+	dnsZoneFiles := flags.String("dns-zone-files", "", "comma separated zone files answered authoritatively, only their STEERED names are routed (all names in -dns-zones if empty)")
+	popsFile := flags.String("pops", "", "file of 'PoP address [address...]' lines, the addresses the DNS server answers for each PoP")
+	dnsTTL := flags.Duration("dns-ttl", 30*time.Second, "TTL of the DNS answers")
+	dnsCache := flags.Int("dns-cache", 100000, "number of packed DNS answers cached (disabled if 0)")
+	dotAddr := flags.String("dot-addr", "", "listen address of DNS over TLS, usually :853 (disabled if empty)")
+	dohAddr := flags.String("doh-addr", "", "listen address of DNS over HTTPS at /dns-query, usually :443 (disabled if empty)")
+	tlsCert := flags.String("tls-cert", "", "PEM certificate chain of the DNS over TLS and HTTPS listeners, reloaded on SIGHUP")
+	tlsKey := flags.String("tls-key", "", "PEM private key of -tls-cert")
+	dnstapSocket := flags.String("dnstap-socket", "", "unix socket of a dnstap receiver the answered DNS queries are logged to")
+	dnstapFile := flags.String("dnstap-file", "", "file the answered DNS queries are logged to in dnstap format, replaced at startup")
+	dnstapSample := flags.Int("dnstap-sample", dnstap.DefaultOptions.SampleEvery, "log one in this many answered DNS queries")
+	dnstapBuffer := flags.Int("dnstap-buffer", dnstap.DefaultOptions.BufferSize, "DNS queries waiting to be logged, more are dropped")
+	rrlRate := flags.Float64("rrl-rate", 0, "identical UDP responses per second allowed to a client network (rate limiting disabled if 0)")
+	rrlWindow := flags.Duration("rrl-window", dns.DefaultRateLimit.Window, "how long a client network stays rate limited after its flood stops, at most")
+	rrlSlip := flags.Int("rrl-slip", dns.DefaultRateLimit.Slip, "send every this many rate limited responses truncated instead of dropping it (all dropped if 0)")
+	rrlIPv4Prefix := flags.Int("rrl-ipv4-prefix", dns.DefaultRateLimit.IPv4PrefixLen, "prefix length IPv4 clients are rate limited by")
+	rrlIPv6Prefix := flags.Int("rrl-ipv6-prefix", dns.DefaultRateLimit.IPv6PrefixLen, "prefix length IPv6 clients are rate limited by")
+	rrlExempt := flags.String("rrl-exempt", "", "comma separated prefixes of clients never rate limited, eg. known resolvers")
+	rrlEntries := flags.Int("rrl-entries", dns.DefaultRateLimit.MaxEntries, "number of rate limiting accounts kept")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	d := optimised.NewData()
+	// the tables answering DNS queries, d alone unless there is a registry
+	served := []*optimised.Data{d}
+	var tables *registry.Registry
+	// observes every table before it is loaded, so the initial loads are recorded as well
+	var collector *metrics.Collector
+	if *registryFile != "" {
+		if *journalDir != "" || *adminAddr != "" {
+			return fmt.Errorf("-journal and -admin-addr manage the -routing table and can not be used with -registry")
+		}
+		collector = metrics.NewTables(nil)
+		var err error
+		tables, err = registry.LoadWith(*registryFile, func(table *registry.Table) {
+			collector.AddTable(table.Name, table.Data)
+		})
+		if err != nil {
+			return err
+		}
+		served = served[:0]
+		for _, table := range tables.Tables() {
+			served = append(served, table.Data)
+		}
+	}
+	// every PoP starts up, the prober and the admin API mark them draining or down
+	health := optimised.NewHealth()
+	for _, table := range served {
+		table.SetHistoryLimit(*history)
+		table.EnableHitCounters(*hitCounters)
+		table.SetHealth(health)
+	}
+	if *capacityFile != "" {
+		capacities, err := optimised.LoadCapacities(*capacityFile)
+		if err != nil {
+			return err
+		}
+		for _, c := range capacities {
+			if err := health.SetCapacity(c); err != nil {
+				return err
+			}
+		}
+	}
+	var probes *prober.Prober
+	if *probesFile != "" {
+		checks, err := prober.LoadChecks(*probesFile)
+		if err != nil {
+			return err
+		}
+		defaults := prober.Defaults{Interval: *probeInterval, Timeout: *probeTimeout, Rise: *probeRise, Fall: *probeFall}
+		if probes, err = prober.New(health, checks, defaults); err != nil {
+			return err
+		}
+	}
+	var wal *journal.Log
+	switch {
+	case tables != nil:
+		// loaded by registry.LoadWith with the collector already installed
+	case *journalDir == "":
+		collector = metrics.New(d)
+		if err := d.LoadRoutingData(*routingFile); err != nil {
+			return err
+		}
+	default:
+		collector = metrics.New(d)
+		var err error
+		if wal, err = journal.Open(*journalDir, d, *routingFile); err != nil {
+			return err
+		}
+		defer wal.Close()
+		if truncated := wal.Truncated(); truncated > 0 {
+			log.Printf("cut off %d bytes of a torn journal tail", truncated)
+		}
+	}
+
+	// audit from here on, the initial load would report every rule as added
+	switch {
+	case *auditLog != "" && *auditSlog:
+		return fmt.Errorf("-audit-log and -audit-slog are mutually exclusive")
+	case *auditLog != "":
+		sink, err := audit.NewJSONLines(*auditLog)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		for _, table := range served {
+			table.SetAuditor(sink)
+		}
+	case *auditSlog:
+		sink := audit.NewSlog(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		for _, table := range served {
+			table.SetAuditor(sink)
+		}
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("GET /metrics", collector)
+	servers := []server{newHTTPServer(*metricsAddr, metricsMux)}
+
+	if *adminAddr != "" {
+		if *adminTokens == "" {
+			return fmt.Errorf("-admin-tokens must be given with -admin-addr")
+		}
+		tokens, err := admin.LoadTokens(*adminTokens)
+		if err != nil {
+			return err
+		}
+		api := admin.New(d, tokens)
+		api.SetHealth(health)
+		servers = append(servers, newHTTPServer(*adminAddr, api))
+	}
+
+	var cert *dns.Certificate
+	if *dnsAddr != "" || *dotAddr != "" || *dohAddr != "" {
+		if *popsFile == "" {
+			return fmt.Errorf("-pops must be given with -dns-addr, -dot-addr or -doh-addr")
+		}
+		addresses, err := dns.LoadAddresses(*popsFile)
+		if err != nil {
+			return err
+		}
+		routing := dns.SingleTable(d, strings.Split(*dnsZones, ",")...)
+		if tables != nil {
+			routing = dns.RegistryTables(tables)
+		}
+		steering := dns.NewSteering(routing, addresses, *dnsTTL)
+		if *dnsZoneFiles != "" {
+			zones, err := loadZones(*dnsZoneFiles)
+			if err != nil {
+				return err
+			}
+			steering.SetZones(zones...)
+		}
+		if *dnsCache > 0 {
+			steering.SetCache(dns.NewCache(*dnsCache))
+		}
+		tap, err := newDnstap(*dnstapSocket, *dnstapFile, *dnstapSample, *dnstapBuffer)
+		if err != nil {
+			return err
+		}
+		if tap != nil {
+			defer func() {
+				if err := tap.Close(); err != nil {
+					log.Printf("closing dnstap output failed: %v", err)
+				}
+				stats := tap.Stats()
+				log.Printf("dnstap logged %d queries, dropped %d", stats.Logged, stats.Dropped)
+			}()
+			steering.SetTap(tap)
+		}
+		if *dnsAddr != "" {
+			var handler dns.Handler = steering
+			if *rrlRate > 0 {
+				config := dns.RateLimit{ResponsesPerSecond: *rrlRate, Window: *rrlWindow, Slip: *rrlSlip, IPv4PrefixLen: *rrlIPv4Prefix, IPv6PrefixLen: *rrlIPv6Prefix, MaxEntries: *rrlEntries}
+				if config.Exempt, err = parsePrefixes(*rrlExempt); err != nil {
+					return err
+				}
+				limiter, err := dns.NewRateLimiter(steering, config)
+				if err != nil {
+					return fmt.Errorf("invalid rate limiting: %w", err)
+				}
+				defer func() {
+					stats := limiter.Stats()
+					log.Printf("rate limiting dropped %d responses, truncated %d", stats.Dropped, stats.Truncated)
+				}()
+				handler = limiter
+			}
+			servers = append(servers, server{*dnsAddr, &dns.Server{Addr: *dnsAddr, Handler: handler}})
+		}
+		if *dotAddr != "" || *dohAddr != "" {
+			if *tlsCert == "" || *tlsKey == "" {
+				return fmt.Errorf("-tls-cert and -tls-key must be given with -dot-addr or -doh-addr")
+			}
+			if cert, err = dns.LoadCertificate(*tlsCert, *tlsKey); err != nil {
+				return err
+			}
+		}
+		if *dotAddr != "" {
+			servers = append(servers, server{*dotAddr, &dns.Server{Addr: *dotAddr, Handler: steering, TLSConfig: cert.TLSConfig()}})
+		}
+		if *dohAddr != "" {
+			dohMux := http.NewServeMux()
+			dohMux.Handle("/dns-query", &dns.DoH{Handler: steering})
+			https := &http.Server{Addr: *dohAddr, Handler: dohMux, ReadHeaderTimeout: 10 * time.Second, TLSConfig: cert.TLSConfig()}
+			servers = append(servers, server{*dohAddr, httpsServer{https}})
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if tables != nil {
+		go reloadOnHangup(ctx, *registryFile, tables.ReloadAll, cert)
+	} else {
+		go reloadOnHangup(ctx, *routingFile, func() error { return d.ReloadRoutingData(*routingFile) }, cert)
+	}
+	if wal != nil {
+		go compactPeriodically(ctx, d, wal, *compactEvery)
+	}
+	for _, table := range served {
+		go removeExpiredPeriodically(ctx, table, *expireEvery)
+	}
+	if probes != nil {
+		go probes.Run(ctx)
+	}
+	if *loadFile != "" {
+		go readLoadPeriodically(ctx, health, *loadFile, *loadInterval)
+	}
+	return serveAll(ctx, servers)
+}
+
+// load the comma separated zone files, each zone at most once
+func loadZones(filenames string) ([]*dns.Zone, error) {
+	var zones []*dns.Zone
+	files := map[string]string{}
+	for _, filename := range strings.Split(filenames, ",") {
+		zone, err := dns.LoadZone(filename)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := files[zone.Origin]; ok {
+			return nil, fmt.Errorf("zone %s defined in both '%s' and '%s'", zone.Origin, other, filename)
+		}
+		files[zone.Origin] = filename
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// parse a comma separated list of prefixes, empty for none
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse prefix '%s': %w", field, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// the dnstap logger of the -dnstap-socket or -dnstap-file output, nil without one
+func newDnstap(socket, file string, sample, buffer int) (*dnstap.Logger, error) {
+	options := dnstap.Options{SampleEvery: sample, BufferSize: buffer}
+	options.Identity, _ = os.Hostname()
+	switch {
+	case socket != "" && file != "":
+		return nil, fmt.Errorf("-dnstap-socket and -dnstap-file are mutually exclusive")
+	case socket != "":
+		return dnstap.NewSocket(socket, options), nil
+	case file != "":
+		return dnstap.NewFile(file, options)
+	}
+	return nil, nil
+}
+
+// server is a listener run by serve, *http.Server and *dns.Server
+type server struct {
+	addr    string
+	service interface {
+		ListenAndServe() error
+		Shutdown(ctx context.Context) error
+	}
+}
+
+// httpsServer serves with the certificate of its TLSConfig
+type httpsServer struct {
+	*http.Server
+}
+
+func (s httpsServer) ListenAndServe() error {
+	return s.ListenAndServeTLS("", "")
+}
+
+func newHTTPServer(addr string, handler http.Handler) server {
+	return server{addr, &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}}
+}
+
+// run the servers until ctx is done or one of them fails, then shut all of them down
+func serveAll(ctx context.Context, servers []server) error {
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			log.Printf("listening on %s", server.addr)
+			err := server.service.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, dns.ErrServerClosed) {
+				serveErr <- fmt.Errorf("server on %s failed: %w", server.addr, err)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.service.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("server on %s shutdown failed: %w", server.addr, shutdownErr)
+		}
+	}
+	return err
+}
+
+// compact the journal whenever there are several records to fold into one
+func compactPeriodically(ctx context.Context, d *optimised.Data, wal *journal.Log, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if wal.Records() <= 1 {
+				continue
+			}
+			if err := d.CompactJournal(); err != nil {
+				log.Printf("journal compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// drop expired rules, Route already ignores them so this only keeps the table, exports and the journal small
+func removeExpiredPeriodically(ctx context.Context, d *optimised.Data, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := d.RemoveExpired()
+			if err != nil {
+				log.Printf("removing expired rules failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("removed %d expired rules", removed)
+			}
+		}
+	}
+}
+
+// feed the load report file into health, a report that can not be read keeps the last loads
+func readLoadPeriodically(ctx context.Context, health *optimised.Health, loadFile string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		loads, err := optimised.LoadReports(loadFile)
+		if err != nil {
+			log.Printf("reading load reports failed: %v", err)
+		} else {
+			health.ReportLoad(loads)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reload the routing data read from source and the TLS certificate (nil without DNS over TLS or HTTPS) on SIGHUP,
+// what fails to load is kept as it was
+func reloadOnHangup(ctx context.Context, source string, reload func() error, cert *dns.Certificate) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := reload(); err != nil {
+				log.Printf("reload of '%s' failed, keeping the old table: %v", source, err)
+			} else {
+				log.Printf("reloaded '%s'", source)
+			}
+			if cert == nil {
+				continue
+			}
+			if err := cert.Reload(); err != nil {
+				log.Printf("keeping the old TLS certificate: %v", err)
+			} else {
+				log.Printf("reloaded the TLS certificate")
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"CDN77-DNS/optimised"
+	"CDN77-DNS/registry"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// print trie size and shape of a routing table
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	in := flags.String("in", "routing-data.txt", "routing data file to load")
+	registryConfig := flags.String("registry", "", "registry config, prints the stats of every table instead of -in")
+	histograms := flags.Bool("histograms", false, "print depth and prefix length histograms")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if *registryConfig != "" {
+		r, err := registry.Load(*registryConfig)
+		if err != nil {
+			return err
+		}
+		for i, table := range r.Tables() {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "table %s (%s), zones %v\n", table.Name, table.File, table.Zones)
+			writeStats(w, table.Data.Stats(), *histograms)
+		}
+		return w.Flush()
+	}
+
+	d := optimised.NewData()
+	if err := d.LoadRoutingData(*in); err != nil {
+		return err
+	}
+	writeStats(w, d.Stats(), *histograms)
+	return w.Flush()
+}
+
+func writeStats(w *bufio.Writer, stats optimised.Stats, histograms bool) {
+	fmt.Fprintf(w, "rules: %d\n", stats.Rules)
+	fmt.Fprintf(w, "nodes: %d\n", stats.Nodes)
+	fmt.Fprintf(w, "compressible nodes (no rule, single child): %d\n", stats.CompressibleNodes)
+	fmt.Fprintf(w, "estimated size: %d bytes\n", stats.EstimatedBytes)
+	if histograms {
+		fmt.Fprintln(w, "\ndepth  nodes  rules")
+		for depth := range stats.DepthHistogram {
+			if stats.DepthHistogram[depth] == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%5d  %5d  %5d\n", depth, stats.DepthHistogram[depth], stats.PrefixLenHistogram[depth])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a CLI subcommand, args excludes the subcommand name
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"audit":    {"audit -log audit.jsonl -prefix 2001:db8::/32", runAudit},
+	"diff":     {"diff -old routing-data.txt -new routing-data.new.txt [-out diff.txt]", runDiff},
+	"export":   {"export -in routing-data.txt [-out canonical.txt]", runExport},
+	"generate": {"generate -in rum.csv [-out routing-data.txt] [-min-samples 50] [-min-margin 0.05]", runGenerate},
+	"hits":     {"hits -in routing-data.txt -queries queries.txt [-top 10]", runHits},
+	"minimise": {"minimise -in routing-data.txt [-out minimal.txt] [-keep-scope]", runMinimise},
+	"rollback": {"rollback [-admin http://localhost:8053] [-serial 12] (ADMIN_TOKEN in the environment)", runRollback},
+	"route":    {"route (-in routing-data.txt | -registry tables.txt -qname www.example.com.) -ecs 2001:db8::/56", runRoute},
+	"serve":    {"serve -routing routing-data.txt [-metrics-addr :9153] [-admin-addr :8053 -admin-tokens tokens.txt] [-history 16] [-hit-counters] [-expire 1m] [-journal journal-dir [-journal-compact 10m]] [-audit-log audit.jsonl | -audit-slog] [-probes checks.txt] [-capacity capacity.txt [-load-reports load.txt]] [-dns-addr :53 | -dot-addr :853 | -doh-addr :443 (-tls-cert cert.pem -tls-key key.pem) -pops pops.txt [-dns-zones cdn.example.com] [-dns-zone-files cdn.zone] [-dns-ttl 30s] [-dns-cache 100000] [-rrl-rate 20 [-rrl-exempt 192.0.2.0/24]] [-dnstap-socket dnstap.sock | -dnstap-file dnstap.fstrm [-dnstap-sample 1]]]", runServe},
+	"stats":    {"stats (-in routing-data.txt | -registry tables.txt) [-histograms]", runStats},
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command '%s'", name)
+	}
+	return cmd.run(args)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+// open the output file or fall back to stdout when no file is given
+func createOutput(filename string) (*os.File, error) {
+	if filename == "" || filename == "-" {
+		return os.Stdout, nil
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file '%s': %w", filename, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,783 @@
+package admin
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server is an authenticated JSON HTTP API for reading and changing a live routing table.
+// Every change is published atomically by optimised.Data, lookups never see a half applied change.
+type Server struct {
+	table *optimised.Data
+	// PoP states the table fails over from, nil when not enabled (see SetHealth)
+	health *optimised.Health
+	// bearer token -> actor name
+	tokens map[string]string
+	mux    *http.ServeMux
+}
+
+// Rule is the JSON form of a routing rule
+type Rule struct {
+	Prefix string `json:"prefix"`
+	PoP    uint16 `json:"pop"`
+	// weights of a weighted rule in the routing data form, e.g. "1:70,2:30" (read only, PoP is the primary PoP)
+	Weights string `json:"weights,omitempty"`
+	// PoP taking over while PoP is down (read only, configured in the routing data)
+	Backup *uint16 `json:"backup,omitempty"`
+	// window the rule is in effect in (to the second), absent for an open end
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+func newRule(prefix netip.Prefix, target optimised.Target) Rule {
+	rule := Rule{Prefix: prefix.String(), PoP: target.PoP}
+	if target.Weighted() {
+		rule.Weights = target.PoPs()
+	}
+	if backup, ok := target.Backup(); ok {
+		rule.Backup = &backup
+	}
+	notBefore, notAfter := target.Window()
+	rule.NotBefore, rule.NotAfter = optionalTime(notBefore), optionalTime(notAfter)
+	return rule
+}
+
+// the window of a rule as the table takes it, zero for an open end
+func (rule Rule) window() (notBefore, notAfter time.Time) {
+	if rule.NotBefore != nil {
+		notBefore = *rule.NotBefore
+	}
+	if rule.NotAfter != nil {
+		notAfter = *rule.NotAfter
+	}
+	return notBefore, notAfter
+}
+
+// weights and backups come from the routing data, the API only shows them
+func (rule Rule) checkReadOnly() error {
+	if rule.Weights != "" || rule.Backup != nil {
+		return errors.New("weights and backup are read only, they are configured in the routing data")
+	}
+	return nil
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+type conflictResponse struct {
+	Kind     string `json:"kind"`
+	Rule     Rule   `json:"rule"`
+	Existing Rule   `json:"existing"`
+}
+
+type errorResponse struct {
+	Error    string            `json:"error"`
+	Conflict *conflictResponse `json:"conflict,omitempty"`
+	// every problem of a rejected transaction
+	Problems  []string           `json:"problems,omitempty"`
+	Conflicts []conflictResponse `json:"conflicts,omitempty"`
+}
+
+type txOperation struct {
+	// "insert" (adds or replaces the rule) or "delete"
+	Op     string `json:"op"`
+	Prefix string `json:"prefix"`
+	PoP    uint16 `json:"pop"`
+	// optional window of an inserted rule
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+type txRequest struct {
+	Ops []txOperation `json:"ops"`
+}
+
+type txResponse struct {
+	Applied int `json:"applied"`
+}
+
+// Version is the JSON form of a kept table version
+type Version struct {
+	Serial    uint64    `json:"serial"`
+	Published time.Time `json:"published"`
+	Source    string    `json:"source"`
+}
+
+// History is the response of GET /versions, Serial is the version being served
+type History struct {
+	Serial   uint64    `json:"serial"`
+	Versions []Version `json:"versions"`
+}
+
+// PoPState is the JSON form of a PoP's health state
+type PoPState struct {
+	PoP   uint16 `json:"pop"`
+	State string `json:"state"`
+}
+
+// Maintenance is the JSON form of a maintenance window, durations in Go syntax ("10m")
+type Maintenance struct {
+	ID    uint64    `json:"id"`
+	PoP   uint16    `json:"pop"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Drain string    `json:"drain"`
+	Ramp  string    `json:"ramp"`
+}
+
+func newMaintenance(m optimised.Maintenance) Maintenance {
+	return Maintenance{ID: m.ID, PoP: m.PoP, Start: m.Start, End: m.End, Drain: m.Drain.String(), Ramp: m.Ramp.String()}
+}
+
+// Capacity is the JSON form of a PoP's capacity with its last reported load
+type Capacity struct {
+	PoP      uint16   `json:"pop"`
+	Limit    float64  `json:"limit"`
+	Spill    float64  `json:"spill"`
+	Overflow []uint16 `json:"overflow"`
+	// last reported load and whether it is over the limit (read only)
+	Load       *float64 `json:"load,omitempty"`
+	Overloaded bool     `json:"overloaded"`
+}
+
+// RuleHits is the JSON form of a rule's hits in the current window
+type RuleHits struct {
+	Prefix string `json:"prefix"`
+	PoP    uint16 `json:"pop"`
+	Hits   uint64 `json:"hits"`
+}
+
+// HitReport is the response of GET /hits
+type HitReport struct {
+	Since   time.Time  `json:"since"`
+	Unused  []RuleHits `json:"unused"`
+	Hottest []RuleHits `json:"hottest"`
+}
+
+func newRuleHits(rules []optimised.RuleHits) []RuleHits {
+	result := make([]RuleHits, len(rules))
+	for i, rule := range rules {
+		result[i] = RuleHits{Prefix: rule.Prefix.String(), PoP: rule.PoP, Hits: rule.Hits}
+	}
+	return result
+}
+
+type lookupResponse struct {
+	ECS     string `json:"ecs"`
+	Matched bool   `json:"matched"`
+	PoP     uint16 `json:"pop"`
+	Scope   int    `json:"scope"`
+}
+
+// New creates the API for table, tokens maps accepted bearer tokens to actor names
+func New(table *optimised.Data, tokens map[string]string) *Server {
+	s := &Server{table: table, tokens: tokens, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /rules", s.listRules)
+	s.mux.HandleFunc("POST /rules", s.createRule)
+	s.mux.HandleFunc("GET /rules/{addr}/{bits}", s.getRule)
+	s.mux.HandleFunc("PUT /rules/{addr}/{bits}", s.updateRule)
+	s.mux.HandleFunc("DELETE /rules/{addr}/{bits}", s.deleteRule)
+	s.mux.HandleFunc("POST /transactions", s.transaction)
+	s.mux.HandleFunc("GET /versions", s.listVersions)
+	s.mux.HandleFunc("POST /versions/{serial}/rollback", s.rollback)
+	s.mux.HandleFunc("GET /lookup", s.lookup)
+	s.mux.HandleFunc("GET /hits", s.hitReport)
+	s.mux.HandleFunc("POST /hits/reset", s.resetHits)
+	s.mux.HandleFunc("GET /pops", s.listPoPs)
+	s.mux.HandleFunc("PUT /pops/{pop}", s.setPoPState)
+	s.mux.HandleFunc("GET /maintenance", s.listMaintenance)
+	s.mux.HandleFunc("POST /maintenance", s.addMaintenance)
+	s.mux.HandleFunc("DELETE /maintenance/{id}", s.removeMaintenance)
+	s.mux.HandleFunc("GET /capacity", s.listCapacity)
+	s.mux.HandleFunc("PUT /capacity/{pop}", s.setCapacity)
+	s.mux.HandleFunc("DELETE /capacity/{pop}", s.removeCapacity)
+	s.mux.HandleFunc("POST /load", s.reportLoad)
+	return s
+}
+
+// SetHealth enables the PoP state endpoints, health should be the one the table fails over with
+func (s *Server) SetHealth(health *optimised.Health) {
+	s.health = health
+}
+
+// request context key of the authenticated actor
+type actorKey struct{}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	actor, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+		return
+	}
+	s.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+}
+
+// the table changed on behalf of the request's actor, so the audit trail names who made the change
+func (s *Server) tableAs(r *http.Request) *optimised.Actor {
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	return s.table.As(actor)
+}
+
+// find the actor of the request's bearer token
+func (s *Server) authenticate(r *http.Request) (actor string, ok bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", false
+	}
+	// compare against every token so the timing does not leak which one matched
+	for knownToken, knownActor := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(knownToken)) == 1 {
+			actor, ok = knownActor, true
+		}
+	}
+	return actor, ok
+}
+
+// GET /rules lists all rules in address order, ?within=prefix limits them to rules inside prefix
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	withinPrefix := netip.MustParsePrefix("::/0")
+	if within := r.URL.Query().Get("within"); within != "" {
+		prefix, err := netip.ParsePrefix(within)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse prefix '%s': %w", within, err))
+			return
+		}
+		withinPrefix = prefix.Masked()
+	}
+
+	// only the subtrie under the prefix is walked
+	result := []Rule{}
+	for prefix, target := range s.table.WithinTargets(withinPrefix) {
+		result = append(result, newRule(prefix, target))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GET /rules/{addr}/{bits}
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) {
+	prefix, err := pathPrefix(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	target, ok := s.table.Target(prefix)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no rule for %s: %w", prefix, optimised.ErrRuleNotFound))
+		return
+	}
+	writeJSON(w, http.StatusOK, newRule(prefix, target))
+}
+
+// POST /rules {"prefix": "2001:db8::/32", "pop": 1}, optionally with "not_before" and "not_after" (RFC 3339)
+func (s *Server) createRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	if err := decodeBody(w, r, &rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	prefix, err := netip.ParsePrefix(rule.Prefix)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse prefix '%s': %w", rule.Prefix, err))
+		return
+	}
+	if err := rule.checkReadOnly(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	notBefore, notAfter := rule.window()
+	if err := s.tableAs(r).InsertBounded(prefix, rule.PoP, notBefore, notAfter); err != nil {
+		writeChangeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newRule(prefix.Masked(), optimised.Target{PoP: rule.PoP}.WithWindow(notBefore, notAfter)))
+}
+
+// PUT /rules/{addr}/{bits} {"pop": 2}, changes the PoP and the window of an existing rule
+// that has neither weights nor a backup
+func (s *Server) updateRule(w http.ResponseWriter, r *http.Request) {
+	prefix, err := pathPrefix(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var rule Rule
+	if err := decodeBody(w, r, &rule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := rule.checkReadOnly(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	notBefore, notAfter := rule.window()
+	if err := s.tableAs(r).UpdateBounded(prefix, rule.PoP, notBefore, notAfter); err != nil {
+		writeChangeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRule(prefix, optimised.Target{PoP: rule.PoP}.WithWindow(notBefore, notAfter)))
+}
+
+// DELETE /rules/{addr}/{bits}
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) {
+	prefix, err := pathPrefix(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.tableAs(r).Delete(prefix); err != nil {
+		writeChangeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /transactions {"ops": [{"op": "insert", "prefix": "2001:db8::/32", "pop": 2}, {"op": "delete", "prefix": "2001:db8:1::/48"}]}
+// applies all operations atomically or none of them
+func (s *Server) transaction(w http.ResponseWriter, r *http.Request) {
+	var req txRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx := s.tableAs(r).Begin()
+	for i, op := range req.Ops {
+		prefix, err := netip.ParsePrefix(op.Prefix)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: failed to parse prefix '%s': %w", i, op.Prefix, err))
+			return
+		}
+		switch op.Op {
+		case "insert":
+			notBefore, notAfter := Rule{NotBefore: op.NotBefore, NotAfter: op.NotAfter}.window()
+			tx.InsertBounded(prefix, op.PoP, notBefore, notAfter)
+		case "delete":
+			tx.Delete(prefix)
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: unknown op '%s', expected insert or delete", i, op.Op))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeTxError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, txResponse{Applied: len(req.Ops)})
+}
+
+// GET /versions lists the kept table versions, oldest first
+func (s *Server) listVersions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.history())
+}
+
+// POST /versions/{serial}/rollback publishes a kept version again and returns the new history
+func (s *Server) rollback(w http.ResponseWriter, r *http.Request) {
+	serial, err := strconv.ParseUint(r.PathValue("serial"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse serial '%s': %w", r.PathValue("serial"), err))
+		return
+	}
+	if err := s.tableAs(r).Rollback(serial); err != nil {
+		if errors.Is(err, optimised.ErrVersionNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.history())
+}
+
+func (s *Server) history() History {
+	versions := s.table.Versions()
+	history := History{Serial: s.table.Serial(), Versions: make([]Version, len(versions))}
+	for i, v := range versions {
+		history.Versions[i] = Version{Serial: v.Serial, Published: v.Published, Source: v.Source}
+	}
+	return history
+}
+
+// GET /pops lists the PoPs that are not up, sorted by PoP ID
+func (s *Server) listPoPs(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	states := s.health.States()
+	result := make([]PoPState, 0, len(states))
+	for _, popID := range slices.Sorted(maps.Keys(states)) {
+		result = append(result, PoPState{PoP: popID, State: states[popID].String()})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// PUT /pops/{pop} {"state": "down"} marks a PoP up, draining or down
+func (s *Server) setPoPState(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	popID, err := strconv.ParseUint(r.PathValue("pop"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse PoP ID '%s': %w", r.PathValue("pop"), err))
+		return
+	}
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := decodeBody(w, r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	state, err := optimised.ParsePoPState(body.State)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	if previous := s.health.Set(uint16(popID), state); previous != state {
+		log.Printf("PoP %d marked %s by %s (was %s)", popID, state, actor, previous)
+	}
+	writeJSON(w, http.StatusOK, PoPState{PoP: uint16(popID), State: state.String()})
+}
+
+// GET /maintenance lists the maintenance windows that have not finished yet
+func (s *Server) listMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	result := []Maintenance{}
+	for _, m := range s.health.Maintenance() {
+		result = append(result, newMaintenance(m))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// POST /maintenance {"pop": 1, "start": "2026-03-01T02:00:00Z", "end": "2026-03-01T04:00:00Z", "drain": "20m", "ramp": "20m"}
+// schedules a window in which the PoP drains onto the rules' backup PoPs and ramps back up
+func (s *Server) addMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	var body Maintenance
+	if err := decodeBody(w, r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	m := optimised.Maintenance{PoP: body.PoP, Start: body.Start, End: body.End}
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{{"drain", body.Drain, &m.Drain}, {"ramp", body.Ramp, &m.Ramp}} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse %s '%s': %w", d.name, d.value, err))
+			return
+		}
+		*d.into = duration
+	}
+	m, err := s.health.AddMaintenance(m)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	log.Printf("maintenance %d of PoP %d from %s to %s scheduled by %s", m.ID, m.PoP, m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339), actor)
+	writeJSON(w, http.StatusCreated, newMaintenance(m))
+}
+
+// DELETE /maintenance/{id} cancels a window, the PoP takes its full share again at once
+func (s *Server) removeMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse maintenance ID '%s': %w", r.PathValue("id"), err))
+		return
+	}
+	if !s.health.RemoveMaintenance(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no maintenance %d", id))
+		return
+	}
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	log.Printf("maintenance %d cancelled by %s", id, actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /capacity lists the PoPs with a capacity limit and their last reported load
+func (s *Server) listCapacity(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	loads := s.health.Loads()
+	result := []Capacity{}
+	for _, c := range s.health.Capacities() {
+		capacity := Capacity{PoP: c.PoP, Limit: c.Limit, Spill: c.Spill, Overflow: c.Overflow, Overloaded: s.health.Overloaded(c.PoP)}
+		if load, ok := loads[c.PoP]; ok {
+			capacity.Load = &load
+		}
+		result = append(result, capacity)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// PUT /capacity/{pop} {"limit": 400, "spill": 0.3, "overflow": [2, 3]} sets the load above which
+// the spill fraction of the PoP's subnets is answered by the overflow PoPs
+func (s *Server) setCapacity(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	popID, err := strconv.ParseUint(r.PathValue("pop"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse PoP ID '%s': %w", r.PathValue("pop"), err))
+		return
+	}
+	var body Capacity
+	if err := decodeBody(w, r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c := optimised.Capacity{PoP: uint16(popID), Limit: body.Limit, Spill: body.Spill, Overflow: body.Overflow}
+	if err := s.health.SetCapacity(c); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	log.Printf("capacity of PoP %d set to %g (spill %g to %v) by %s", c.PoP, c.Limit, c.Spill, c.Overflow, actor)
+	writeJSON(w, http.StatusOK, Capacity{PoP: c.PoP, Limit: c.Limit, Spill: c.Spill, Overflow: c.Overflow, Overloaded: s.health.Overloaded(c.PoP)})
+}
+
+// DELETE /capacity/{pop} removes the PoP's limit, it stops spilling
+func (s *Server) removeCapacity(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	popID, err := strconv.ParseUint(r.PathValue("pop"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse PoP ID '%s': %w", r.PathValue("pop"), err))
+		return
+	}
+	if !s.health.RemoveCapacity(uint16(popID)) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no capacity for PoP %d", popID))
+		return
+	}
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	log.Printf("capacity of PoP %d removed by %s", popID, actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /load {"1": 380.5, "2": 120} reports the current load of PoPs, PoPs not listed keep their last load
+func (s *Server) reportLoad(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeError(w, http.StatusNotFound, errors.New("PoP health is not enabled"))
+		return
+	}
+	var loads map[uint16]float64
+	if err := decodeBody(w, r, &loads); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.health.ReportLoad(loads)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /hits?top=10 lists the rules unused since the window started and the top most used ones
+func (s *Server) hitReport(w http.ResponseWriter, r *http.Request) {
+	if !s.table.HitCountersEnabled() {
+		writeError(w, http.StatusNotFound, errors.New("hit counters are not enabled"))
+		return
+	}
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse top '%s', expected a number of rules", value))
+			return
+		}
+	}
+	report := s.table.HitReport(top)
+	writeJSON(w, http.StatusOK, HitReport{Since: report.Since, Unused: newRuleHits(report.Unused), Hottest: newRuleHits(report.Hottest)})
+}
+
+// POST /hits/reset zeroes the hit counters and starts a new window
+func (s *Server) resetHits(w http.ResponseWriter, r *http.Request) {
+	if !s.table.HitCountersEnabled() {
+		writeError(w, http.StatusNotFound, errors.New("hit counters are not enabled"))
+		return
+	}
+	s.table.ResetHitCounters()
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	log.Printf("hit counters reset by %s", actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /lookup?ecs=2001:db8::/56 answers like the DNS server would
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) {
+	ecs, err := ParseECS(r.URL.Query().Get("ecs"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pop, scope := s.table.Route(ecs)
+	writeJSON(w, http.StatusOK, lookupResponse{ECS: ecs.String(), Matched: scope >= 0, PoP: pop, Scope: scope})
+}
+
+// ParseECS accepts both CIDR and plain addresses, a plain address is a full length subnet
+func ParseECS(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ecs, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ECS subnet '%s': %w", s, err)
+		}
+		return ecs, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("failed to parse ECS address '%s'", s)
+	}
+	bits := len(ip) * 8
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// LoadTokens reads "actor token" lines
+func LoadTokens(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file '%s': %w", filename, err)
+	}
+	defer file.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected 2 fields (actor, token), got %d on line %d", len(parts), lineNumber)
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading tokens file '%s': %w", filename, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tokens file '%s' contains no tokens", filename)
+	}
+	return tokens, nil
+}
+
+// the prefix addressed by /rules/{addr}/{bits}
+func pathPrefix(r *http.Request) (netip.Prefix, error) {
+	s := r.PathValue("addr") + "/" + r.PathValue("bits")
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("failed to parse prefix '%s': %w", s, err)
+	}
+	return prefix.Masked(), nil
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return nil
+}
+
+// map errors of table changes to status codes, conflicts carry the conflicting rule
+func writeChangeError(w http.ResponseWriter, err error) {
+	var conflict *optimised.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		conflictResp := newConflictResponse(conflict)
+		writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error(), Conflict: &conflictResp})
+	case errors.Is(err, optimised.ErrRuleNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, optimised.ErrRoutingDataTarget):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, optimised.ErrJournal):
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+// a rejected transaction lists all its problems, 409 if any of them is a conflict or replaces a routing data rule
+func writeTxError(w http.ResponseWriter, err error) {
+	var txErr *optimised.TxError
+	if !errors.As(err, &txErr) {
+		writeChangeError(w, err)
+		return
+	}
+
+	resp := errorResponse{Error: "transaction rejected"}
+	for _, problem := range txErr.Errors {
+		resp.Problems = append(resp.Problems, problem.Error())
+	}
+	for _, conflict := range txErr.Conflicts() {
+		resp.Conflicts = append(resp.Conflicts, newConflictResponse(conflict))
+	}
+	status := http.StatusBadRequest
+	if len(resp.Conflicts) > 0 || errors.Is(err, optimised.ErrRoutingDataTarget) {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, resp)
+}
+
+func newConflictResponse(conflict *optimised.ConflictError) conflictResponse {
+	return conflictResponse{
+		Kind:     conflict.Kind.String(),
+		Rule:     Rule{Prefix: conflict.Prefix.String(), PoP: conflict.PoP, Weights: conflict.Weights},
+		Existing: Rule{Prefix: conflict.Existing.String(), PoP: conflict.ExistingPoP, Weights: conflict.ExistingWeights},
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
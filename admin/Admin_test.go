@@ -0,0 +1,495 @@
+package admin
+
+import (
+	"CDN77-DNS/optimised"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "secret-token"
+
+func newTestServer(t *testing.T) (*httptest.Server, *optimised.Data) {
+	t.Helper()
+	table := optimised.NewData()
+	for prefix, popID := range map[string]uint16{"2001:db8::/32": 100, "2001:db8:aaaa::/48": 100, "2001:db9::/32": 200} {
+		if err := table.Insert(netip.MustParsePrefix(prefix), popID); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	server := httptest.NewServer(New(table, map[string]string{testToken: "alice"}))
+	t.Cleanup(server.Close)
+	return server, table
+}
+
+// do sends an authenticated request and decodes the JSON response into out (if not nil)
+func do(t *testing.T, server *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: failed to decode %q: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuthentication(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, header := range []string{"", "Bearer wrong", "Basic " + testToken} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/rules", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d, want 401", header, resp.StatusCode)
+		}
+	}
+}
+
+func TestRuleCRUD(t *testing.T) {
+	server, table := newTestServer(t)
+
+	var rules []Rule
+	if status := do(t, server, http.MethodGet, "/rules", "", &rules); status != http.StatusOK || len(rules) != 3 || rules[0] != (Rule{Prefix: "2001:db8::/32", PoP: 100}) {
+		t.Fatalf("list: got %d %+v", status, rules)
+	}
+	if status := do(t, server, http.MethodGet, "/rules?within=2001:db8::/32", "", &rules); status != http.StatusOK || len(rules) != 2 {
+		t.Errorf("list within: got %d %+v", status, rules)
+	}
+
+	var rule Rule
+	if status := do(t, server, http.MethodGet, "/rules/2001:db8:aaaa::/48", "", &rule); status != http.StatusOK || rule != (Rule{Prefix: "2001:db8:aaaa::/48", PoP: 100}) {
+		t.Errorf("get: got %d %+v", status, rule)
+	}
+	if status := do(t, server, http.MethodGet, "/rules/2001:dba::/32", "", nil); status != http.StatusNotFound {
+		t.Errorf("get missing: got %d, want 404", status)
+	}
+
+	if status := do(t, server, http.MethodPost, "/rules", `{"prefix": "2001:dba::1/32", "pop": 300}`, &rule); status != http.StatusCreated || rule != (Rule{Prefix: "2001:dba::/32", PoP: 300}) {
+		t.Errorf("create: got %d %+v", status, rule)
+	}
+	if popID, ok := table.Rule(netip.MustParsePrefix("2001:dba::/32")); !ok || popID != 300 {
+		t.Errorf("created rule not in table: %d %v", popID, ok)
+	}
+
+	if status := do(t, server, http.MethodPut, "/rules/2001:db9::/32", `{"pop": 201}`, &rule); status != http.StatusOK || rule.PoP != 201 {
+		t.Errorf("update: got %d %+v", status, rule)
+	}
+	if status := do(t, server, http.MethodPut, "/rules/2001:dbb::/32", `{"pop": 1}`, nil); status != http.StatusNotFound {
+		t.Errorf("update missing: got %d, want 404", status)
+	}
+
+	if status := do(t, server, http.MethodDelete, "/rules/2001:db9::/32", "", nil); status != http.StatusNoContent {
+		t.Errorf("delete: got %d, want 204", status)
+	}
+	if status := do(t, server, http.MethodDelete, "/rules/2001:db9::/32", "", nil); status != http.StatusNotFound {
+		t.Errorf("delete missing: got %d, want 404", status)
+	}
+
+	t.Run("BadRequests", func(t *testing.T) {
+		for _, tc := range []struct{ method, path, body string }{
+			{http.MethodPost, "/rules", `{"prefix": "nope", "pop": 1}`},
+			{http.MethodPost, "/rules", `{"prefix": "10.0.0.0/8", "pop": 1}`},
+			{http.MethodPost, "/rules", `{"prefix": "2001:dbc::/32", "pop": 1, "extra": true}`},
+			{http.MethodPost, "/rules", `{"prefix": "2001:dbc::/32", "pop": 70000}`},
+			{http.MethodPost, "/rules", `{"prefix": "2001:dbc::/32", "pop": 1, "weights": "1:70,2:30"}`},
+			{http.MethodPost, "/rules", `{"prefix": "2001:dbc::/32", "pop": 1, "backup": 2}`},
+			{http.MethodPut, "/rules/2001:db8::/32", `{"pop": 1, "backup": 2}`},
+			{http.MethodGet, "/rules/2001:db8::/999", ""},
+			{http.MethodGet, "/lookup?ecs=nope", ""},
+		} {
+			if status := do(t, server, tc.method, tc.path, tc.body, nil); status != http.StatusBadRequest {
+				t.Errorf("%s %s %s: got %d, want 400", tc.method, tc.path, tc.body, status)
+			}
+		}
+	})
+}
+
+func TestUpdateRoutingDataRule(t *testing.T) {
+	routingFile := filepath.Join(t.TempDir(), "routing.txt")
+	if err := os.WriteFile(routingFile, []byte("2001:db8::/32 1:70,2:30\n2001:db9::/32 1 backup=2\n2001:dba::/32 3\n"), 0644); err != nil {
+		t.Fatalf("Failed to write routing data: %v", err)
+	}
+	table := optimised.NewData()
+	if err := table.LoadRoutingData(routingFile); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	server := httptest.NewServer(New(table, map[string]string{testToken: "alice"}))
+	defer server.Close()
+
+	// the change would drop the weights or the backup, the rule stays as loaded
+	for _, prefix := range []string{"2001:db8::/32", "2001:db9::/32"} {
+		before, _ := table.Target(netip.MustParsePrefix(prefix))
+		if status := do(t, server, http.MethodPut, "/rules/"+prefix, `{"pop": 1}`, nil); status != http.StatusConflict {
+			t.Errorf("update %s: got %d, want 409", prefix, status)
+		}
+		if status := do(t, server, http.MethodPost, "/rules", `{"prefix": "`+prefix+`", "pop": 1}`, nil); status != http.StatusConflict {
+			t.Errorf("insert %s: got %d, want 409", prefix, status)
+		}
+		if after, _ := table.Target(netip.MustParsePrefix(prefix)); after != before {
+			t.Errorf("update %s changed the rule from %s to %s", prefix, before, after)
+		}
+	}
+	var rule Rule
+	if status := do(t, server, http.MethodPut, "/rules/2001:dba::/32", `{"pop": 4}`, &rule); status != http.StatusOK || rule != (Rule{Prefix: "2001:dba::/32", PoP: 4}) {
+		t.Errorf("update of a single PoP rule: got %d %+v", status, rule)
+	}
+}
+
+func TestConflictResponse(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	var resp errorResponse
+	status := do(t, server, http.MethodPost, "/rules", `{"prefix": "2001:db8:bbbb::/48", "pop": 300}`, &resp)
+	if status != http.StatusConflict {
+		t.Fatalf("got status %d, want 409", status)
+	}
+	want := conflictResponse{
+		Kind:     "broader",
+		Rule:     Rule{Prefix: "2001:db8:bbbb::/48", PoP: 300},
+		Existing: Rule{Prefix: "2001:db8::/32", PoP: 100},
+	}
+	if resp.Conflict == nil || *resp.Conflict != want {
+		t.Errorf("conflict: got %+v, want %+v", resp.Conflict, want)
+	}
+	if !strings.Contains(resp.Error, "conflicts with broader rule") {
+		t.Errorf("unexpected error message %q", resp.Error)
+	}
+
+	status = do(t, server, http.MethodPut, "/rules/2001:db8::/32", `{"pop": 300}`, &resp)
+	want = conflictResponse{
+		Kind:     "narrower",
+		Rule:     Rule{Prefix: "2001:db8::/32", PoP: 300},
+		Existing: Rule{Prefix: "2001:db8:aaaa::/48", PoP: 100},
+	}
+	if status != http.StatusConflict || resp.Conflict == nil || *resp.Conflict != want {
+		t.Errorf("update conflict: got %d %+v, want 409 %+v", status, resp.Conflict, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	var resp lookupResponse
+	if status := do(t, server, http.MethodGet, "/lookup?ecs=2001:db8:aaaa::/56", "", &resp); status != http.StatusOK ||
+		resp != (lookupResponse{ECS: "2001:db8:aaaa::/56", Matched: true, PoP: 100, Scope: 48}) {
+		t.Errorf("lookup: got %d %+v", status, resp)
+	}
+	if status := do(t, server, http.MethodGet, "/lookup?ecs=2002::1", "", &resp); status != http.StatusOK || resp.Matched || resp.Scope != -1 {
+		t.Errorf("lookup unmatched: got %d %+v", status, resp)
+	}
+}
+
+func TestHits(t *testing.T) {
+	server, table := newTestServer(t)
+	if status := do(t, server, http.MethodGet, "/hits", "", nil); status != http.StatusNotFound {
+		t.Errorf("hits while disabled: got %d, want 404", status)
+	}
+	table.EnableHitCounters(true)
+	for _, ecs := range []string{"2001:db8:aaaa::/56", "2001:db8:aaaa::/64", "2001:db8:1::/48"} {
+		do(t, server, http.MethodGet, "/lookup?ecs="+ecs, "", nil)
+	}
+
+	var report HitReport
+	if status := do(t, server, http.MethodGet, "/hits?top=1", "", &report); status != http.StatusOK {
+		t.Fatalf("hits: got %d", status)
+	}
+	if len(report.Hottest) != 1 || report.Hottest[0] != (RuleHits{Prefix: "2001:db8:aaaa::/48", PoP: 100, Hits: 2}) {
+		t.Errorf("got hottest %+v", report.Hottest)
+	}
+	if len(report.Unused) != 1 || report.Unused[0].Prefix != "2001:db9::/32" || report.Since.IsZero() {
+		t.Errorf("got unused %+v since %s", report.Unused, report.Since)
+	}
+	if status := do(t, server, http.MethodGet, "/hits?top=many", "", nil); status != http.StatusBadRequest {
+		t.Errorf("bad top: got %d, want 400", status)
+	}
+
+	if status := do(t, server, http.MethodPost, "/hits/reset", "", nil); status != http.StatusNoContent {
+		t.Errorf("reset: got %d, want 204", status)
+	}
+	if status := do(t, server, http.MethodGet, "/hits", "", &report); status != http.StatusOK || len(report.Hottest) != 0 || len(report.Unused) != 3 {
+		t.Errorf("after the reset: got %d %+v", status, report)
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tokens.txt")
+	if err := os.WriteFile(filePath, []byte("alice token-a\n\nbob token-b\n"), 0600); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tokens, err := LoadTokens(filePath)
+	if err != nil {
+		t.Fatalf("LoadTokens failed: %v", err)
+	}
+	if len(tokens) != 2 || tokens["token-a"] != "alice" || tokens["token-b"] != "bob" {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+
+	if err := os.WriteFile(filePath, []byte("alice\n"), 0600); err != nil {
+		t.Fatalf("Failed to write temp file: %v", err)
+	}
+	if _, err := LoadTokens(filePath); err == nil || !strings.Contains(err.Error(), "expected 2 fields") {
+		t.Errorf("expected field count error, got %v", err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	server, table := newTestServer(t)
+
+	t.Run("Commit", func(t *testing.T) {
+		var resp txResponse
+		body := `{"ops": [
+			{"op": "insert", "prefix": "2001:db8:aaaa::/48", "pop": 300},
+			{"op": "insert", "prefix": "2001:db8::/32", "pop": 300},
+			{"op": "delete", "prefix": "2001:db9::/32"}
+		]}`
+		if status := do(t, server, http.MethodPost, "/transactions", body, &resp); status != http.StatusOK || resp.Applied != 3 {
+			t.Fatalf("transaction: got %d %+v", status, resp)
+		}
+		if popID, ok := table.Rule(netip.MustParsePrefix("2001:db8::/32")); !ok || popID != 300 {
+			t.Errorf("transaction not applied: %d %v", popID, ok)
+		}
+		if _, ok := table.Rule(netip.MustParsePrefix("2001:db9::/32")); ok {
+			t.Error("deleted rule still present")
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		var resp errorResponse
+		body := `{"ops": [
+			{"op": "insert", "prefix": "2001:db8:cccc::/48", "pop": 1},
+			{"op": "insert", "prefix": "2001:db8:dddd::/48", "pop": 2},
+			{"op": "delete", "prefix": "2001:dba::/32"}
+		]}`
+		if status := do(t, server, http.MethodPost, "/transactions", body, &resp); status != http.StatusConflict {
+			t.Fatalf("got status %d, want 409", status)
+		}
+		if len(resp.Conflicts) != 2 || len(resp.Problems) != 3 {
+			t.Errorf("expected 2 conflicts and 3 problems, got %+v", resp)
+		}
+		if _, ok := table.Rule(netip.MustParsePrefix("2001:db8:cccc::/48")); ok {
+			t.Error("rejected transaction was partially applied")
+		}
+	})
+
+	t.Run("BadOp", func(t *testing.T) {
+		if status := do(t, server, http.MethodPost, "/transactions", `{"ops": [{"op": "upsert", "prefix": "2001:db8::/32"}]}`, nil); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", status)
+		}
+	})
+}
+
+func TestRollback(t *testing.T) {
+	server, table := newTestServer(t)
+	before := table.Serial()
+	if status := do(t, server, http.MethodDelete, "/rules/2001:db9::/32", "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete: got %d, want 204", status)
+	}
+
+	var history History
+	if status := do(t, server, http.MethodGet, "/versions", "", &history); status != http.StatusOK || history.Serial != before+1 {
+		t.Fatalf("versions: got %d %+v", status, history)
+	}
+	if last := history.Versions[len(history.Versions)-1]; last.Serial != history.Serial || last.Source != "delete 2001:db9::/32" {
+		t.Errorf("unexpected latest version %+v", last)
+	}
+
+	if status := do(t, server, http.MethodPost, "/versions/"+strconv.FormatUint(before, 10)+"/rollback", "", &history); status != http.StatusOK || history.Serial != before+2 {
+		t.Fatalf("rollback: got %d %+v", status, history)
+	}
+	if popID, ok := table.Rule(netip.MustParsePrefix("2001:db9::/32")); !ok || popID != 200 {
+		t.Errorf("rollback did not restore the deleted rule: %d %v", popID, ok)
+	}
+
+	if status := do(t, server, http.MethodPost, "/versions/999/rollback", "", nil); status != http.StatusNotFound {
+		t.Errorf("rollback to missing version: got %d, want 404", status)
+	}
+	if status := do(t, server, http.MethodPost, "/versions/latest/rollback", "", nil); status != http.StatusBadRequest {
+		t.Errorf("rollback to invalid serial: got %d, want 400", status)
+	}
+}
+
+type actorAuditor struct {
+	actors []string
+}
+
+func (a *actorAuditor) Audit(record optimised.AuditRecord) {
+	a.actors = append(a.actors, record.Actor)
+}
+
+func TestChangesAttributedToActor(t *testing.T) {
+	server, table := newTestServer(t)
+	auditor := &actorAuditor{}
+	table.SetAuditor(auditor)
+
+	if status := do(t, server, http.MethodDelete, "/rules/2001:db9::/32", "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete: got %d, want 204", status)
+	}
+	if len(auditor.actors) != 1 || auditor.actors[0] != "alice" {
+		t.Errorf("expected the change to be attributed to alice, got %v", auditor.actors)
+	}
+}
+
+func TestPoPStates(t *testing.T) {
+	table := optimised.NewData()
+	if err := table.Insert(netip.MustParsePrefix("2001:db8::/32"), 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	api := New(table, map[string]string{testToken: "alice"})
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	if status := do(t, server, http.MethodGet, "/pops", "", nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 without health, got %d", status)
+	}
+	health := optimised.NewHealth()
+	table.SetHealth(health)
+	api.SetHealth(health)
+
+	var state PoPState
+	if status := do(t, server, http.MethodPut, "/pops/100", `{"state": "down"}`, &state); status != http.StatusOK || state != (PoPState{PoP: 100, State: "down"}) {
+		t.Fatalf("set state: got %d %+v", status, state)
+	}
+	if status := do(t, server, http.MethodPut, "/pops/100", `{"state": "asleep"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("unknown state: got %d", status)
+	}
+	var states []PoPState
+	if status := do(t, server, http.MethodGet, "/pops", "", &states); status != http.StatusOK || len(states) != 1 || states[0] != state {
+		t.Errorf("list: got %d %+v", status, states)
+	}
+	if health.State(100) != optimised.PoPDown {
+		t.Errorf("health not updated: %s", health.State(100))
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	table := optimised.NewData()
+	health := optimised.NewHealth()
+	api := New(table, map[string]string{testToken: "alice"})
+	api.SetHealth(health)
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	start := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body := fmt.Sprintf(`{"pop": 1, "start": %q, "end": %q, "drain": "20m", "ramp": "10m"}`, start.Format(time.RFC3339), start.Add(time.Hour).Format(time.RFC3339))
+	var created Maintenance
+	if status := do(t, server, http.MethodPost, "/maintenance", body, &created); status != http.StatusCreated ||
+		created != (Maintenance{ID: 1, PoP: 1, Start: start, End: start.Add(time.Hour), Drain: "20m0s", Ramp: "10m0s"}) {
+		t.Fatalf("add: got %d %+v", status, created)
+	}
+	badBody := fmt.Sprintf(`{"pop": 1, "start": %q, "end": %q, "drain": "2h"}`, start.Format(time.RFC3339), start.Add(time.Hour).Format(time.RFC3339))
+	if status := do(t, server, http.MethodPost, "/maintenance", badBody, nil); status != http.StatusBadRequest {
+		t.Errorf("window ending before drained: got %d", status)
+	}
+	var windows []Maintenance
+	if status := do(t, server, http.MethodGet, "/maintenance", "", &windows); status != http.StatusOK || len(windows) != 1 || windows[0] != created {
+		t.Errorf("list: got %d %+v", status, windows)
+	}
+	if status := do(t, server, http.MethodDelete, "/maintenance/1", "", nil); status != http.StatusNoContent {
+		t.Errorf("delete: got %d", status)
+	}
+	if status := do(t, server, http.MethodDelete, "/maintenance/1", "", nil); status != http.StatusNotFound {
+		t.Errorf("delete again: got %d", status)
+	}
+}
+
+func TestRuleWindow(t *testing.T) {
+	server, table := newTestServer(t)
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	// a temporary move next to the permanent rules, fractions of a second are dropped
+	var created Rule
+	body := fmt.Sprintf(`{"prefix": "2001:dba::/32", "pop": 300, "not_after": %q}`, notAfter.Add(500*time.Millisecond).Format(time.RFC3339Nano))
+	if status := do(t, server, http.MethodPost, "/rules", body, &created); status != http.StatusCreated {
+		t.Fatalf("POST /rules: got status %d", status)
+	}
+	if created.NotBefore != nil || created.NotAfter == nil || !created.NotAfter.Equal(notAfter) {
+		t.Errorf("got window %v - %v, want open - %s", created.NotBefore, created.NotAfter, notAfter)
+	}
+	var rule Rule
+	if status := do(t, server, http.MethodGet, "/rules/2001:dba::/32", "", &rule); status != http.StatusOK || rule.NotAfter == nil || !rule.NotAfter.Equal(notAfter) {
+		t.Errorf("GET: got status %d, rule %+v", status, rule)
+	}
+	if pop, _ := table.Route(&net.IPNet{IP: net.ParseIP("2001:dba::"), Mask: net.CIDRMask(56, 128)}); pop != 300 {
+		t.Errorf("Route: got PoP %d, want 300", pop)
+	}
+
+	var errResp errorResponse
+	body = fmt.Sprintf(`{"pop": 300, "not_before": %q, "not_after": %q}`, notAfter.Format(time.RFC3339), notAfter.Add(-time.Hour).Format(time.RFC3339))
+	if status := do(t, server, http.MethodPut, "/rules/2001:dba::/32", body, &errResp); status != http.StatusBadRequest || !strings.Contains(errResp.Error, "window ends before it starts") {
+		t.Errorf("PUT with an inverted window: got status %d, %+v", status, errResp)
+	}
+
+	// a rule that starts once the broader rule's window is over does not conflict with it
+	body = fmt.Sprintf(`{"ops": [{"op": "insert", "prefix": "2001:dba:1::/48", "pop": 400, "not_before": %q}]}`, notAfter.Add(time.Second).Format(time.RFC3339))
+	if status := do(t, server, http.MethodPost, "/transactions", body, nil); status != http.StatusOK {
+		t.Errorf("POST /transactions: got status %d", status)
+	}
+	if status := do(t, server, http.MethodPost, "/rules", `{"prefix": "2001:dba:2::/48", "pop": 400}`, &errResp); status != http.StatusConflict {
+		t.Errorf("POST overlapping rule: got status %d, want 409", status)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	table := optimised.NewData()
+	health := optimised.NewHealth()
+	table.SetHealth(health)
+	api := New(table, map[string]string{testToken: "alice"})
+	api.SetHealth(health)
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	var capacity Capacity
+	if status := do(t, server, http.MethodPut, "/capacity/1", `{"limit": 400, "spill": 0.3, "overflow": [2, 3]}`, &capacity); status != http.StatusOK || capacity.Limit != 400 {
+		t.Fatalf("PUT /capacity/1: got %d %+v", status, capacity)
+	}
+	if status := do(t, server, http.MethodPut, "/capacity/1", `{"limit": 400, "spill": 0.3, "overflow": []}`, nil); status != http.StatusBadRequest {
+		t.Errorf("capacity without overflow PoPs: got %d, want 400", status)
+	}
+	if status := do(t, server, http.MethodPost, "/load", `{"1": 420.5, "2": 100}`, nil); status != http.StatusNoContent {
+		t.Fatalf("POST /load: got %d", status)
+	}
+	var capacities []Capacity
+	if status := do(t, server, http.MethodGet, "/capacity", "", &capacities); status != http.StatusOK || len(capacities) != 1 ||
+		capacities[0].Load == nil || *capacities[0].Load != 420.5 || !capacities[0].Overloaded {
+		t.Errorf("GET /capacity: got %d %+v", status, capacities)
+	}
+	if !health.Overloaded(1) {
+		t.Error("health not updated")
+	}
+	if status := do(t, server, http.MethodDelete, "/capacity/1", "", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE /capacity/1: got %d", status)
+	}
+	if status := do(t, server, http.MethodDelete, "/capacity/1", "", nil); status != http.StatusNotFound {
+		t.Errorf("second DELETE /capacity/1: got %d, want 404", status)
+	}
+}
@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is the JSON Lines form of an optimised.AuditRecord
+type Record struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Source string    `json:"source"`
+	Serial uint64    `json:"serial"`
+	Prefix string    `json:"prefix"`
+	// PoP (primary PoP of a weighted rule), null when there was or is no rule for the prefix
+	Before *uint16 `json:"before"`
+	After  *uint16 `json:"after"`
+	// routing data form of a rule that is more than a single PoP, e.g. "1:70,2:30" or "12 backup=13"
+	BeforeTarget string `json:"before_target,omitempty"`
+	AfterTarget  string `json:"after_target,omitempty"`
+}
+
+func newRecord(record optimised.AuditRecord) Record {
+	r := Record{
+		Time:   record.Time.UTC(),
+		Actor:  record.Actor,
+		Source: record.Source,
+		Serial: record.Serial,
+		Prefix: record.Prefix.String(),
+	}
+	r.Before, r.BeforeTarget = splitTarget(record.Before)
+	r.After, r.AfterTarget = splitTarget(record.After)
+	return r
+}
+
+// the primary PoP and, unless the target is just that PoP, its routing data form
+func splitTarget(target *optimised.Target) (*uint16, string) {
+	if target == nil {
+		return nil, ""
+	}
+	popID := target.PoP
+	if *target == (optimised.Target{PoP: popID}) {
+		return &popID, ""
+	}
+	return &popID, target.String()
+}
+
+// JSONLines appends one JSON record per line to a file, it implements optimised.Auditor
+type JSONLines struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLines opens filename for appending, creating it if needed
+func NewJSONLines(filename string) (*JSONLines, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log '%s': %w", filename, err)
+	}
+	return &JSONLines{file: file}, nil
+}
+
+func (j *JSONLines) Audit(record optimised.AuditRecord) {
+	line, err := json.Marshal(newRecord(record))
+	if err != nil {
+		log.Printf("failed to encode audit record: %v", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a single write per record keeps lines whole even with other writers appending to the file
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.Printf("failed to write audit record: %v", err)
+	}
+}
+
+func (j *JSONLines) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// Slog logs every record as a structured log entry, it implements optimised.Auditor
+type Slog struct {
+	logger *slog.Logger
+}
+
+func NewSlog(logger *slog.Logger) *Slog {
+	return &Slog{logger: logger}
+}
+
+func (s *Slog) Audit(record optimised.AuditRecord) {
+	r := newRecord(record)
+	attrs := []any{
+		slog.String("actor", r.Actor),
+		slog.String("source", r.Source),
+		slog.Uint64("serial", r.Serial),
+		slog.String("prefix", r.Prefix),
+		slog.Any("before", r.Before),
+		slog.Any("after", r.After),
+	}
+	if r.BeforeTarget != "" {
+		attrs = append(attrs, slog.String("before_target", r.BeforeTarget))
+	}
+	if r.AfterTarget != "" {
+		attrs = append(attrs, slog.String("after_target", r.AfterTarget))
+	}
+	s.logger.Info("routing rule changed", attrs...)
+}
+
+// Query reads JSON Lines records and returns the ones whose prefix overlaps prefix (contains it or lies within it), in order
+func Query(r io.Reader, prefix netip.Prefix) ([]Record, error) {
+	prefix = prefix.Masked()
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid audit record on line %d: %w", lineNumber, err)
+		}
+		recordPrefix, err := netip.ParsePrefix(record.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix on line %d: %w", lineNumber, err)
+		}
+		if recordPrefix.Overlaps(prefix) {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"CDN77-DNS/optimised"
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLines(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewJSONLines(filePath)
+	if err != nil {
+		t.Fatalf("NewJSONLines failed: %v", err)
+	}
+	data := optimised.NewData()
+	data.SetAuditor(sink)
+
+	alice := data.As("alice")
+	for prefix, popID := range map[string]uint16{"2001:db8::/32": 100, "2001:db9::/32": 200} {
+		if err := alice.Insert(netip.MustParsePrefix(prefix), popID); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := data.As("bob").Update(netip.MustParsePrefix("2001:db8::/32"), 12); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	// "who moved this /32 to PoP 12": records of the /32 itself and of prefixes inside it
+	records, err := Query(file, netip.MustParsePrefix("2001:db8:aaaa::/48"))
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records for 2001:db8::/32, got %+v", records)
+	}
+	moved := records[1]
+	if moved.Actor != "bob" || moved.Prefix != "2001:db8::/32" || moved.Before == nil || *moved.Before != 100 ||
+		moved.After == nil || *moved.After != 12 || moved.Serial != data.Serial() || moved.Source != "update 2001:db8::/32 12" {
+		t.Errorf("unexpected record %+v", moved)
+	}
+	if records[0].Before != nil || records[0].Actor != "alice" {
+		t.Errorf("unexpected insert record %+v", records[0])
+	}
+
+	t.Run("InvalidLine", func(t *testing.T) {
+		if _, err := Query(strings.NewReader("{\"prefix\": \"2001:db8::/32\"}\nnope\n"), netip.MustParsePrefix("::/0")); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("expected error for line 2, got %v", err)
+		}
+	})
+}
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	data := optimised.NewData()
+	data.SetAuditor(NewSlog(slog.New(slog.NewJSONHandler(&buf, nil))))
+	if err := data.As("alice").Insert(netip.MustParsePrefix("2001:db8::/32"), 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	for _, want := range []string{`"msg":"routing rule changed"`, `"actor":"alice"`, `"prefix":"2001:db8::/32"`, `"before":null`, `"after":100`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log entry is missing %s: %s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache keeps packed answers so a repeated query costs a route and a copy instead of building and packing
+// the response. An entry is keyed by what the answer depends on: the name, the type, whether the query had
+// a client subnet and its family, and the subnet address truncated to the answer's scope.
+// Queries are still routed before the lookup, the entry is only used while the table serial and the PoP
+// are those it was built with, so a publish or a health change (failover, spill) never serves a stale PoP.
+type Cache struct {
+	size int
+
+	mu      sync.RWMutex
+	entries map[cacheKey]cacheEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheKey struct {
+	// canonical
+	name  string
+	qtype uint16
+	// 0 for queries routed by the resolver's address, 1 IPv4 and 2 IPv6 client subnets like in the option
+	family uint8
+	subnet netip.Prefix
+}
+
+type cacheEntry struct {
+	serial uint64
+	pop    uint16
+	// the response without the OPT record, ID 0 and RD clear
+	wire []byte
+}
+
+// CacheStats is a snapshot of the cache counters
+type CacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// NewCache returns a cache of at most size entries, a random entry is evicted to make room
+func NewCache(size int) *Cache {
+	return &Cache{size: max(size, 1), entries: map[cacheKey]cacheEntry{}}
+}
+
+// Stats returns the number of entries and the hit and miss counts so far
+func (c *Cache) Stats() CacheStats {
+	c.mu.RLock()
+	entries := len(c.entries)
+	c.mu.RUnlock()
+	return CacheStats{Entries: entries, Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// the cached response of key if it was built from the table with serial routing to popID, the slice is shared
+func (c *Cache) get(key cacheKey, serial uint64, popID uint16) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || entry.serial != serial || entry.pop != popID {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return entry.wire, true
+}
+
+func (c *Cache) put(key cacheKey, serial uint64, popID uint16, wire []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		// map iteration starts at a random entry
+		for victim := range c.entries {
+			delete(c.entries, victim)
+			break
+		}
+	}
+	c.entries[key] = cacheEntry{serial: serial, pop: popID, wire: wire}
+}
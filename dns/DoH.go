@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+)
+
+// dnsMessageType is the media type of DNS messages in DNS over HTTPS requests and responses
+const dnsMessageType = "application/dns-message"
+
+// DoH serves DNS over HTTPS (RFC 8484) with Handler: a GET carries the query base64url encoded in the dns
+// parameter, a POST carries it as the body. Mount it on the server's URI template path, usually /dns-query.
+type DoH struct {
+	Handler Handler
+}
+
+func (d *DoH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(wire) == 0 {
+			http.Error(w, "expected a base64url encoded query in the dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != dnsMessageType {
+			http.Error(w, fmt.Sprintf("expected content type %s, got '%s'", dnsMessageType, contentType), http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if wire, err = io.ReadAll(io.LimitReader(r.Body, math.MaxUint16+1)); err != nil || len(wire) > math.MaxUint16 {
+			http.Error(w, "failed to read the query", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the client of a DNS over HTTPS request is the resolver, like over UDP and TCP
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	response := d.Handler.ServeDNS(&Request{Client: client, Transport: "doh", Wire: wire})
+	if response == nil {
+		http.Error(w, "malformed query", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	if ttl, ok := minTTL(response); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(response)
+}
+
+// the smallest TTL of the answer and authority records, the freshness lifetime of the response in HTTP caches
+func minTTL(response []byte) (uint32, bool) {
+	m, err := Parse(response)
+	if err != nil {
+		return 0, false
+	}
+	ttl, ok := uint32(math.MaxUint32), false
+	for _, rr := range append(m.Answers, m.Authority...) {
+		ttl, ok = min(ttl, rr.TTL), true
+	}
+	return ttl, ok
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+const (
+	optionClientSubnet uint16 = 8
+	// UDP payload size advertised in responses, small enough to avoid fragmentation
+	defaultUDPSize uint16 = 1232
+)
+
+// EDNS is the content of the OPT pseudo record (RFC 6891)
+type EDNS struct {
+	UDPSize uint16
+	// upper 8 bits of the 12 bit response code
+	ExtendedRcode uint8
+	Version       uint8
+	DNSSECOK      bool
+	// nil when the message has no client subnet option
+	ClientSubnet *ClientSubnet
+	// options other than the client subnet, kept in wire form
+	Options []Option
+}
+
+// Option is an EDNS option in wire form
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// ClientSubnet is the EDNS Client Subnet option (RFC 7871): the resolver's client subnet in a query,
+// in a response the same subnet with the scope the answer is valid for
+type ClientSubnet struct {
+	// the address masked to SourcePrefix bits, IPv4 or IPv6 as sent
+	Prefix netip.Prefix
+	// bits of the address the answer depends on, 0 in queries
+	ScopePrefix uint8
+}
+
+// IPNet is the subnet in the form optimised.Data.Route takes
+func (cs *ClientSubnet) IPNet() *net.IPNet {
+	addr := cs.Prefix.Addr()
+	return &net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(cs.Prefix.Bits(), addr.BitLen())}
+}
+
+func parseEDNS(rr RR) (*EDNS, error) {
+	if rr.Name != "." {
+		return nil, errors.New("OPT record not owned by the root")
+	}
+	e := &EDNS{
+		UDPSize:       rr.Class,
+		ExtendedRcode: uint8(rr.TTL >> 24),
+		Version:       uint8(rr.TTL >> 16),
+		DNSSECOK:      rr.TTL&(1<<15) != 0,
+	}
+	for data := rr.Data; len(data) > 0; {
+		if len(data) < 4 {
+			return nil, errTruncatedMessage
+		}
+		code, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, errTruncatedMessage
+		}
+		value := data[4 : 4+length]
+		data = data[4+length:]
+		if code != optionClientSubnet {
+			e.Options = append(e.Options, Option{Code: code, Data: append([]byte(nil), value...)})
+			continue
+		}
+		if e.ClientSubnet != nil {
+			return nil, errors.New("more than one client subnet option")
+		}
+		cs, err := parseClientSubnet(value)
+		if err != nil {
+			return nil, err
+		}
+		e.ClientSubnet = cs
+	}
+	return e, nil
+}
+
+func parseClientSubnet(value []byte) (*ClientSubnet, error) {
+	if len(value) < 4 {
+		return nil, errors.New("client subnet option too short")
+	}
+	family, source, scope := binary.BigEndian.Uint16(value), int(value[2]), value[3]
+	var addr [16]byte
+	var size int
+	switch family {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		return nil, fmt.Errorf("unknown client subnet family %d", family)
+	}
+	address := value[4:]
+	// the address is truncated to the source prefix, bits beyond it must be zero
+	if source > size*8 || len(address) != (source+7)/8 {
+		return nil, fmt.Errorf("client subnet address of %d bytes does not match /%d", len(address), source)
+	}
+	copy(addr[:], address)
+	var ip netip.Addr
+	if size == 4 {
+		ip = netip.AddrFrom4([4]byte(addr[:4]))
+	} else {
+		ip = netip.AddrFrom16(addr)
+	}
+	prefix := netip.PrefixFrom(ip, source)
+	if prefix.Masked() != prefix {
+		return nil, errors.New("client subnet address has bits set beyond the source prefix")
+	}
+	return &ClientSubnet{Prefix: prefix, ScopePrefix: scope}, nil
+}
+
+func (cs *ClientSubnet) pack() []byte {
+	family := uint16(2)
+	if cs.Prefix.Addr().Is4() {
+		family = 1
+	}
+	value := binary.BigEndian.AppendUint16(nil, family)
+	value = append(value, byte(cs.Prefix.Bits()), cs.ScopePrefix)
+	return append(value, cs.Prefix.Addr().AsSlice()[:(cs.Prefix.Bits()+7)/8]...)
+}
+
+// the OPT record carrying e
+func (e *EDNS) rr() RR {
+	ttl := uint32(e.ExtendedRcode)<<24 | uint32(e.Version)<<16
+	if e.DNSSECOK {
+		ttl |= 1 << 15
+	}
+	var data []byte
+	options := e.Options
+	if e.ClientSubnet != nil {
+		options = append([]Option{{Code: optionClientSubnet, Data: e.ClientSubnet.pack()}}, options...)
+	}
+	for _, option := range options {
+		data = binary.BigEndian.AppendUint16(data, option.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+	return RR{Name: ".", Type: TypeOPT, Class: e.UDPSize, TTL: ttl, Data: data}
+}
@@ -0,0 +1,369 @@
+package dns
+
+import (
+	"CDN77-DNS/optimised"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Request is a query as received, Transport is "udp", "tcp", "dot" (DNS over TLS) or "doh" (DNS over HTTPS)
+type Request struct {
+	Client    netip.AddrPort
+	Transport string
+	Wire      []byte
+}
+
+// Handler answers a query with a response in wire form, nil drops the query
+type Handler interface {
+	ServeDNS(req *Request) []byte
+}
+
+// Steering answers A and AAAA queries for the names of its tables with the addresses of the PoP the table
+// routes the client to. The client is the EDNS Client Subnet of the query, or the resolver's address when
+// the query has none, and the response carries the rule's scope in its client subnet option.
+// A client no rule matches, or routed to a PoP without addresses, gets SERVFAIL so the resolver tries elsewhere.
+// With zones (see SetZones) only their steered names are routed, the rest is answered from the zones.
+type Steering struct {
+	tables    Tables
+	addresses Addresses
+	ttl       uint32
+	zones     []*Zone
+	cache     *Cache
+	tap       Tap
+}
+
+// NewSteering returns a handler answering the names of tables with addresses, ttl is the TTL of the answers
+func NewSteering(tables Tables, addresses Addresses, ttl time.Duration) *Steering {
+	return &Steering{tables: tables, addresses: addresses, ttl: uint32(ttl / time.Second)}
+}
+
+// SetZones makes s answer the names of zones from them and refuse all others, a zone inside another one
+// answers its names; the tables only route the steered names. It has to be set before serving.
+func (s *Steering) SetZones(zones ...*Zone) {
+	s.zones = zones
+}
+
+// SetCache makes s keep packed answers in cache, it has to be set before serving
+func (s *Steering) SetCache(cache *Cache) {
+	s.cache = cache
+}
+
+// SetTap makes s pass every answered query to tap, it has to be set before serving
+func (s *Steering) SetTap(tap Tap) {
+	s.tap = tap
+}
+
+func (s *Steering) ServeDNS(req *Request) []byte {
+	if s.tap == nil {
+		response, _ := s.serve(req)
+		return response
+	}
+	received := time.Now()
+	response, routing := s.serve(req)
+	if response != nil {
+		s.tap.Tap(Exchange{
+			Client:       req.Client,
+			Transport:    req.Transport,
+			QueryTime:    received,
+			ResponseTime: time.Now(),
+			Query:        req.Wire,
+			Response:     response,
+			Routing:      routing,
+		})
+	}
+	return response
+}
+
+// the response and how the query was routed
+func (s *Steering) serve(req *Request) ([]byte, Routing) {
+	routing := Routing{Scope: -1}
+	query, err := Parse(req.Wire)
+	if err != nil {
+		return formatError(req.Wire), routing
+	}
+	switch {
+	case query.Response:
+		return nil, routing
+	case query.Opcode != 0:
+		return reply(req, query, RcodeNotImplemented), routing
+	case len(query.Questions) != 1:
+		return reply(req, query, RcodeFormatError), routing
+	case query.EDNS != nil && query.EDNS.Version != 0:
+		return reply(req, query, rcodeBadVersion), routing
+	}
+	q := query.Questions[0]
+	if q.Class != ClassINET {
+		return reply(req, query, RcodeRefused), routing
+	}
+	if s.zones != nil {
+		return s.serveZones(req, query)
+	}
+	table, ok := s.tables.TableFor(q.Name)
+	if !ok {
+		return reply(req, query, RcodeRefused), routing
+	}
+	return s.steer(req, query, table, q.Name, nil, nil)
+}
+
+// maxCNAMEs is the longest chain of CNAMEs followed within the zones, longer chains (loops) get SERVFAIL
+const maxCNAMEs = 8
+
+// the response from the zones, following CNAMEs within them to a steered name, static records or a negative answer
+func (s *Steering) serveZones(req *Request, query *Message) ([]byte, Routing) {
+	q := query.Questions[0]
+	owner, zone := q.Name, s.zoneFor(q.Name)
+	if zone == nil {
+		return reply(req, query, RcodeRefused), Routing{Scope: -1}
+	}
+	var chain []RR
+	for {
+		node := zone.names[CanonicalName(owner)]
+		switch {
+		case node == nil:
+			return static(req, query, RcodeNameError, chain, []RR{zone.negative(s.serial(zone))}), Routing{Scope: -1}
+		case node.cname != "" && q.Type != TypeCNAME:
+			if len(chain) == maxCNAMEs {
+				return reply(req, query, RcodeServerFailure), Routing{Scope: -1}
+			}
+			chain = append(chain, zone.records(owner, node, TypeCNAME, 0)...)
+			owner = node.cname
+			if zone = s.zoneFor(owner); zone == nil {
+				// the resolver follows a CNAME out of the zones
+				return static(req, query, RcodeSuccess, chain, nil), Routing{Scope: -1}
+			}
+			continue
+		case node.steered && (q.Type == TypeA || q.Type == TypeAAAA || q.Type == TypeANY):
+			table, ok := s.tables.TableFor(owner)
+			if !ok {
+				return reply(req, query, RcodeServerFailure), Routing{Scope: -1}
+			}
+			return s.steer(req, query, table, owner, chain, zone)
+		}
+		records := zone.records(owner, node, q.Type, s.serial(zone))
+		if len(records) == 0 {
+			return static(req, query, RcodeSuccess, chain, []RR{zone.negative(s.serial(zone))}), Routing{Scope: -1}
+		}
+		return static(req, query, RcodeSuccess, append(chain, records...), nil), Routing{Scope: -1}
+	}
+}
+
+// the zone of name with the longest origin, nil when no zone has it
+func (s *Steering) zoneFor(name string) *Zone {
+	name = CanonicalName(name)
+	var longest *Zone
+	for _, zone := range s.zones {
+		if InZone(name, zone.Origin) && (longest == nil || len(zone.Origin) > len(longest.Origin)) {
+			longest = zone
+		}
+	}
+	return longest
+}
+
+// the SOA serial of zone, the unix time the table routing the origin was published, at least the serial
+// of the zone file. Unlike the table's serial it keeps increasing across restarts.
+func (s *Steering) serial(zone *Zone) uint32 {
+	serial := zone.soa.serial
+	if table, ok := s.tables.TableFor(zone.Origin); ok {
+		serial = max(serial, uint32(table.Published().Unix()))
+	}
+	return serial
+}
+
+// an authoritative response not depending on the client, scoped to all clients
+func static(req *Request, query *Message, rcode int, answers, authority []RR) []byte {
+	response := Message{
+		Header:    Header{Response: true, Authoritative: true, Rcode: uint8(rcode)},
+		Questions: query.Questions,
+		Answers:   answers,
+		Authority: authority,
+	}
+	wire, err := response.Pack()
+	if err != nil {
+		return reply(req, query, RcodeServerFailure)
+	}
+	return finish(req, query, wire, 0)
+}
+
+// the response routing the client to a PoP and answering its addresses for the steered name target,
+// chain are the CNAMEs leading to target from the question and zone is target's zone, nil without zones
+func (s *Steering) steer(req *Request, query *Message, table *optimised.Data, target string, chain []RR, zone *Zone) ([]byte, Routing) {
+	q := query.Questions[0]
+	routing := Routing{Scope: -1}
+	c := clientOf(req, query)
+	routing.Subnet, routing.ECS = c.prefix, c.ecs
+	serial := table.Serial()
+	popID, scope, rule := table.RouteRule(c.ipNet())
+	if scope < 0 {
+		return reply(req, query, RcodeServerFailure), routing
+	}
+	scope = c.scope(scope)
+	routing.Rule, routing.PoP, routing.Scope = rule, popID, scope
+	key := cacheKey{name: CanonicalName(q.Name), qtype: q.Type, family: c.family(), subnet: netip.PrefixFrom(c.prefix.Addr(), scope).Masked()}
+	body, ok := s.cache.get(key, serial, popID)
+	if !ok {
+		if len(s.addresses[popID]) == 0 {
+			return reply(req, query, RcodeServerFailure), routing
+		}
+		// no addresses of the type asked for is an empty answer (NODATA), with the SOA in a zone
+		records := s.addresses.records(target, popID, q.Type, s.ttl)
+		var authority []RR
+		if len(records) == 0 && zone != nil {
+			authority = []RR{zone.negative(s.serial(zone))}
+		}
+		if body, ok = answer(q, append(slices.Clip(chain), records...), authority); !ok {
+			return reply(req, query, RcodeServerFailure), routing
+		}
+		// the SOA serial follows the table of the zone's origin, not necessarily the one the entry is checked against
+		if authority == nil {
+			s.cache.put(key, serial, popID, body)
+		}
+	}
+	return finish(req, query, body, scope), routing
+}
+
+// the packed response without the OPT record
+func answer(q Question, answers, authority []RR) ([]byte, bool) {
+	response := Message{
+		Header:    Header{Response: true, Authoritative: true},
+		Questions: []Question{q},
+		Answers:   answers,
+		Authority: authority,
+	}
+	wire, err := response.Pack()
+	return wire, err == nil
+}
+
+// the subnet a query is routed by
+type client struct {
+	// IPv4 or IPv6
+	prefix netip.Prefix
+	// the prefix comes from a client subnet option with a source prefix length above 0
+	ecs bool
+}
+
+func clientOf(req *Request, query *Message) client {
+	if query.EDNS != nil && query.EDNS.ClientSubnet != nil && query.EDNS.ClientSubnet.Prefix.Bits() > 0 {
+		return client{prefix: query.EDNS.ClientSubnet.Prefix, ecs: true}
+	}
+	// a source prefix of 0 asks not to use the client's address, the resolver's one is used like without the option
+	addr := req.Client.Addr().Unmap()
+	return client{prefix: netip.PrefixFrom(addr, addr.BitLen())}
+}
+
+// the subnet in the IPv6 only address space of the routing table, IPv4 subnets are IPv4-mapped (::ffff:0:0/96)
+func (c client) ipNet() *net.IPNet {
+	addr, bits := c.prefix.Addr(), c.prefix.Bits()
+	if addr.Is4() {
+		bits += 96
+	}
+	ip := addr.As16()
+	return &net.IPNet{IP: ip[:], Mask: net.CIDRMask(bits, 128)}
+}
+
+// the scope of the routing table converted to the family of the client subnet
+func (c client) scope(tableScope int) int {
+	if c.prefix.Addr().Is4() {
+		return min(max(tableScope-96, 0), 32)
+	}
+	return tableScope
+}
+
+func (c client) family() uint8 {
+	switch {
+	case !c.ecs:
+		return 0
+	case c.prefix.Addr().Is4():
+		return 1
+	default:
+		return 2
+	}
+}
+
+// extended response code 16 (BADVERS), the upper 8 bits go into the OPT record
+const rcodeBadVersion = 16
+
+// an error response echoing the question, with an OPT record when the query has one
+func reply(req *Request, query *Message, rcode int) []byte {
+	response := Message{
+		Header:    Header{ID: query.ID, Response: true, Opcode: query.Opcode, RecursionDesired: query.RecursionDesired, Rcode: uint8(rcode & 0xf)},
+		Questions: query.Questions,
+	}
+	if query.EDNS != nil {
+		response.EDNS = &EDNS{UDPSize: defaultUDPSize, ExtendedRcode: uint8(rcode >> 4)}
+	}
+	wire, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return truncate(req, query, wire)
+}
+
+// a FORMERR header for a query that can not be parsed, nothing when there is no header to answer
+func formatError(wire []byte) []byte {
+	if len(wire) < headerSize || wire[2]&0x80 != 0 {
+		return nil
+	}
+	response := make([]byte, headerSize)
+	copy(response, wire[:2])
+	// QR set, opcode and RD kept
+	response[2] = 0x80 | wire[2]&0x79
+	response[3] = RcodeFormatError
+	return response
+}
+
+// the response to query from the packed body: the query's ID, RD bit and question name (a cached body may
+// have been built for a query spelling the name in another case), then the OPT record with the client subnet
+// option at scope when the query has EDNS
+func finish(req *Request, query *Message, body []byte, scope int) []byte {
+	response := make([]byte, len(body), len(body)+64)
+	copy(response, body)
+	binary.BigEndian.PutUint16(response, query.ID)
+	if query.RecursionDesired {
+		response[2] |= 0x01
+	}
+	// the same name in another case packs to the same length, so this overwrites the name in place
+	if _, err := appendName(response[:headerSize], 0, query.Questions[0].Name, nil); err != nil {
+		return nil
+	}
+	if query.EDNS != nil {
+		edns := &EDNS{UDPSize: defaultUDPSize}
+		if cs := query.EDNS.ClientSubnet; cs != nil {
+			edns.ClientSubnet = &ClientSubnet{Prefix: cs.Prefix}
+			if cs.Prefix.Bits() > 0 {
+				edns.ClientSubnet.ScopePrefix = uint8(scope)
+			}
+		}
+		var err error
+		if response, err = appendRR(response, 0, edns.rr(), nil); err != nil {
+			return nil
+		}
+		binary.BigEndian.PutUint16(response[10:], binary.BigEndian.Uint16(response[10:])+1)
+	}
+	return truncate(req, query, response)
+}
+
+// the response cut down to the header, question and OPT record with TC set when it does not fit the UDP size
+// the query allows, the resolver retries over TCP
+func truncate(req *Request, query *Message, response []byte) []byte {
+	limit := minUDPSize
+	if query.EDNS != nil {
+		limit = max(limit, int(query.EDNS.UDPSize))
+	}
+	if req.Transport != "udp" || len(response) <= limit {
+		return response
+	}
+	header := parseHeader(binary.BigEndian.Uint16(response), binary.BigEndian.Uint16(response[2:]))
+	header.Truncated = true
+	truncated := Message{Header: header, Questions: query.Questions}
+	if query.EDNS != nil {
+		truncated.EDNS = &EDNS{UDPSize: defaultUDPSize}
+	}
+	wire, err := truncated.Pack()
+	if err != nil {
+		return nil
+	}
+	return wire
+}
@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"CDN77-DNS/optimised"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testTable(t *testing.T) *optimised.Data {
+	t.Helper()
+	data := optimised.NewData()
+	for prefix, popID := range map[string]uint16{
+		"2001:db8::/32":        1,
+		"::ffff:192.0.2.0/120": 2,
+		"2001:db9::/32":        4,
+		"2001:dba::/32":        5,
+	} {
+		if err := data.Insert(netip.MustParsePrefix(prefix), popID); err != nil {
+			t.Fatalf("Insert(%s) failed: %v", prefix, err)
+		}
+	}
+	return data
+}
+
+func testAddresses() Addresses {
+	addresses := Addresses{
+		1: {netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")},
+		2: {netip.MustParseAddr("198.51.100.1")},
+	}
+	// too many for a 512 byte response
+	for i := range 40 {
+		addresses[5] = append(addresses[5], netip.MustParseAddr(fmt.Sprintf("2001:dba::%x", i+1)))
+	}
+	return addresses
+}
+
+func newQuery(name string, qtype uint16, ecs string) *Message {
+	query := &Message{
+		Header:    Header{ID: 4242, RecursionDesired: true},
+		Questions: []Question{{Name: name, Type: qtype, Class: ClassINET}},
+	}
+	if ecs != "" {
+		query.EDNS = &EDNS{UDPSize: 1232}
+		if ecs != "none" {
+			query.EDNS.ClientSubnet = &ClientSubnet{Prefix: netip.MustParsePrefix(ecs)}
+		}
+	}
+	return query
+}
+
+// send query from client to h and parse the response
+func exchange(t *testing.T, h Handler, client, transport string, query *Message) *Message {
+	t.Helper()
+	wire, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	responseWire := h.ServeDNS(&Request{Client: netip.MustParseAddrPort(client), Transport: transport, Wire: wire})
+	if responseWire == nil {
+		t.Fatalf("no response")
+	}
+	response, err := Parse(responseWire)
+	if err != nil {
+		t.Fatalf("Parse of the response failed: %v", err)
+	}
+	if response.ID != query.ID || !response.Response || response.RecursionDesired != query.RecursionDesired {
+		t.Errorf("bad response header %+v", response.Header)
+	}
+	return response
+}
+
+// the answered addresses in order
+func answerAddrs(m *Message) []string {
+	var addrs []string
+	for _, rr := range m.Answers {
+		addr, _ := netip.AddrFromSlice(rr.Data)
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+func TestSteering(t *testing.T) {
+	h := NewSteering(SingleTable(testTable(t), "cdn.example.com"), testAddresses(), 30*time.Second)
+
+	tests := []struct {
+		name      string
+		client    string
+		query     *Message
+		wantRcode int
+		wantAddrs []string
+		// -1 when the response must not carry a client subnet option
+		wantScope int
+	}{
+		{"IPv6 client subnet", "[2001:db8::53]:5300", newQuery("www.cdn.example.com.", TypeAAAA, "2001:db8:1234::/48"), RcodeSuccess, []string{"2001:db8::10"}, 32},
+		{"IPv4 client subnet", "[2001:db8::53]:5300", newQuery("cdn.example.com.", TypeA, "192.0.2.0/24"), RcodeSuccess, []string{"198.51.100.1"}, 24},
+		{"resolver address", "[2001:db8::53]:5300", newQuery("cdn.example.com.", TypeA, ""), RcodeSuccess, []string{"192.0.2.10"}, -1},
+		{"IPv4 resolver", "192.0.2.53:5300", newQuery("cdn.example.com.", TypeA, "none"), RcodeSuccess, []string{"198.51.100.1"}, -1},
+		{"source prefix 0", "192.0.2.53:5300", newQuery("cdn.example.com.", TypeA, "::/0"), RcodeSuccess, []string{"198.51.100.1"}, 0},
+		{"no address of the type", "[2001:db8::53]:5300", newQuery("cdn.example.com.", TypeAAAA, "192.0.2.0/24"), RcodeSuccess, nil, 24},
+		{"no rule", "[2001:db8::53]:5300", newQuery("cdn.example.com.", TypeA, "2001:dbf::/48"), RcodeServerFailure, nil, -1},
+		{"PoP without addresses", "[2001:db8::53]:5300", newQuery("cdn.example.com.", TypeA, "2001:db9::/48"), RcodeServerFailure, nil, -1},
+		{"other zone", "[2001:db8::53]:5300", newQuery("www.example.com.", TypeA, ""), RcodeRefused, nil, -1},
+		{"bad EDNS version", "[2001:db8::53]:5300", func() *Message {
+			query := newQuery("cdn.example.com.", TypeA, "none")
+			query.EDNS.Version = 1
+			return query
+		}(), rcodeBadVersion, nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := exchange(t, h, tt.client, "udp", tt.query)
+			rcode := int(response.Rcode)
+			if response.EDNS != nil {
+				rcode |= int(response.EDNS.ExtendedRcode) << 4
+			}
+			if rcode != tt.wantRcode {
+				t.Fatalf("got rcode %d, want %d", rcode, tt.wantRcode)
+			}
+			if got := answerAddrs(response); !slices.Equal(got, tt.wantAddrs) {
+				t.Errorf("got answers %v, want %v", got, tt.wantAddrs)
+			}
+			if tt.wantRcode == RcodeSuccess && (!response.Authoritative || response.Answers != nil && response.Answers[0].TTL != 30) {
+				t.Errorf("expected authoritative answers with TTL 30, got %+v", response)
+			}
+			if (response.EDNS != nil) != (tt.query.EDNS != nil) {
+				t.Errorf("query EDNS %v, response EDNS %v", tt.query.EDNS != nil, response.EDNS != nil)
+			}
+			var cs *ClientSubnet
+			if response.EDNS != nil {
+				cs = response.EDNS.ClientSubnet
+			}
+			switch {
+			case tt.wantScope < 0 && cs != nil:
+				t.Errorf("unexpected client subnet option %+v", cs)
+			case tt.wantScope >= 0 && cs == nil:
+				t.Errorf("expected a client subnet option")
+			case cs != nil && (cs.Prefix != tt.query.EDNS.ClientSubnet.Prefix || int(cs.ScopePrefix) != tt.wantScope):
+				t.Errorf("got client subnet %s scope %d, want %s scope %d", cs.Prefix, cs.ScopePrefix, tt.query.EDNS.ClientSubnet.Prefix, tt.wantScope)
+			}
+		})
+	}
+
+	t.Run("truncation", func(t *testing.T) {
+		query := newQuery("cdn.example.com.", TypeAAAA, "")
+		query.EDNS = nil
+		h := NewSteering(SingleTable(testTable(t), "."), testAddresses(), time.Minute)
+		udp := exchange(t, h, "[2001:dba::53]:5300", "udp", query)
+		if !udp.Truncated || len(udp.Answers) != 0 || len(udp.Questions) != 1 {
+			t.Errorf("expected a truncated UDP response with the question only, got %+v", udp)
+		}
+		if tcp := exchange(t, h, "[2001:dba::53]:5300", "tcp", query); tcp.Truncated || len(tcp.Answers) != 40 {
+			t.Errorf("expected 40 answers over TCP, got %d (truncated %v)", len(tcp.Answers), tcp.Truncated)
+		}
+		query.EDNS = &EDNS{UDPSize: 4096}
+		if udp := exchange(t, h, "[2001:dba::53]:5300", "udp", query); udp.Truncated || len(udp.Answers) != 40 {
+			t.Errorf("expected 40 answers within the EDNS UDP size, got %d (truncated %v)", len(udp.Answers), udp.Truncated)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		wire := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'c', 'd'}
+		response := h.ServeDNS(&Request{Client: netip.MustParseAddrPort("192.0.2.53:53"), Transport: "udp", Wire: wire})
+		want := []byte{0x12, 0x34, 0x81, RcodeFormatError, 0, 0, 0, 0, 0, 0, 0, 0}
+		if !slices.Equal(response, want) {
+			t.Errorf("got %v, want %v", response, want)
+		}
+		if response := h.ServeDNS(&Request{Client: netip.MustParseAddrPort("192.0.2.53:53"), Transport: "udp", Wire: wire[:5]}); response != nil {
+			t.Errorf("expected no response to a partial header, got %v", response)
+		}
+	})
+}
+
+func TestCache(t *testing.T) {
+	data := testTable(t)
+	h := NewSteering(SingleTable(data, "cdn.example.com"), testAddresses(), 30*time.Second)
+	cache := NewCache(100)
+	h.SetCache(cache)
+
+	checkStats := func(want CacheStats) {
+		t.Helper()
+		if got := cache.Stats(); got != want {
+			t.Errorf("got cache stats %+v, want %+v", got, want)
+		}
+	}
+	check := func(client string, query *Message, wantAddrs ...string) *Message {
+		t.Helper()
+		response := exchange(t, h, client, "udp", query)
+		if got := answerAddrs(response); !slices.Equal(got, wantAddrs) {
+			t.Errorf("got answers %v, want %v", got, wantAddrs)
+		}
+		return response
+	}
+
+	check("[2001:db8::53]:53", newQuery("cdn.example.com.", TypeA, "2001:db8:1:2::/64"), "192.0.2.10")
+	checkStats(CacheStats{Entries: 1, Misses: 1})
+
+	// another subnet within the scope, the name in another case
+	response := check("[2001:db8::53]:53", newQuery("CDN.Example.com.", TypeA, "2001:db8:ffff::/48"), "192.0.2.10")
+	checkStats(CacheStats{Entries: 1, Hits: 1, Misses: 1})
+	if name := response.Questions[0].Name; name != "CDN.Example.com." {
+		t.Errorf("cached response question %s, want the query's case", name)
+	}
+	if cs := response.EDNS.ClientSubnet; cs.Prefix.String() != "2001:db8:ffff::/48" || cs.ScopePrefix != 32 {
+		t.Errorf("cached response client subnet %s scope %d", cs.Prefix, cs.ScopePrefix)
+	}
+
+	// queries without a client subnet and of another type are cached apart
+	check("[2001:db8::53]:53", newQuery("cdn.example.com.", TypeA, ""), "192.0.2.10")
+	check("[2001:db8::53]:53", newQuery("cdn.example.com.", TypeAAAA, "2001:db8::/56"), "2001:db8::10")
+	checkStats(CacheStats{Entries: 3, Hits: 1, Misses: 3})
+	check("[2001:db8::1]:53", newQuery("cdn.example.com.", TypeA, "none"), "192.0.2.10")
+	checkStats(CacheStats{Entries: 3, Hits: 2, Misses: 3})
+
+	// a new table version invalidates the entries
+	if err := data.Update(netip.MustParsePrefix("2001:db8::/32"), 2); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	check("[2001:db8::53]:53", newQuery("cdn.example.com.", TypeA, "2001:db8:1:2::/64"), "198.51.100.1")
+	checkStats(CacheStats{Entries: 3, Hits: 2, Misses: 4})
+	check("[2001:db8::53]:53", newQuery("cdn.example.com.", TypeA, "2001:db8:1:2::/64"), "198.51.100.1")
+	checkStats(CacheStats{Entries: 3, Hits: 3, Misses: 4})
+
+	t.Run("failover", func(t *testing.T) {
+		// a failover changes the PoP without a new version
+		routing := filepath.Join(t.TempDir(), "routing.txt")
+		if err := os.WriteFile(routing, []byte("2001:db8::/32 1 backup=2\n"), 0644); err != nil {
+			t.Fatalf("failed to write routing data: %v", err)
+		}
+		data := optimised.NewData()
+		if err := data.LoadRoutingData(routing); err != nil {
+			t.Fatalf("LoadRoutingData failed: %v", err)
+		}
+		health := optimised.NewHealth()
+		data.SetHealth(health)
+		h := NewSteering(SingleTable(data, "."), testAddresses(), time.Minute)
+		h.SetCache(NewCache(10))
+		query := newQuery("cdn.example.com.", TypeA, "2001:db8:1:2::/64")
+		for _, want := range []string{"192.0.2.10", "192.0.2.10", "198.51.100.1"} {
+			if want == "198.51.100.1" {
+				health.Set(1, optimised.PoPDown)
+			}
+			if got := answerAddrs(exchange(t, h, "[2001:db8::53]:53", "udp", query)); !slices.Equal(got, []string{want}) {
+				t.Errorf("got answers %v, want %s", got, want)
+			}
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		cache := NewCache(2)
+		for i := range 5 {
+			cache.put(cacheKey{name: fmt.Sprint(i)}, 1, 1, nil)
+		}
+		if entries := cache.Stats().Entries; entries != 2 {
+			t.Errorf("got %d entries, want 2", entries)
+		}
+	})
+}
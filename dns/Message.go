@@ -0,0 +1,328 @@
+// Package dns is the authoritative DNS server answering steered names with the addresses of the PoP
+// the routing table picks for the client subnet (EDNS Client Subnet, RFC 7871).
+// The wire format is implemented here on top of the standard library, only what an authoritative server needs.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// record types and classes
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeOPT   uint16 = 41
+	TypeANY   uint16 = 255
+
+	ClassINET uint16 = 1
+)
+
+// response codes
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const (
+	headerSize = 12
+	// largest UDP response to a query without EDNS
+	minUDPSize = 512
+	maxNameLen = 255
+)
+
+var errTruncatedMessage = errors.New("truncated message")
+
+// Header is the fixed part of a message without the section counts
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              uint8
+}
+
+func (h Header) flags() uint16 {
+	flags := uint16(h.Opcode&0xf)<<11 | uint16(h.Rcode&0xf)
+	for _, bit := range []struct {
+		set  bool
+		mask uint16
+	}{{h.Response, 1 << 15}, {h.Authoritative, 1 << 10}, {h.Truncated, 1 << 9}, {h.RecursionDesired, 1 << 8}, {h.RecursionAvailable, 1 << 7}} {
+		if bit.set {
+			flags |= bit.mask
+		}
+	}
+	return flags
+}
+
+func parseHeader(id, flags uint16) Header {
+	return Header{
+		ID:                 id,
+		Response:           flags&(1<<15) != 0,
+		Opcode:             uint8(flags>>11) & 0xf,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		Rcode:              uint8(flags) & 0xf,
+	}
+}
+
+type Question struct {
+	// fully qualified in presentation form, "www.example.com."
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record, Data is the record data in wire form (see the A, AAAA... constructors)
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS message, the OPT pseudo record of the additional section is kept apart in EDNS
+type Message struct {
+	Header
+	Questions  []Question
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+	// nil when the message carries no OPT record
+	EDNS *EDNS
+}
+
+// Parse reads a message in wire form
+func Parse(wire []byte) (*Message, error) {
+	if len(wire) < headerSize {
+		return nil, errTruncatedMessage
+	}
+	m := &Message{Header: parseHeader(binary.BigEndian.Uint16(wire[0:2]), binary.BigEndian.Uint16(wire[2:4]))}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(wire[4+2*i:]))
+	}
+	offset := headerSize
+	for range counts[0] {
+		name, next, err := readName(wire, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(wire) {
+			return nil, errTruncatedMessage
+		}
+		m.Questions = append(m.Questions, Question{Name: name, Type: binary.BigEndian.Uint16(wire[next:]), Class: binary.BigEndian.Uint16(wire[next+2:])})
+		offset = next + 4
+	}
+	for section, count := range counts[1:] {
+		for range count {
+			rr, next, err := readRR(wire, offset)
+			if err != nil {
+				return nil, err
+			}
+			offset = next
+			switch {
+			case section == 2 && rr.Type == TypeOPT:
+				if m.EDNS != nil {
+					return nil, errors.New("more than one OPT record")
+				}
+				if m.EDNS, err = parseEDNS(rr); err != nil {
+					return nil, err
+				}
+			case section == 0:
+				m.Answers = append(m.Answers, rr)
+			case section == 1:
+				m.Authority = append(m.Authority, rr)
+			default:
+				m.Additional = append(m.Additional, rr)
+			}
+		}
+	}
+	return m, nil
+}
+
+func readRR(wire []byte, offset int) (RR, int, error) {
+	name, next, err := readName(wire, offset)
+	if err != nil {
+		return RR{}, 0, err
+	}
+	if next+10 > len(wire) {
+		return RR{}, 0, errTruncatedMessage
+	}
+	rr := RR{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(wire[next:]),
+		Class: binary.BigEndian.Uint16(wire[next+2:]),
+		TTL:   binary.BigEndian.Uint32(wire[next+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(wire[next+8:]))
+	next += 10
+	if next+length > len(wire) {
+		return RR{}, 0, errTruncatedMessage
+	}
+	rr.Data = append([]byte(nil), wire[next:next+length]...)
+	return rr, next + length, nil
+}
+
+// read a possibly compressed name starting at offset, returns the offset after it
+func readName(wire []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	end := -1
+	// every pointer must point backwards, so a loop is impossible
+	limit := offset
+	for {
+		if offset >= len(wire) {
+			return "", 0, errTruncatedMessage
+		}
+		length := int(wire[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			if name.Len() == 0 {
+				return ".", end, nil
+			}
+			return name.String(), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(wire) {
+				return "", 0, errTruncatedMessage
+			}
+			pointer := int(binary.BigEndian.Uint16(wire[offset:]) & 0x3fff)
+			if pointer >= limit {
+				return "", 0, errors.New("invalid name compression pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset, limit = pointer, pointer
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported label type 0x%x", length&0xc0)
+		default:
+			if offset+1+length > len(wire) {
+				return "", 0, errTruncatedMessage
+			}
+			name.Write(wire[offset+1 : offset+1+length])
+			name.WriteByte('.')
+			if name.Len() > maxNameLen {
+				return "", 0, errors.New("name too long")
+			}
+			offset += 1 + length
+		}
+	}
+}
+
+// Pack returns the message in wire form, owner names are compressed
+func (m *Message) Pack() ([]byte, error) {
+	return m.AppendPack(make([]byte, 0, minUDPSize))
+}
+
+// AppendPack appends the message in wire form to buf
+func (m *Message) AppendPack(buf []byte) ([]byte, error) {
+	base := len(buf)
+	additional := len(m.Additional)
+	if m.EDNS != nil {
+		additional++
+	}
+	buf = binary.BigEndian.AppendUint16(buf, m.ID)
+	buf = binary.BigEndian.AppendUint16(buf, m.flags())
+	for _, count := range []int{len(m.Questions), len(m.Answers), len(m.Authority), additional} {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(count))
+	}
+
+	compression := map[string]int{}
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = appendName(buf, base, q.Name, compression); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, q.Type)
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if buf, err = appendRR(buf, base, rr, compression); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.EDNS != nil {
+		if buf, err = appendRR(buf, base, m.EDNS.rr(), compression); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendRR(buf []byte, base int, rr RR, compression map[string]int) ([]byte, error) {
+	buf, err := appendName(buf, base, rr.Name, compression)
+	if err != nil {
+		return nil, err
+	}
+	if len(rr.Data) > 0xffff {
+		return nil, fmt.Errorf("record data of %s too long", rr.Name)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, rr.Type)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.Data)))
+	return append(buf, rr.Data...), nil
+}
+
+// append name, pointing to an earlier occurrence of its longest known suffix when compression is not nil
+func appendName(buf []byte, base int, name string, compression map[string]int) ([]byte, error) {
+	name = Fqdn(name)
+	if len(name) > maxNameLen {
+		return nil, fmt.Errorf("name '%s' too long", name)
+	}
+	for name != "." {
+		key := strings.ToLower(name)
+		if offset, ok := compression[key]; ok {
+			return binary.BigEndian.AppendUint16(buf, 0xc000|uint16(offset)), nil
+		}
+		if compression != nil && len(buf)-base < 0x4000 {
+			compression[key] = len(buf) - base
+		}
+		label, rest, _ := strings.Cut(name, ".")
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid label in name '%s'", name)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		name = rest
+		if name == "" {
+			name = "."
+		}
+	}
+	return append(buf, 0), nil
+}
+
+// Fqdn adds the trailing dot of a fully qualified name if missing
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// CanonicalName is the lowercase fully qualified form names are compared in
+func CanonicalName(name string) string {
+	return strings.ToLower(Fqdn(name))
+}
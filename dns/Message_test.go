@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{
+		Header:    Header{ID: 0xbeef, Response: true, Authoritative: true, RecursionDesired: true, Rcode: RcodeNameError},
+		Questions: []Question{{Name: "WWW.example.com.", Type: TypeAAAA, Class: ClassINET}},
+		Answers: []RR{
+			{Name: "WWW.example.com.", Type: TypeAAAA, Class: ClassINET, TTL: 30, Data: netip.MustParseAddr("2001:db8::1").AsSlice()},
+			{Name: "cdn.example.com.", Type: TypeA, Class: ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}},
+		},
+		Authority: []RR{{Name: "example.com.", Type: TypeNS, Class: ClassINET, TTL: 3600, Data: []byte{2, 'n', 's', 0}}},
+		EDNS: &EDNS{
+			UDPSize:      1232,
+			DNSSECOK:     true,
+			ClientSubnet: &ClientSubnet{Prefix: netip.MustParsePrefix("2001:db8:1200::/40"), ScopePrefix: 32},
+			Options:      []Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		},
+	}
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	// the owner names point into the question name
+	if n := bytes.Count(wire, []byte("\x07example")); n != 1 {
+		t.Errorf("names not compressed, example.com appears %d times", n)
+	}
+	parsed, err := Parse(wire)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("round trip changed the message\n got %+v\nwant %+v", parsed, m)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	query, err := (&Message{Questions: []Question{{Name: "example.com.", Type: TypeA, Class: ClassINET}}}).Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	pointerLoop := append(bytes.Clone(query[:12]), 0xc0, 12, 0, 1, 0, 1)
+	missingAnswer := bytes.Clone(query)
+	missingAnswer[7] = 1
+
+	tests := []struct {
+		name string
+		wire []byte
+	}{
+		{"short header", query[:11]},
+		{"truncated question", query[:len(query)-1]},
+		{"forward pointer", pointerLoop},
+		{"missing answer", missingAnswer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.wire); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestClientSubnetOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   []byte
+		want    string
+		wantErr bool
+	}{
+		{"IPv4", []byte{0, 1, 24, 0, 192, 0, 2}, "192.0.2.0/24", false},
+		{"IPv6", []byte{0, 2, 36, 0, 0x20, 0x01, 0x0d, 0xb8, 0x10}, "2001:db8:1000::/36", false},
+		{"source 0", []byte{0, 1, 0, 0}, "0.0.0.0/0", false},
+		{"bits beyond source", []byte{0, 1, 23, 0, 192, 0, 3}, "", true},
+		{"address too long", []byte{0, 1, 8, 0, 192, 0}, "", true},
+		{"source too long", []byte{0, 1, 33, 0, 192, 0, 2, 1, 0}, "", true},
+		{"unknown family", []byte{0, 3, 8, 0, 1}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := parseClientSubnet(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", cs.Prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseClientSubnet failed: %v", err)
+			}
+			if cs.Prefix.String() != tt.want {
+				t.Errorf("got %s, want %s", cs.Prefix, tt.want)
+			}
+			if packed := cs.pack(); !bytes.Equal(packed, tt.value) {
+				t.Errorf("pack: got %v, want %v", packed, tt.value)
+			}
+		})
+	}
+}
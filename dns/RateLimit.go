@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"CDN77-DNS/optimised"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit configures response rate limiting (RRL) against reflection attacks, where spoofed queries make
+// the server flood a victim with responses. Responses are counted per client network and response identity,
+// so a flood of identical responses to one network is limited while other clients and other answers are not.
+type RateLimit struct {
+	// responses per second allowed to a network for one identity, also the burst allowed after a quiet period
+	ResponsesPerSecond float64
+	// how long a network stays limited after its flood stops, at most
+	Window time.Duration
+	// every Slip-th limited response is sent truncated (TC=1, no answer) instead of being dropped, so a real
+	// client behind a spoofed network can retry over TCP; 0 drops all of them, 1 truncates all of them
+	Slip int
+	// client addresses are aggregated into networks of these prefix lengths
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// clients never limited, eg. the resolvers we peer with
+	Exempt []netip.Prefix
+	// accounts kept at most, the one charged longest ago is evicted to make room
+	MaxEntries int
+}
+
+// DefaultRateLimit allows 20 identical responses per second to a /24 or /56 network
+var DefaultRateLimit = RateLimit{ResponsesPerSecond: 20, Window: 15 * time.Second, Slip: 2, IPv4PrefixLen: 24, IPv6PrefixLen: 56, MaxEntries: 100000}
+
+func (rl RateLimit) validate() error {
+	switch {
+	case rl.ResponsesPerSecond <= 0:
+		return fmt.Errorf("responses per second must be positive, got %g", rl.ResponsesPerSecond)
+	case rl.Window < 0:
+		return fmt.Errorf("window must not be negative, got %s", rl.Window)
+	case rl.Slip < 0:
+		return fmt.Errorf("slip must not be negative, got %d", rl.Slip)
+	case rl.IPv4PrefixLen < 0 || rl.IPv4PrefixLen > 32:
+		return fmt.Errorf("IPv4 prefix length must be between 0 and 32, got %d", rl.IPv4PrefixLen)
+	case rl.IPv6PrefixLen < 0 || rl.IPv6PrefixLen > 128:
+		return fmt.Errorf("IPv6 prefix length must be between 0 and 128, got %d", rl.IPv6PrefixLen)
+	}
+	return nil
+}
+
+// RateLimitStats counts the limited responses
+type RateLimitStats struct {
+	Dropped   uint64
+	Truncated uint64
+	Entries   int
+}
+
+// RateLimiter applies RateLimit to the UDP responses of Handler, TCP (and TLS, HTTPS) can not be spoofed
+// and is never limited. The identity of a response with answers is its name and type; empty answers (NODATA)
+// and NXDOMAIN are one identity per zone and response code, errors one per response code,
+// so random names do not get a fresh allowance each.
+type RateLimiter struct {
+	handler Handler
+	config  RateLimit
+	clock   optimised.Clock
+
+	mu       sync.Mutex
+	accounts map[rateKey]*account
+	// keys of the accounts, most recently charged first: a flood keeps its account at the front,
+	// so fresh accounts of spoofed sources can not push it out
+	charged *list.List
+
+	dropped   atomic.Uint64
+	truncated atomic.Uint64
+}
+
+type rateKey struct {
+	network netip.Prefix
+	rcode   uint8
+	// the zone of NODATA and NXDOMAIN, empty for errors
+	name string
+	// 0 unless the response has answers
+	qtype uint16
+}
+
+type account struct {
+	// responses still allowed, refilled at the rate up to one second's worth, negative while limited
+	balance float64
+	updated time.Time
+	// limited responses so far, for the slip
+	limited int
+	// in RateLimiter.charged
+	element *list.Element
+}
+
+// NewRateLimiter limits the responses of handler as configured
+func NewRateLimiter(handler Handler, config RateLimit) (*RateLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	config.MaxEntries = max(config.MaxEntries, 1)
+	return &RateLimiter{handler: handler, config: config, clock: optimised.SystemClock, accounts: map[rateKey]*account{}, charged: list.New()}, nil
+}
+
+// SetClock replaces the clock the balances are refilled by, it has to be set before serving
+func (rl *RateLimiter) SetClock(clock optimised.Clock) {
+	rl.clock = clock
+}
+
+// Stats returns the limited counts so far and the number of accounts
+func (rl *RateLimiter) Stats() RateLimitStats {
+	rl.mu.Lock()
+	entries := len(rl.accounts)
+	rl.mu.Unlock()
+	return RateLimitStats{Dropped: rl.dropped.Load(), Truncated: rl.truncated.Load(), Entries: entries}
+}
+
+func (rl *RateLimiter) ServeDNS(req *Request) []byte {
+	response := rl.handler.ServeDNS(req)
+	if response == nil || req.Transport != "udp" {
+		return response
+	}
+	client := req.Client.Addr().Unmap()
+	for _, exempt := range rl.config.Exempt {
+		if exempt.Contains(client) {
+			return response
+		}
+	}
+	key, questionEnd, ok := rl.key(client, response)
+	if !ok {
+		return response
+	}
+	allowed, slip := rl.account(key)
+	switch {
+	case allowed:
+		return response
+	case slip:
+		rl.truncated.Add(1)
+		return truncated(response, questionEnd)
+	default:
+		rl.dropped.Add(1)
+		return nil
+	}
+}
+
+// the account key of response to client and the offset after its question
+func (rl *RateLimiter) key(client netip.Addr, response []byte) (rateKey, int, bool) {
+	if len(response) < headerSize {
+		return rateKey{}, 0, false
+	}
+	bits := rl.config.IPv6PrefixLen
+	if client.Is4() {
+		bits = rl.config.IPv4PrefixLen
+	}
+	network, _ := client.Prefix(bits)
+	key := rateKey{network: network, rcode: response[3] & 0xf}
+	switch binary.BigEndian.Uint16(response[4:]) {
+	case 0:
+		// FORMERR to a query that could not be parsed
+		return key, headerSize, true
+	case 1:
+	default:
+		return rateKey{}, 0, false
+	}
+	name, next, err := readName(response, headerSize)
+	if err != nil || next+4 > len(response) {
+		return rateKey{}, 0, false
+	}
+	answers := binary.BigEndian.Uint16(response[6:])
+	switch {
+	case key.rcode == RcodeSuccess && answers > 0:
+		key.name, key.qtype = CanonicalName(name), binary.BigEndian.Uint16(response[next:])
+	case key.rcode == RcodeSuccess || key.rcode == RcodeNameError:
+		key.name = negativeZone(response, next+4, answers)
+	}
+	return key, next + 4, true
+}
+
+// the zone of a negative response, the owner of the SOA its authority section starts with (after the CNAMEs
+// leading to the missing name), empty without one
+func negativeZone(response []byte, offset int, answers uint16) string {
+	for range answers {
+		_, next, err := readRR(response, offset)
+		if err != nil {
+			return ""
+		}
+		offset = next
+	}
+	if binary.BigEndian.Uint16(response[8:]) == 0 {
+		return ""
+	}
+	soa, _, err := readRR(response, offset)
+	if err != nil || soa.Type != TypeSOA {
+		return ""
+	}
+	return CanonicalName(soa.Name)
+}
+
+// charge one response to the account of key, slip tells a limited response to be sent truncated
+func (rl *RateLimiter) account(key rateKey) (allowed, slip bool) {
+	now := rl.clock.Now()
+	rate := rl.config.ResponsesPerSecond
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	a, ok := rl.accounts[key]
+	if ok {
+		rl.charged.MoveToFront(a.element)
+	} else {
+		if len(rl.accounts) >= rl.config.MaxEntries {
+			delete(rl.accounts, rl.charged.Remove(rl.charged.Back()).(rateKey))
+		}
+		a = &account{balance: rate, updated: now, element: rl.charged.PushFront(key)}
+		rl.accounts[key] = a
+	}
+	if elapsed := now.Sub(a.updated); elapsed > 0 {
+		a.balance = min(rate, a.balance+elapsed.Seconds()*rate)
+		a.updated = now
+	}
+	a.balance--
+	if a.balance >= 0 {
+		a.limited = 0
+		return true, false
+	}
+	// a flood keeps the balance at most a window's worth of responses below zero
+	a.balance = max(a.balance, -rate*rl.config.Window.Seconds())
+	a.limited++
+	return false, rl.config.Slip > 0 && a.limited%rl.config.Slip == 0
+}
+
+// the response cut down to its header and question with TC set
+func truncated(response []byte, questionEnd int) []byte {
+	t := append([]byte(nil), response[:questionEnd]...)
+	t[2] |= 0x02
+	// no answer, authority or additional records
+	clear(t[6:headerSize])
+	return t
+}
@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is moved by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestRateLimiter(t *testing.T) {
+	config := RateLimit{
+		ResponsesPerSecond: 5,
+		Window:             2 * time.Second,
+		Slip:               2,
+		IPv4PrefixLen:      24,
+		IPv6PrefixLen:      56,
+		Exempt:             []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		MaxEntries:         100,
+	}
+	newLimiter := func(config RateLimit) (*RateLimiter, *fakeClock) {
+		t.Helper()
+		rl, err := NewRateLimiter(NewSteering(SingleTable(testTable(t), "cdn.example.com"), testAddresses(), time.Minute), config)
+		if err != nil {
+			t.Fatalf("NewRateLimiter failed: %v", err)
+		}
+		clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+		rl.SetClock(clock)
+		return rl, clock
+	}
+	// the raw response to a query for name and qtype from client
+	send := func(rl *RateLimiter, client, transport, name string, qtype uint16) []byte {
+		t.Helper()
+		wire, err := newQuery(name, qtype, "2001:db8:1200::/40").Pack()
+		if err != nil {
+			t.Fatalf("Pack failed: %v", err)
+		}
+		return rl.ServeDNS(&Request{Client: netip.MustParseAddrPort(client), Transport: transport, Wire: wire})
+	}
+	const (
+		full      = "full"
+		dropped   = "dropped"
+		truncated = "truncated"
+	)
+	outcome := func(response []byte) string {
+		t.Helper()
+		if response == nil {
+			return dropped
+		}
+		m, err := Parse(response)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if !m.Truncated {
+			return full
+		}
+		if len(m.Questions) > 1 || len(m.Answers)+len(m.Authority)+len(m.Additional) != 0 || m.EDNS != nil {
+			t.Errorf("truncated response with records: %+v", m)
+		}
+		return truncated
+	}
+	check := func(rl *RateLimiter, client, transport, name string, qtype uint16, want ...string) {
+		t.Helper()
+		for i, want := range want {
+			if got := outcome(send(rl, client, transport, name, qtype)); got != want {
+				t.Errorf("%s %s %s/%d response %d: got %s, want %s", client, transport, name, qtype, i, got, want)
+			}
+		}
+	}
+
+	t.Run("limit and slip", func(t *testing.T) {
+		rl, clock := newLimiter(config)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, full, full, full, full, full, dropped, truncated, dropped)
+		// the whole /24 shares the account, names differing in case are the same identity
+		check(rl, "192.0.2.200:53", "udp", "CDN.example.com.", TypeA, truncated, dropped)
+		// other networks and other identities are not limited
+		check(rl, "192.0.3.1:53", "udp", "cdn.example.com.", TypeA, full)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeAAAA, full)
+		// neither are TCP and exempt clients
+		check(rl, "192.0.2.1:53", "tcp", "cdn.example.com.", TypeA, full)
+		for range 10 {
+			check(rl, "203.0.113.9:53", "udp", "cdn.example.com.", TypeA, full)
+		}
+		if stats := rl.Stats(); stats != (RateLimitStats{Dropped: 3, Truncated: 2, Entries: 3}) {
+			t.Errorf("got stats %+v", stats)
+		}
+
+		// 10 responses so far took the balance to -5, a second later it is back to 0
+		clock.now = clock.now.Add(time.Second)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, truncated)
+		clock.now = clock.now.Add(500 * time.Millisecond)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, full, dropped, truncated)
+		// a long flood is only remembered for the window
+		for range 100 {
+			send(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA)
+		}
+		clock.now = clock.now.Add(config.Window + 200*time.Millisecond)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, full)
+	})
+
+	t.Run("errors share an identity", func(t *testing.T) {
+		rl, _ := newLimiter(config)
+		// REFUSED for names out of the zone, each name different
+		for _, name := range []string{"a.example.org.", "b.example.org.", "c.example.org.", "d.example.org.", "e.example.org."} {
+			check(rl, "198.51.100.1:53", "udp", name, TypeA, full)
+		}
+		check(rl, "198.51.100.1:53", "udp", "f.example.org.", TypeA, dropped)
+		// an answer to the same network is counted apart
+		check(rl, "198.51.100.1:53", "udp", "cdn.example.com.", TypeA, full)
+
+		// FORMERR to queries that do not parse, without a question to echo
+		malformed := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 7, 'e'}
+		for i := range 7 {
+			response := rl.ServeDNS(&Request{Client: netip.MustParseAddrPort("198.51.100.1:53"), Transport: "udp", Wire: malformed})
+			if got := outcome(response); got != []string{full, full, full, full, full, dropped, truncated}[i] {
+				t.Errorf("malformed query %d: got %s", i, got)
+			}
+		}
+	})
+
+	t.Run("negative answers by zone", func(t *testing.T) {
+		h := NewSteering(SingleTable(testTable(t), "."), testAddresses(), time.Minute)
+		var zones []*Zone
+		for _, origin := range []string{"cdn.example.com.", "cdn.example.net."} {
+			zone, err := ReadZone(strings.NewReader(strings.Replace(testZone, "$ORIGIN cdn.example.com.", "$ORIGIN "+origin, 1)))
+			if err != nil {
+				t.Fatalf("ReadZone failed: %v", err)
+			}
+			zones = append(zones, zone)
+		}
+		h.SetZones(zones...)
+		rl, err := NewRateLimiter(h, config)
+		if err != nil {
+			t.Fatalf("NewRateLimiter failed: %v", err)
+		}
+		rl.SetClock(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+
+		// NXDOMAIN for random names in one zone
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			check(rl, "198.51.100.1:53", "udp", name+".cdn.example.com.", TypeA, full)
+		}
+		check(rl, "198.51.100.1:53", "udp", "f.cdn.example.com.", TypeA, dropped)
+		// another zone is counted apart
+		check(rl, "198.51.100.1:53", "udp", "g.cdn.example.net.", TypeA, full)
+		// so is NODATA, one identity for all names and types of the zone
+		for _, qtype := range []uint16{TypeMX, TypeTXT} {
+			check(rl, "198.51.100.1:53", "udp", "static.cdn.example.com.", qtype, full)
+		}
+		for _, qtype := range []uint16{TypeMX, TypeTXT, TypeAAAA} {
+			check(rl, "198.51.100.1:53", "udp", "a.b.deep.cdn.example.com.", qtype, full)
+		}
+		check(rl, "198.51.100.1:53", "udp", "static.cdn.example.com.", TypeNS, dropped)
+		// REFUSED outside the zones is not a negative answer of any of them
+		check(rl, "198.51.100.1:53", "udp", "h.example.org.", TypeA, full)
+	})
+
+	t.Run("IPv6 networks", func(t *testing.T) {
+		rl, _ := newLimiter(config)
+		check(rl, "[2001:db8:0:100::1]:53", "udp", "cdn.example.com.", TypeAAAA, full, full, full)
+		check(rl, "[2001:db8:0:1ff::2]:53", "udp", "cdn.example.com.", TypeAAAA, full, full, dropped)
+		check(rl, "[2001:db8:0:200::1]:53", "udp", "cdn.example.com.", TypeAAAA, full)
+		// an IPv4-mapped client is aggregated as IPv4
+		check(rl, "[::ffff:192.0.2.1]:53", "udp", "cdn.example.com.", TypeAAAA, full, full, full, full, full)
+		check(rl, "192.0.2.2:53", "udp", "cdn.example.com.", TypeAAAA, dropped)
+	})
+
+	t.Run("no slip", func(t *testing.T) {
+		noSlip := config
+		noSlip.Slip = 0
+		rl, _ := newLimiter(noSlip)
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, full, full, full, full, full, dropped, dropped, dropped)
+	})
+
+	t.Run("bounded accounts", func(t *testing.T) {
+		bounded := config
+		bounded.MaxEntries = 3
+		rl, _ := newLimiter(bounded)
+		for i := range 10 {
+			client := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}), 53)
+			check(rl, client.String(), "udp", "cdn.example.com.", TypeA, full)
+		}
+		if entries := rl.Stats().Entries; entries != 3 {
+			t.Errorf("got %d accounts, want 3", entries)
+		}
+
+		// a flood keeps its account however many fresh accounts spoofed sources make meanwhile
+		check(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA, full, full, full, full, full, dropped)
+		for i := range 10 {
+			client := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 1, byte(i), 1}), 53)
+			check(rl, client.String(), "udp", "cdn.example.com.", TypeA, full)
+			if got := outcome(send(rl, "192.0.2.1:53", "udp", "cdn.example.com.", TypeA)); got == full {
+				t.Fatalf("flood answered in full after %d fresh accounts", i+1)
+			}
+		}
+	})
+
+	t.Run("configuration", func(t *testing.T) {
+		for _, bad := range []func(*RateLimit){
+			func(c *RateLimit) { c.ResponsesPerSecond = 0 },
+			func(c *RateLimit) { c.Window = -time.Second },
+			func(c *RateLimit) { c.Slip = -1 },
+			func(c *RateLimit) { c.IPv4PrefixLen = 33 },
+			func(c *RateLimit) { c.IPv6PrefixLen = -1 },
+		} {
+			c := DefaultRateLimit
+			bad(&c)
+			if _, err := NewRateLimiter(nil, c); err == nil {
+				t.Errorf("expected %+v to be rejected", c)
+			}
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by ListenAndServe and Serve after Shutdown
+var ErrServerClosed = errors.New("dns: server closed")
+
+// idle TCP connections are closed after this long, as are connections a query can not be read from in time
+const tcpIdleTimeout = 10 * time.Second
+
+// DefaultMaxUDPQueries is the number of UDP queries answered at once when Server.MaxUDPQueries is 0
+const DefaultMaxUDPQueries = 1024
+
+// Server answers queries over UDP and TCP on the same address with Handler,
+// or with TLSConfig set over TLS only (DNS over TLS, RFC 7858, usually on port 853)
+type Server struct {
+	Addr      string
+	Handler   Handler
+	TLSConfig *tls.Config
+	// UDP queries answered at once, reading pauses while as many are in flight and the socket buffer
+	// takes the burst, DefaultMaxUDPQueries if 0
+	MaxUDPQueries int
+
+	mu       sync.Mutex
+	closed   bool
+	packet   net.PacketConn
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// ListenAndServe listens on UDP and TCP Addr (TCP only with TLSConfig) and serves until Shutdown
+func (s *Server) ListenAndServe() error {
+	var packet net.PacketConn
+	if s.TLSConfig == nil {
+		var err error
+		if packet, err = net.ListenPacket("udp", s.Addr); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		if packet != nil {
+			packet.Close()
+		}
+		return err
+	}
+	return s.Serve(packet, listener)
+}
+
+// Serve answers the queries arriving on packet and listener until Shutdown, either may be nil.
+// With TLSConfig the connections of listener are TLS connections, packet must be nil.
+func (s *Server) Serve(packet net.PacketConn, listener net.Listener) error {
+	if s.TLSConfig != nil && listener != nil {
+		if packet != nil {
+			return fmt.Errorf("dns: no UDP with TLS")
+		}
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		if packet != nil {
+			packet.Close()
+		}
+		if listener != nil {
+			listener.Close()
+		}
+		return ErrServerClosed
+	}
+	s.packet, s.listener, s.conns = packet, listener, map[net.Conn]struct{}{}
+	s.mu.Unlock()
+
+	errs := make(chan error, 2)
+	serving := 0
+	if packet != nil {
+		serving++
+		go func() { errs <- s.serveUDP(packet) }()
+	}
+	if listener != nil {
+		serving++
+		go func() { errs <- s.serveTCP(listener) }()
+	}
+	if serving == 0 {
+		return fmt.Errorf("dns: nothing to serve on")
+	}
+	err := <-errs
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+	s.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown stops listening, closes the TCP connections and waits for the queries in flight to be answered
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.packet != nil {
+		s.packet.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveUDP(packet net.PacketConn) error {
+	buf := make([]byte, 65535)
+	slots := make(chan struct{}, cmp.Or(s.MaxUDPQueries, DefaultMaxUDPQueries))
+	for {
+		n, addr, err := packet.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if !s.begin() {
+			return ErrServerClosed
+		}
+		req := &Request{Client: udpAddr.AddrPort(), Transport: "udp", Wire: append([]byte(nil), buf[:n]...)}
+		slots <- struct{}{}
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-slots }()
+			if response := s.Handler.ServeDNS(req); response != nil {
+				packet.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.begin() {
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.track(conn)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// count a query or connection in flight for Shutdown to wait for, false when the server is already closed
+func (s *Server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// add conn to the connections closed by Shutdown
+func (s *Server) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// answer length prefixed queries one at a time until the client closes the connection or goes idle
+func (s *Server) serveConn(conn net.Conn) {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	transport := "tcp"
+	if s.TLSConfig != nil {
+		// the handshake happens on the first read, within the deadline
+		transport = "dot"
+	}
+	var length [2]byte
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, wire); err != nil {
+			return
+		}
+		response := s.Handler.ServeDNS(&Request{Client: tcpAddr.AddrPort(), Transport: transport, Wire: wire})
+		if response == nil {
+			return
+		}
+		message := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(response)), uint16(len(response)))
+		if _, err := conn.Write(append(message, response...)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := &Server{Handler: NewSteering(SingleTable(testTable(t), "cdn.example.com"), testAddresses(), time.Minute)}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(packet, listener) }()
+
+	query, err := newQuery("cdn.example.com.", TypeA, "192.0.2.0/24").Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	checkResponse := func(wire []byte) {
+		t.Helper()
+		response, err := Parse(wire)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got := answerAddrs(response); !slices.Equal(got, []string{"198.51.100.1"}) {
+			t.Errorf("got answers %v", got)
+		}
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.Dial("udp", packet.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(query); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		buf := make([]byte, 1232)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		checkResponse(buf[:n])
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// two queries on one connection
+		for range 2 {
+			if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, wire); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			checkResponse(wire)
+		}
+	})
+
+	// an idle connection is closed by the shutdown
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer idle.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the idle connection closed")
+	}
+}
+
+// blockingHandler answers every query with its wire form once released, counting the queries being answered
+type blockingHandler struct {
+	release chan struct{}
+	mu      sync.Mutex
+	active  int
+	most    int
+}
+
+func (h *blockingHandler) ServeDNS(req *Request) []byte {
+	h.mu.Lock()
+	h.active++
+	h.most = max(h.most, h.active)
+	h.mu.Unlock()
+	<-h.release
+	h.mu.Lock()
+	h.active--
+	h.mu.Unlock()
+	return req.Wire
+}
+
+func TestServerMaxUDPQueries(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	handler := &blockingHandler{release: make(chan struct{})}
+	server := &Server{Handler: handler, MaxUDPQueries: 2}
+	go server.Serve(packet, nil)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("udp", packet.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := range 5 {
+		if _, err := conn.Write([]byte{0, byte(i)}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	// the first two are answered while the rest wait
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		handler.mu.Lock()
+		active := handler.active
+		handler.mu.Unlock()
+		if active == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d queries in flight, want 2", active)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(handler.release)
+	for range 5 {
+		if _, err := conn.Read(make([]byte, 2)); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.most != 2 {
+		t.Errorf("got up to %d queries in flight, want 2", handler.most)
+	}
+}
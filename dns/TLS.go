@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// Certificate is a TLS certificate and key loaded from PEM files that can be reloaded while serving (eg. after
+// a renewal), handshakes made afterwards present the new certificate and established connections keep theirs
+type Certificate struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+}
+
+// LoadCertificate loads the certificate chain in certFile and its key in keyFile
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again, on error the previous certificate stays in use
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate '%s' with key '%s': %w", c.certFile, c.keyFile, err)
+	}
+	c.current.Store(&cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.GetCertificate
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// TLSConfig returns a server configuration presenting the current certificate
+func (c *Certificate) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate, MinVersion: tls.VersionTLS12}
+}
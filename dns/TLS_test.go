@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate for 127.0.0.1 named commonName to dir, returns the files and a pool trusting it
+func writeCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for filename, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER}} {
+		if err := os.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("failed to write '%s': %v", filename, err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+func TestDoT(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, roots := writeCertificate(t, dir, "first")
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadCertificate failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := &Server{Handler: NewSteering(SingleTable(testTable(t), "."), testAddresses(), time.Minute), TLSConfig: cert.TLSConfig()}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(nil, listener) }()
+
+	query, err := newQuery("cdn.example.com.", TypeA, "192.0.2.0/24").Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	// query over a new connection trusting roots, returns the server certificate's common name
+	exchangeTLS := func(roots *x509.CertPool) string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, wire); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		response, err := Parse(wire)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got := answerAddrs(response); !slices.Equal(got, []string{"198.51.100.1"}) {
+			t.Errorf("got answers %v", got)
+		}
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := exchangeTLS(roots); name != "first" {
+		t.Errorf("got certificate %s, want first", name)
+	}
+	// a renewed certificate is presented after the reload
+	_, _, renewedRoots := writeCertificate(t, dir, "renewed")
+	if name := exchangeTLS(roots); name != "first" {
+		t.Errorf("before the reload: got certificate %s, want first", name)
+	}
+	if err := cert.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if name := exchangeTLS(renewedRoots); name != "renewed" {
+		t.Errorf("after the reload: got certificate %s, want renewed", name)
+	}
+	// a broken file keeps the certificate in use
+	if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := cert.Reload(); err == nil {
+		t.Errorf("expected reloading a broken certificate to fail")
+	}
+	if name := exchangeTLS(renewedRoots); name != "renewed" {
+		t.Errorf("after a failed reload: got certificate %s, want renewed", name)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestDoH(t *testing.T) {
+	certFile, keyFile, roots := writeCertificate(t, t.TempDir(), "doh")
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadCertificate failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", &DoH{Handler: NewSteering(SingleTable(testTable(t), "."), testAddresses(), time.Minute)})
+	server := &http.Server{Handler: mux, TLSConfig: cert.TLSConfig()}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}, Timeout: 5 * time.Second}
+	url := "https://" + listener.Addr().String() + "/dns-query"
+	query, err := newQuery("cdn.example.com.", TypeAAAA, "2001:db8:1200::/40").Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	checkAnswer := func(response *http.Response) {
+		t.Helper()
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("got status %d, content type %s: %s", response.StatusCode, response.Header.Get("Content-Type"), body)
+		}
+		if response.ProtoMajor != 2 {
+			t.Errorf("got %s, want HTTP/2", response.Proto)
+		}
+		if cacheControl := response.Header.Get("Cache-Control"); cacheControl != "max-age=60" {
+			t.Errorf("got Cache-Control %s, want max-age=60", cacheControl)
+		}
+		m, err := Parse(body)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got := answerAddrs(m); !slices.Equal(got, []string{"2001:db8::10"}) {
+			t.Errorf("got answers %v", got)
+		}
+		if cs := m.EDNS.ClientSubnet; cs == nil || cs.ScopePrefix != 32 {
+			t.Errorf("got client subnet %+v, want scope 32", cs)
+		}
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		response, err := client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		checkAnswer(response)
+	})
+	t.Run("POST", func(t *testing.T) {
+		response, err := client.Post(url, "application/dns-message", bytes.NewReader(query))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		checkAnswer(response)
+	})
+	t.Run("errors", func(t *testing.T) {
+		for _, tt := range []struct {
+			method, query, contentType string
+			body                       []byte
+			wantStatus                 int
+		}{
+			{http.MethodGet, "", "", nil, http.StatusBadRequest},
+			{http.MethodGet, "?dns=not+base64", "", nil, http.StatusBadRequest},
+			{http.MethodPost, "", "text/plain", query, http.StatusUnsupportedMediaType},
+			{http.MethodPost, "", "application/dns-message", query[:5], http.StatusBadRequest},
+			{http.MethodPut, "", "application/dns-message", query, http.StatusMethodNotAllowed},
+		} {
+			request, err := http.NewRequest(tt.method, url+tt.query, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("NewRequest failed: %v", err)
+			}
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("%s failed: %v", tt.method, err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("%s %s (%s): got status %d, want %d", tt.method, tt.query, tt.contentType, response.StatusCode, tt.wantStatus)
+			}
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"CDN77-DNS/optimised"
+	"CDN77-DNS/registry"
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Tables picks the routing table answering a query name, ok is false for names the server does not serve
+type Tables interface {
+	TableFor(qname string) (table *optimised.Data, ok bool)
+}
+
+type singleTable struct {
+	data  *optimised.Data
+	zones []string
+}
+
+// SingleTable serves every name in zones (a zone includes all names below it, "." is every name) from data
+func SingleTable(data *optimised.Data, zones ...string) Tables {
+	t := singleTable{data: data}
+	for _, zone := range zones {
+		t.zones = append(t.zones, CanonicalName(zone))
+	}
+	return t
+}
+
+func (t singleTable) TableFor(qname string) (*optimised.Data, bool) {
+	name := CanonicalName(qname)
+	for _, zone := range t.zones {
+		if InZone(name, zone) {
+			return t.data, true
+		}
+	}
+	return nil, false
+}
+
+type registryTables struct {
+	r *registry.Registry
+}
+
+// RegistryTables serves every name from the registry table of its longest zone, see registry.Registry.Lookup
+func RegistryTables(r *registry.Registry) Tables {
+	return registryTables{r}
+}
+
+func (t registryTables) TableFor(qname string) (*optimised.Data, bool) {
+	table, ok := t.r.Lookup(qname)
+	if !ok {
+		return nil, false
+	}
+	return table.Data, true
+}
+
+// InZone reports whether the canonical name is zone or below it, zone is canonical as well
+func InZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// Addresses are the addresses answered for each PoP, A queries get the IPv4 and AAAA queries the IPv6 ones
+type Addresses map[uint16][]netip.Addr
+
+// LoadAddresses reads the PoP addresses from filename, one "PoP address [address...]" line per PoP,
+// empty lines and lines starting with # are skipped
+func LoadAddresses(filename string) (Addresses, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PoP addresses file '%s': %w", filename, err)
+	}
+	defer file.Close()
+
+	addresses := Addresses{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a PoP ID and at least one address", lineNumber)
+		}
+		popID, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: failed to parse PoP ID '%s': %w", lineNumber, fields[0], err)
+		}
+		if _, ok := addresses[uint16(popID)]; ok {
+			return nil, fmt.Errorf("line %d: duplicate PoP %d", lineNumber, popID)
+		}
+		for _, field := range fields[1:] {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: failed to parse address '%s': %w", lineNumber, field, err)
+			}
+			addresses[uint16(popID)] = append(addresses[uint16(popID)], addr.Unmap())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading PoP addresses file '%s': %w", filename, err)
+	}
+	return addresses, nil
+}
+
+// the records of the PoP's addresses answering qtype
+func (a Addresses) records(name string, popID uint16, qtype uint16, ttl uint32) []RR {
+	var records []RR
+	for _, addr := range a[popID] {
+		switch {
+		case addr.Is4() && (qtype == TypeA || qtype == TypeANY):
+			records = append(records, RR{Name: name, Type: TypeA, Class: ClassINET, TTL: ttl, Data: addr.AsSlice()})
+		case addr.Is6() && (qtype == TypeAAAA || qtype == TypeANY):
+			records = append(records, RR{Name: name, Type: TypeAAAA, Class: ClassINET, TTL: ttl, Data: addr.AsSlice()})
+		}
+	}
+	return records
+}
@@ -0,0 +1,37 @@
+package dns
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Tap receives the answered queries, eg. to log them (see the dnstap package).
+// Tap runs on the serving goroutine for every query, implementations must be safe for concurrent use
+// and must not block, Query and Response are not modified afterwards and may be kept.
+type Tap interface {
+	Tap(exchange Exchange)
+}
+
+// Exchange is an answered query
+type Exchange struct {
+	Client netip.AddrPort
+	// as in Request
+	Transport    string
+	QueryTime    time.Time
+	ResponseTime time.Time
+	Query        []byte
+	Response     []byte
+	Routing      Routing
+}
+
+// Routing is how a query was routed, Subnet is invalid for queries answered without routing (errors, other zones)
+type Routing struct {
+	// the client subnet of the query, or the resolver's address when ECS is false
+	Subnet netip.Prefix
+	ECS    bool
+	// the matched rule of the routing table, invalid when no rule matched
+	Rule netip.Prefix
+	PoP  uint16
+	// in bits of the subnet's family, -1 when no rule matched
+	Scope int
+}
@@ -0,0 +1,374 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultZoneTTL is the TTL of zone records until a $TTL line sets another one
+const defaultZoneTTL = 3600
+
+// Zone is an authoritative zone: the SOA and NS records of its apex, static records, CNAMEs and the names
+// steered by the routing table. A name of the zone with no records of the type asked for gets an empty answer
+// (NODATA), a name not in the zone does not exist (NXDOMAIN), both with the zone's SOA in the authority section.
+type Zone struct {
+	// canonical
+	Origin string
+	soa    soa
+	// canonical name -> node, empty non-terminals included
+	names map[string]*zoneNode
+}
+
+type soa struct {
+	ttl          uint32
+	mname, rname string
+	// the serial answered is the routing table's publish time when that is greater
+	serial, refresh, retry, expire, minimum uint32
+}
+
+type zoneNode struct {
+	// owner names are set when answering
+	records []RR
+	// the target of the CNAME of the name, there are no other records then
+	cname string
+	// A and AAAA queries are answered from the routing table
+	steered bool
+}
+
+// ReadZone reads a zone definition, one "name [TTL] type data" record per line. Names are relative to the
+// $ORIGIN line unless they end with a dot, @ is the origin itself, and a $TTL line sets the TTL of the records
+// after it (3600 seconds by default). The types are SOA (exactly one, at the origin, "mname rname serial
+// refresh retry expire minimum"), NS (at the origin, delegations are not supported), A, AAAA, CNAME, MX, TXT
+// (quoted strings) and STEERED, without data, for names answered with the addresses of the routed PoP.
+// Empty lines and lines starting with # are skipped.
+func ReadZone(reader io.Reader) (*Zone, error) {
+	z := &Zone{names: map[string]*zoneNode{}}
+	ttl := uint32(defaultZoneTTL)
+	var hasSOA bool
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitZoneLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		switch fields[0] {
+		case "$ORIGIN":
+			if len(fields) != 2 || !strings.HasSuffix(fields[1], ".") {
+				return nil, fmt.Errorf("line %d: expected $ORIGIN with a fully qualified name", lineNumber)
+			}
+			if z.Origin != "" {
+				return nil, fmt.Errorf("line %d: one zone per file, $ORIGIN already set to %s", lineNumber, z.Origin)
+			}
+			z.Origin = CanonicalName(fields[1])
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected $TTL with a number of seconds", lineNumber)
+			}
+			if ttl, err = parseUint32(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: failed to parse TTL '%s': %w", lineNumber, fields[1], err)
+			}
+			continue
+		}
+		if z.Origin == "" {
+			return nil, fmt.Errorf("line %d: records before the $ORIGIN line", lineNumber)
+		}
+		if err := z.add(fields, ttl, &hasSOA); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := z.validate(hasSOA); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// LoadZone reads the zone definition in filename, see ReadZone
+func LoadZone(filename string) (*Zone, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone file '%s': %w", filename, err)
+	}
+	defer file.Close()
+	z, err := ReadZone(file)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", filename, err)
+	}
+	return z, nil
+}
+
+// add the record of a line split into fields, ttl is the current $TTL
+func (z *Zone) add(fields []string, ttl uint32, hasSOA *bool) error {
+	if len(fields) < 2 {
+		return fmt.Errorf("expected a name and a type")
+	}
+	name, err := z.absolute(fields[0])
+	if err != nil {
+		return err
+	}
+	if !InZone(name, z.Origin) {
+		return fmt.Errorf("%s is not in the zone %s", name, z.Origin)
+	}
+	fields = fields[1:]
+	if number, err := parseUint32(fields[0]); err == nil {
+		ttl, fields = number, fields[1:]
+		if len(fields) == 0 {
+			return fmt.Errorf("expected a type after the TTL")
+		}
+	}
+	recordType, data := strings.ToUpper(fields[0]), fields[1:]
+	node := z.node(name)
+	if recordType == "STEERED" {
+		if len(data) != 0 {
+			return fmt.Errorf("STEERED takes no data")
+		}
+		node.steered = true
+		return nil
+	}
+	rr := RR{Class: ClassINET, TTL: ttl}
+	switch recordType {
+	case "A", "AAAA":
+		if len(data) != 1 {
+			return fmt.Errorf("expected one address")
+		}
+		addr, err := netip.ParseAddr(data[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse address '%s': %w", data[0], err)
+		}
+		rr.Type = TypeA
+		if recordType == "AAAA" {
+			rr.Type = TypeAAAA
+		}
+		if addr.Is4() != (rr.Type == TypeA) || addr.Is4In6() {
+			return fmt.Errorf("%s is not an address of a %s record", addr, recordType)
+		}
+		rr.Data = addr.AsSlice()
+	case "NS", "CNAME":
+		if len(data) != 1 {
+			return fmt.Errorf("expected one name")
+		}
+		target, err := z.absolute(data[0])
+		if err != nil {
+			return err
+		}
+		rr.Type = TypeNS
+		if recordType == "CNAME" {
+			rr.Type = TypeCNAME
+			if node.cname != "" {
+				return fmt.Errorf("more than one CNAME for %s", name)
+			}
+			node.cname = target
+		}
+		if rr.Data, err = appendName(nil, 0, target, nil); err != nil {
+			return err
+		}
+	case "MX":
+		if len(data) != 2 {
+			return fmt.Errorf("expected a preference and an exchange")
+		}
+		preference, err := strconv.ParseUint(data[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("failed to parse MX preference '%s': %w", data[0], err)
+		}
+		exchange, err := z.absolute(data[1])
+		if err != nil {
+			return err
+		}
+		rr.Type = TypeMX
+		if rr.Data, err = appendName(binary.BigEndian.AppendUint16(nil, uint16(preference)), 0, exchange, nil); err != nil {
+			return err
+		}
+	case "TXT":
+		if len(data) == 0 {
+			return fmt.Errorf("expected at least one string")
+		}
+		rr.Type = TypeTXT
+		for _, s := range data {
+			if len(s) > 255 {
+				return fmt.Errorf("TXT string longer than 255 bytes")
+			}
+			rr.Data = append(append(rr.Data, byte(len(s))), s...)
+		}
+	case "SOA":
+		if name != z.Origin {
+			return fmt.Errorf("SOA of %s outside the origin %s", name, z.Origin)
+		}
+		if *hasSOA {
+			return fmt.Errorf("more than one SOA")
+		}
+		if len(data) != 7 {
+			return fmt.Errorf("expected mname rname serial refresh retry expire minimum")
+		}
+		z.soa.ttl = ttl
+		if z.soa.mname, err = z.absolute(data[0]); err != nil {
+			return err
+		}
+		if z.soa.rname, err = z.absolute(data[1]); err != nil {
+			return err
+		}
+		for i, value := range []*uint32{&z.soa.serial, &z.soa.refresh, &z.soa.retry, &z.soa.expire, &z.soa.minimum} {
+			if *value, err = parseUint32(data[2+i]); err != nil {
+				return fmt.Errorf("failed to parse SOA field '%s': %w", data[2+i], err)
+			}
+		}
+		*hasSOA = true
+		// the SOA is built when answering, its serial follows the routing table's publish time
+		return nil
+	default:
+		return fmt.Errorf("unsupported record type '%s'", fields[0])
+	}
+	if rr.Type == TypeNS && name != z.Origin {
+		return fmt.Errorf("NS of %s outside the origin %s, delegations are not supported", name, z.Origin)
+	}
+	node.records = append(node.records, rr)
+	return nil
+}
+
+// the node of the canonical name, created with its empty non-terminals up to the origin
+func (z *Zone) node(name string) *zoneNode {
+	node, ok := z.names[name]
+	if ok {
+		return node
+	}
+	node = &zoneNode{}
+	z.names[name] = node
+	for parent := name; parent != z.Origin; {
+		_, parent, _ = strings.Cut(parent, ".")
+		if parent == "" {
+			parent = "."
+		}
+		if _, ok := z.names[parent]; ok {
+			break
+		}
+		z.names[parent] = &zoneNode{}
+	}
+	return node
+}
+
+func (z *Zone) validate(hasSOA bool) error {
+	if z.Origin == "" {
+		return fmt.Errorf("no $ORIGIN line")
+	}
+	if !hasSOA {
+		return fmt.Errorf("zone %s has no SOA", z.Origin)
+	}
+	if !z.names[z.Origin].has(TypeNS) {
+		return fmt.Errorf("zone %s has no NS records", z.Origin)
+	}
+	for name, node := range z.names {
+		switch {
+		case node.cname != "" && name == z.Origin:
+			return fmt.Errorf("CNAME at the origin %s", name)
+		case node.cname != "" && (len(node.records) > 1 || node.steered):
+			return fmt.Errorf("CNAME of %s next to other records", name)
+		case node.steered && (node.has(TypeA) || node.has(TypeAAAA)):
+			return fmt.Errorf("steered name %s with static addresses", name)
+		}
+	}
+	return nil
+}
+
+// the canonical fully qualified form of a name of the zone file
+func (z *Zone) absolute(name string) (string, error) {
+	switch {
+	case name == "@":
+		name = z.Origin
+	case !strings.HasSuffix(name, "."):
+		name += "." + z.Origin
+		if z.Origin == "." {
+			name = name[:len(name)-1]
+		}
+	}
+	// packing checks the labels and the length
+	if _, err := appendName(nil, 0, name, nil); err != nil {
+		return "", err
+	}
+	return CanonicalName(name), nil
+}
+
+func (n *zoneNode) has(recordType uint16) bool {
+	for _, rr := range n.records {
+		if rr.Type == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+// the records of node answering qtype with owner, the SOA included at the origin
+func (z *Zone) records(owner string, node *zoneNode, qtype uint16, serial uint32) []RR {
+	var records []RR
+	if CanonicalName(owner) == z.Origin && (qtype == TypeSOA || qtype == TypeANY) {
+		records = append(records, z.soaRecord(owner, z.soa.ttl, serial))
+	}
+	for _, rr := range node.records {
+		if rr.Type == qtype || qtype == TypeANY {
+			rr.Name = owner
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// the SOA for the authority section of negative answers, its TTL is the negative caching time (RFC 2308)
+func (z *Zone) negative(serial uint32) RR {
+	return z.soaRecord(z.Origin, min(z.soa.ttl, z.soa.minimum), serial)
+}
+
+func (z *Zone) soaRecord(owner string, ttl, serial uint32) RR {
+	data, _ := appendName(nil, 0, z.soa.mname, nil)
+	data, _ = appendName(data, 0, z.soa.rname, nil)
+	for _, value := range []uint32{serial, z.soa.refresh, z.soa.retry, z.soa.expire, z.soa.minimum} {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return RR{Name: owner, Type: TypeSOA, Class: ClassINET, TTL: ttl, Data: data}
+}
+
+// split a zone file line into fields, a double quoted field may contain spaces and \" or \\ escapes
+func splitZoneLine(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			fields, line = append(fields, line[:end]), line[end:]
+			continue
+		}
+		var field strings.Builder
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			}
+			field.WriteByte(line[i])
+		}
+		if i == len(line) {
+			return nil, fmt.Errorf("unterminated quoted string")
+		}
+		fields, line = append(fields, field.String()), line[i+1:]
+	}
+}
+
+func parseUint32(s string) (uint32, error) {
+	number, err := strconv.ParseUint(s, 10, 32)
+	return uint32(number), err
+}
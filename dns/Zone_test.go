@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"CDN77-DNS/optimised"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZone = `
+# steered names and what surrounds them
+$ORIGIN cdn.example.com.
+$TTL 600
+@        SOA     ns1.example.net. hostmaster.example.net. 2026100100 7200 900 1209600 300
+@        NS      ns1.example.net.
+@        NS      ns2.example.net.
+@        MX      10 mail.example.net.
+@        TXT     "v=spf1 -all" "and \"more\""
+video    STEERED
+video    TXT     steered
+www      CNAME   video
+alias    CNAME   www.cdn.example.com.
+away     CNAME   cdn.example.org.
+static   60 A    192.0.2.5
+static   AAAA    2001:db8::5
+a.b.deep A       192.0.2.6
+loop1    CNAME   loop2
+loop2    CNAME   loop1
+`
+
+// a record as text, "TYPE TTL data"
+func describe(rr RR) string {
+	var data string
+	switch rr.Type {
+	case TypeA, TypeAAAA:
+		addr, _ := netip.AddrFromSlice(rr.Data)
+		data = addr.String()
+	case TypeNS, TypeCNAME:
+		data, _, _ = readName(rr.Data, 0)
+	case TypeMX:
+		exchange, _, _ := readName(rr.Data, 2)
+		data = fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rr.Data), exchange)
+	case TypeSOA:
+		mname, next, _ := readName(rr.Data, 0)
+		rname, next, _ := readName(rr.Data, next)
+		data = fmt.Sprintf("%s %s %d", mname, rname, binary.BigEndian.Uint32(rr.Data[next:]))
+	case TypeTXT:
+		var strs []string
+		for d := rr.Data; len(d) > 0; d = d[1+d[0]:] {
+			strs = append(strs, fmt.Sprintf("%q", d[1:1+d[0]]))
+		}
+		data = strings.Join(strs, " ")
+	}
+	return fmt.Sprintf("%s %d %s", map[uint16]string{TypeA: "A", TypeAAAA: "AAAA", TypeNS: "NS", TypeCNAME: "CNAME", TypeMX: "MX", TypeSOA: "SOA", TypeTXT: "TXT"}[rr.Type], rr.TTL, data)
+}
+
+func describeAll(records []RR) []string {
+	var described []string
+	for _, rr := range records {
+		described = append(described, describe(rr))
+	}
+	return described
+}
+
+func TestZones(t *testing.T) {
+	zone, err := ReadZone(strings.NewReader(testZone))
+	if err != nil {
+		t.Fatalf("ReadZone failed: %v", err)
+	}
+	table := testTable(t)
+	h := NewSteering(SingleTable(table, "."), testAddresses(), 30*time.Second)
+	h.SetZones(zone)
+	h.SetCache(NewCache(100))
+	// the zone's serial is greater than the table's publish time
+	const serial = 2026100100
+	soa := fmt.Sprintf("SOA 300 ns1.example.net. hostmaster.example.net. %d", serial)
+
+	tests := []struct {
+		name          string
+		query         *Message
+		wantRcode     int
+		wantAnswers   []string
+		wantAuthority []string
+		// the scope of the client subnet option, 0 for answers not depending on the client
+		wantScope uint8
+	}{
+		{"steered", newQuery("video.cdn.example.com.", TypeA, "2001:db8:1200::/40"), RcodeSuccess, []string{"A 30 192.0.2.10"}, nil, 32},
+		{"CNAME to a steered name", newQuery("WWW.cdn.example.com.", TypeAAAA, "2001:db8:1200::/40"), RcodeSuccess,
+			[]string{"CNAME 600 video.cdn.example.com.", "AAAA 30 2001:db8::10"}, nil, 32},
+		{"CNAME chain", newQuery("alias.cdn.example.com.", TypeA, "192.0.2.0/24"), RcodeSuccess,
+			[]string{"CNAME 600 www.cdn.example.com.", "CNAME 600 video.cdn.example.com.", "A 30 198.51.100.1"}, nil, 24},
+		{"steered name without addresses of the type", newQuery("video.cdn.example.com.", TypeAAAA, "192.0.2.0/24"), RcodeSuccess, nil, []string{soa}, 24},
+		{"static record of a steered name", newQuery("video.cdn.example.com.", TypeTXT, "2001:db8:1200::/40"), RcodeSuccess, []string{`TXT 600 "steered"`}, nil, 0},
+		{"static addresses are not routed", newQuery("static.cdn.example.com.", TypeA, "2001:db8:1200::/40"), RcodeSuccess, []string{"A 60 192.0.2.5"}, nil, 0},
+		{"NODATA", newQuery("static.cdn.example.com.", TypeMX, "2001:db8:1200::/40"), RcodeSuccess, nil, []string{soa}, 0},
+		{"NXDOMAIN", newQuery("nope.cdn.example.com.", TypeA, "2001:db8:1200::/40"), RcodeNameError, nil, []string{soa}, 0},
+		{"below a steered name", newQuery("x.video.cdn.example.com.", TypeA, "2001:db8:1200::/40"), RcodeNameError, nil, []string{soa}, 0},
+		{"empty non-terminal", newQuery("b.deep.cdn.example.com.", TypeA, "2001:db8:1200::/40"), RcodeSuccess, nil, []string{soa}, 0},
+		{"SOA", newQuery("cdn.example.com.", TypeSOA, ""), RcodeSuccess, []string{fmt.Sprintf("SOA 600 ns1.example.net. hostmaster.example.net. %d", serial)}, nil, 0},
+		{"NS", newQuery("cdn.example.com.", TypeNS, ""), RcodeSuccess, []string{"NS 600 ns1.example.net.", "NS 600 ns2.example.net."}, nil, 0},
+		{"MX", newQuery("cdn.example.com.", TypeMX, ""), RcodeSuccess, []string{"MX 600 10 mail.example.net."}, nil, 0},
+		{"TXT", newQuery("cdn.example.com.", TypeTXT, ""), RcodeSuccess, []string{`TXT 600 "v=spf1 -all" "and \"more\""`}, nil, 0},
+		{"CNAME out of the zones", newQuery("away.cdn.example.com.", TypeA, ""), RcodeSuccess, []string{"CNAME 600 cdn.example.org."}, nil, 0},
+		{"CNAME query", newQuery("www.cdn.example.com.", TypeCNAME, ""), RcodeSuccess, []string{"CNAME 600 video.cdn.example.com."}, nil, 0},
+		{"CNAME loop", newQuery("loop1.cdn.example.com.", TypeA, ""), RcodeServerFailure, nil, nil, 0},
+		{"other zone", newQuery("cdn.example.org.", TypeA, ""), RcodeRefused, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// twice, the second time from the cache for steered answers
+			for range 2 {
+				response := exchange(t, h, "[2001:db8::53]:5300", "udp", tt.query)
+				if int(response.Rcode) != tt.wantRcode {
+					t.Fatalf("got rcode %d, want %d", response.Rcode, tt.wantRcode)
+				}
+				if tt.wantRcode != RcodeRefused && tt.wantRcode != RcodeServerFailure && !response.Authoritative {
+					t.Errorf("expected an authoritative response")
+				}
+				if got := describeAll(response.Answers); !slices.Equal(got, tt.wantAnswers) {
+					t.Errorf("got answers %q, want %q", got, tt.wantAnswers)
+				}
+				if got := describeAll(response.Authority); !slices.Equal(got, tt.wantAuthority) {
+					t.Errorf("got authority %q, want %q", got, tt.wantAuthority)
+				}
+				if cs := tt.query.EDNS; cs != nil && cs.ClientSubnet != nil && tt.wantRcode == RcodeSuccess {
+					if got := response.EDNS.ClientSubnet; got == nil || got.ScopePrefix != tt.wantScope {
+						t.Errorf("got client subnet %+v, want scope %d", got, tt.wantScope)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("serial follows the publish time", func(t *testing.T) {
+		zone, err := ReadZone(strings.NewReader(strings.Replace(testZone, "2026100100", "1", 1)))
+		if err != nil {
+			t.Fatalf("ReadZone failed: %v", err)
+		}
+		// the SOA serial answered by a server routing from table
+		answered := func(table *optimised.Data) uint32 {
+			t.Helper()
+			h := NewSteering(SingleTable(table, "."), testAddresses(), 30*time.Second)
+			h.SetZones(zone)
+			response := exchange(t, h, "[2001:db8::53]:5300", "udp", newQuery("cdn.example.com.", TypeSOA, ""))
+			if len(response.Answers) != 1 {
+				t.Fatalf("got answers %q", describeAll(response.Answers))
+			}
+			rr := response.Answers[0]
+			_, next, _ := readName(rr.Data, 0)
+			_, next, _ = readName(rr.Data, next)
+			return binary.BigEndian.Uint32(rr.Data[next:])
+		}
+
+		table := testTable(t)
+		for i := range 3 {
+			if err := table.Insert(netip.PrefixFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xbb, byte(i)}), 40), 1); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+		before := answered(table)
+		if want := uint32(table.Published().Unix()); before != want {
+			t.Errorf("got serial %d, want the publish time %d", before, want)
+		}
+		// a restart starts the table serial over, the SOA serial must not go back
+		time.Sleep(time.Second)
+		if after := answered(testTable(t)); after <= before {
+			t.Errorf("got serial %d after a restart, want more than %d", after, before)
+		}
+	})
+}
+
+func TestReadZone(t *testing.T) {
+	const head = "$ORIGIN cdn.example.com.\n@ SOA ns1.example.net. hostmaster.example.net. 1 2 3 4 5\n@ NS ns1.example.net.\n"
+	zone, err := ReadZone(strings.NewReader(head + "$TTL 60\nwww 30 A 192.0.2.1\nmail AAAA 2001:db8::1\nwww.example.net. CNAME x"))
+	if err == nil || !strings.Contains(err.Error(), "not in the zone") {
+		t.Errorf("expected a name out of the zone to fail, got %v", err)
+	}
+	if zone, err = ReadZone(strings.NewReader(head + "$TTL 60\nwww 30 A 192.0.2.1\nmail AAAA 2001:db8::1\n")); err != nil {
+		t.Fatalf("ReadZone failed: %v", err)
+	}
+	if got := describeAll(zone.names["www.cdn.example.com."].records); !slices.Equal(got, []string{"A 30 192.0.2.1"}) {
+		t.Errorf("got www records %q", got)
+	}
+	if got := describeAll(zone.names["mail.cdn.example.com."].records); !slices.Equal(got, []string{"AAAA 60 2001:db8::1"}) {
+		t.Errorf("got mail records %q", got)
+	}
+
+	for _, tt := range []struct {
+		name, zone string
+	}{
+		{"no origin", "@ SOA ns1.example.net. hostmaster.example.net. 1 2 3 4 5\n"},
+		{"relative origin", "$ORIGIN cdn.example.com\n"},
+		{"second origin", head + "$ORIGIN example.net.\n"},
+		{"no SOA", "$ORIGIN cdn.example.com.\n@ NS ns1.example.net.\n"},
+		{"no NS", "$ORIGIN cdn.example.com.\n@ SOA ns1.example.net. hostmaster.example.net. 1 2 3 4 5\n"},
+		{"second SOA", head + "@ SOA ns2.example.net. hostmaster.example.net. 1 2 3 4 5\n"},
+		{"SOA below the origin", head + "www SOA ns1.example.net. hostmaster.example.net. 1 2 3 4 5\n"},
+		{"short SOA", "$ORIGIN cdn.example.com.\n@ SOA ns1.example.net. hostmaster.example.net. 1 2 3 4\n"},
+		{"delegation", head + "sub NS ns1.example.net.\n"},
+		{"CNAME at the origin", head + "@ CNAME www\n"},
+		{"CNAME and other records", head + "www CNAME video\nwww TXT x\n"},
+		{"two CNAMEs", head + "www CNAME video\nwww CNAME static\n"},
+		{"steered CNAME", head + "www CNAME video\nwww STEERED\n"},
+		{"steered static address", head + "www STEERED\nwww A 192.0.2.1\n"},
+		{"STEERED with data", head + "www STEERED 1\n"},
+		{"IPv6 A record", head + "www A 2001:db8::1\n"},
+		{"IPv4 AAAA record", head + "www AAAA 192.0.2.1\n"},
+		{"bad address", head + "www A 192.0.2\n"},
+		{"bad MX", head + "@ MX mail.example.net.\n"},
+		{"unterminated TXT", head + "@ TXT \"open\n"},
+		{"long TXT", head + "@ TXT " + strings.Repeat("x", 256) + "\n"},
+		{"bad TTL", head + "$TTL soon\n"},
+		{"unsupported type", head + "www SRV 0 0 443 host\n"},
+		{"bad label", head + "www..x A 192.0.2.1\n"},
+		{"no type", head + "www 60\n"},
+	} {
+		if _, err := ReadZone(strings.NewReader(tt.zone)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package dnstap logs the queries answered by the DNS server in the dnstap format (dnstap.info):
+// protobuf encoded Dnstap messages in a Frame Streams stream written to a file or a unix socket.
+// The routing of every answer (client subnet, matched rule, PoP and scope) goes into the extra field.
+package dnstap
+
+import (
+	"CDN77-DNS/dns"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configure a Logger
+type Options struct {
+	// identity and version fields of every message, eg. the host name and the software version
+	Identity string
+	Version  string
+	// one in SampleEvery answered queries is logged, 1 logs all of them
+	SampleEvery int
+	// answered queries waiting to be written, further ones are dropped until the writer catches up
+	BufferSize int
+}
+
+// DefaultOptions log every query with a buffer of 10000 queries
+var DefaultOptions = Options{SampleEvery: 1, BufferSize: 10000}
+
+// Stats counts the sampled queries
+type Stats struct {
+	// queries written to the output, each as a query and a response message
+	Logged uint64
+	// queries dropped because the buffer was full or the output unavailable
+	Dropped uint64
+}
+
+// Logger is a dns.Tap writing the sampled queries to a Frame Streams output from its own goroutine.
+// Tap never blocks the serving goroutines: when the buffer is full or the output is gone the query is dropped.
+// A socket output is reconnected at most once a second, a file output is given up on the first write error.
+type Logger struct {
+	options Options
+	records chan dns.Exchange
+	// opens the output, again after a write failed
+	open func() (*frameWriter, error)
+
+	seen    atomic.Uint64
+	logged  atomic.Uint64
+	dropped atomic.Uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	finished  chan struct{}
+	// set by the writer goroutine before finished is closed
+	closeErr error
+}
+
+// NewFile logs to a new Frame Streams file, an existing file is replaced
+func NewFile(filename string, options Options) (*Logger, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dnstap file '%s': %w", filename, err)
+	}
+	fw, err := newFrameWriter(file, nil, nil)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write dnstap file '%s': %w", filename, err)
+	}
+	opened := false
+	return newLogger(options, func() (*frameWriter, error) {
+		if opened {
+			return nil, fmt.Errorf("dnstap file '%s' failed earlier", filename)
+		}
+		opened = true
+		return fw, nil
+	}), nil
+}
+
+// NewSocket logs to the dnstap receiver listening on the unix socket path, eg. a collector or dnstap -u.
+// The connection is made in the background, queries are dropped while there is none.
+func NewSocket(path string, options Options) *Logger {
+	return newLogger(options, func() (*frameWriter, error) {
+		conn, err := net.DialTimeout("unix", path, handshakeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		fw, err := newFrameWriter(conn, conn, conn.SetDeadline)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dnstap handshake with '%s' failed: %w", path, err)
+		}
+		return fw, nil
+	})
+}
+
+func newLogger(options Options, open func() (*frameWriter, error)) *Logger {
+	l := &Logger{
+		options:  options,
+		records:  make(chan dns.Exchange, max(options.BufferSize, 1)),
+		open:     open,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	l.options.SampleEvery = max(options.SampleEvery, 1)
+	go l.run()
+	return l
+}
+
+// Tap queues a sampled query for writing, implementing dns.Tap
+func (l *Logger) Tap(exchange dns.Exchange) {
+	if (l.seen.Add(1)-1)%uint64(l.options.SampleEvery) != 0 {
+		return
+	}
+	select {
+	case l.records <- exchange:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Stats returns the logged and dropped counts so far
+func (l *Logger) Stats() Stats {
+	return Stats{Logged: l.logged.Load(), Dropped: l.dropped.Load()}
+}
+
+// Close writes the queued queries, ends the stream and closes the output. Queries tapped afterwards are not written.
+func (l *Logger) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	<-l.finished
+	return l.closeErr
+}
+
+func (l *Logger) run() {
+	defer close(l.finished)
+	var fw *frameWriter
+	var nextAttempt time.Time
+	write := func(exchange dns.Exchange) {
+		if fw == nil && l.open != nil && !time.Now().Before(nextAttempt) {
+			var err error
+			if fw, err = l.open(); err != nil {
+				log.Printf("dnstap output unavailable: %v", err)
+				nextAttempt = time.Now().Add(time.Second)
+			}
+		}
+		if fw == nil {
+			l.dropped.Add(1)
+			return
+		}
+		err := fw.write(l.message(exchange, false))
+		if err == nil {
+			err = fw.write(l.message(exchange, true))
+		}
+		if err == nil && len(l.records) == 0 {
+			err = fw.flush()
+		}
+		if err != nil {
+			log.Printf("dnstap write failed: %v", err)
+			fw.closer.Close()
+			fw = nil
+			l.dropped.Add(1)
+			return
+		}
+		l.logged.Add(1)
+	}
+
+	for {
+		select {
+		case exchange := <-l.records:
+			write(exchange)
+		case <-l.done:
+			for len(l.records) > 0 {
+				write(<-l.records)
+			}
+			if fw != nil {
+				l.closeErr = fw.close()
+			}
+			return
+		}
+	}
+}
+
+// dnstap.proto field numbers and values
+const (
+	fieldIdentity = 1
+	fieldVersion  = 2
+	fieldExtra    = 3
+	fieldMessage  = 14
+	fieldType     = 15
+
+	typeMessage = 1
+
+	fieldMessageType     = 1
+	fieldSocketFamily    = 2
+	fieldSocketProtocol  = 3
+	fieldQueryAddress    = 4
+	fieldQueryPort       = 6
+	fieldQueryTimeSec    = 8
+	fieldQueryTimeNsec   = 9
+	fieldQueryMessage    = 10
+	fieldResponseTimeSec = 12
+	fieldResponseNsec    = 13
+	fieldResponseMessage = 14
+
+	messageAuthQuery    = 1
+	messageAuthResponse = 2
+
+	familyINET  = 1
+	familyINET6 = 2
+
+	protocolUDP = 1
+	protocolTCP = 2
+	protocolDOT = 3
+	protocolDOH = 4
+)
+
+// the Dnstap message of the query or of the response of exchange
+func (l *Logger) message(exchange dns.Exchange, response bool) []byte {
+	var m []byte
+	messageType := uint64(messageAuthQuery)
+	if response {
+		messageType = messageAuthResponse
+	}
+	m = appendVarint(m, fieldMessageType, messageType)
+	client := exchange.Client.Addr().Unmap()
+	family := uint64(familyINET6)
+	if client.Is4() {
+		family = familyINET
+	}
+	m = appendVarint(m, fieldSocketFamily, family)
+	protocol := uint64(protocolUDP)
+	switch exchange.Transport {
+	case "tcp":
+		protocol = protocolTCP
+	case "dot":
+		protocol = protocolDOT
+	case "doh":
+		protocol = protocolDOH
+	}
+	m = appendVarint(m, fieldSocketProtocol, protocol)
+	m = appendBytes(m, fieldQueryAddress, client.AsSlice())
+	m = appendVarint(m, fieldQueryPort, uint64(exchange.Client.Port()))
+	m = appendVarint(m, fieldQueryTimeSec, uint64(exchange.QueryTime.Unix()))
+	m = appendFixed32(m, fieldQueryTimeNsec, uint32(exchange.QueryTime.Nanosecond()))
+	if response {
+		m = appendVarint(m, fieldResponseTimeSec, uint64(exchange.ResponseTime.Unix()))
+		m = appendFixed32(m, fieldResponseNsec, uint32(exchange.ResponseTime.Nanosecond()))
+		m = appendBytes(m, fieldResponseMessage, exchange.Response)
+	} else {
+		m = appendBytes(m, fieldQueryMessage, exchange.Query)
+	}
+
+	var d []byte
+	if l.options.Identity != "" {
+		d = appendBytes(d, fieldIdentity, []byte(l.options.Identity))
+	}
+	if l.options.Version != "" {
+		d = appendBytes(d, fieldVersion, []byte(l.options.Version))
+	}
+	if extra := Extra(exchange.Routing); response && extra != "" {
+		d = appendBytes(d, fieldExtra, []byte(extra))
+	}
+	d = appendBytes(d, fieldMessage, m)
+	return appendVarint(d, fieldType, typeMessage)
+}
+
+// Extra is the routing as written to the extra field of response messages,
+// "subnet=2001:db8:1200::/40 ecs=true rule=2001:db8::/32 pop=12 scope=32", empty for queries answered without routing
+func Extra(routing dns.Routing) string {
+	if !routing.Subnet.IsValid() {
+		return ""
+	}
+	extra := fmt.Sprintf("subnet=%s ecs=%t", routing.Subnet, routing.ECS)
+	if routing.Rule.IsValid() {
+		extra += fmt.Sprintf(" rule=%s pop=%d scope=%d", routing.Rule, routing.PoP, routing.Scope)
+	}
+	return extra
+}
+
+// protobuf wire format, field keys are the field number shifted left by 3 bits ORed with the wire type
+func appendVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3)
+	return binary.AppendUvarint(buf, value)
+}
+
+func appendFixed32(buf []byte, field int, value uint32) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(buf, value)
+}
+
+func appendBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
@@ -0,0 +1,240 @@
+package dnstap
+
+import (
+	"CDN77-DNS/dns"
+	"CDN77-DNS/optimised"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// read a Frame Streams stream like a dnstap receiver and return its data frames,
+// with w the bidirectional handshake is answered
+func readStream(t *testing.T, r io.Reader, w io.Writer) [][]byte {
+	t.Helper()
+	answer := func(controlType uint32, contentType string) {
+		if err := (&frameWriter{w: bufio.NewWriter(w)}).control(controlType, contentType); err != nil {
+			t.Errorf("failed to answer control frame: %v", err)
+		}
+	}
+	expect := func(r io.Reader, want uint32) {
+		controlType, contentType, err := readControl(r)
+		if err != nil || controlType != want {
+			t.Fatalf("expected control frame %d, got %d (%v)", want, controlType, err)
+		}
+		if want != controlStop && contentType != ContentType {
+			t.Errorf("control frame %d with content type '%s'", want, contentType)
+		}
+	}
+	if w != nil {
+		expect(r, controlReady)
+		answer(controlAccept, ContentType)
+	}
+	expect(r, controlStart)
+
+	var frames [][]byte
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if binary.BigEndian.Uint32(length[:]) == 0 {
+			expect(io.MultiReader(bytes.NewReader(length[:]), r), controlStop)
+			if w != nil {
+				answer(controlFinish, "")
+			}
+			return frames
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// decode a protobuf message into its fields: uint64 for varints, uint32 for fixed32 and []byte for bytes
+func decode(t *testing.T, message []byte) map[int]any {
+	t.Helper()
+	fields := map[int]any{}
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			fields[int(key>>3)], message = value, message[n:]
+		case 5:
+			fields[int(key>>3)], message = binary.LittleEndian.Uint32(message), message[4:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			fields[int(key>>3)], message = message[n:n+int(length)], message[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	received := make(chan [][]byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Accept failed: %v", err)
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		received <- readStream(t, conn, conn)
+	}()
+
+	data := optimised.NewData()
+	if err := data.Insert(netip.MustParsePrefix("2001:db8::/32"), 1); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	steering := dns.NewSteering(dns.SingleTable(data, "."), dns.Addresses{1: {netip.MustParseAddr("192.0.2.1")}}, time.Minute)
+	logger := NewSocket(path, Options{Identity: "dns1", Version: "test", SampleEvery: 1, BufferSize: 10})
+	steering.SetTap(logger)
+
+	query, err := (&dns.Message{
+		Header:    dns.Header{ID: 7},
+		Questions: []dns.Question{{Name: "cdn.example.com.", Type: dns.TypeA, Class: dns.ClassINET}},
+		EDNS:      &dns.EDNS{UDPSize: 1232, ClientSubnet: &dns.ClientSubnet{Prefix: netip.MustParsePrefix("2001:db8:1200::/40")}},
+	}).Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	response := steering.ServeDNS(&dns.Request{Client: netip.MustParseAddrPort("[2001:db8::53]:5300"), Transport: "udp", Wire: query})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if stats := logger.Stats(); stats != (Stats{Logged: 1}) {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	frames := <-received
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	for i, frame := range frames {
+		d := decode(t, frame)
+		if string(d[fieldIdentity].([]byte)) != "dns1" || string(d[fieldVersion].([]byte)) != "test" || d[fieldType] != uint64(typeMessage) {
+			t.Errorf("frame %d: bad Dnstap fields %v", i, d)
+		}
+		m := decode(t, d[fieldMessage].([]byte))
+		if m[fieldSocketFamily] != uint64(familyINET6) || m[fieldSocketProtocol] != uint64(protocolUDP) || m[fieldQueryPort] != uint64(5300) ||
+			!bytes.Equal(m[fieldQueryAddress].([]byte), netip.MustParseAddr("2001:db8::53").AsSlice()) {
+			t.Errorf("frame %d: bad socket fields %v", i, m)
+		}
+		if i == 0 {
+			if m[fieldMessageType] != uint64(messageAuthQuery) || !bytes.Equal(m[fieldQueryMessage].([]byte), query) || d[fieldExtra] != nil {
+				t.Errorf("bad query message %v", m)
+			}
+			continue
+		}
+		if m[fieldMessageType] != uint64(messageAuthResponse) || !bytes.Equal(m[fieldResponseMessage].([]byte), response) {
+			t.Errorf("bad response message %v", m)
+		}
+		if extra, want := string(d[fieldExtra].([]byte)), "subnet=2001:db8:1200::/40 ecs=true rule=2001:db8::/32 pop=1 scope=32"; extra != want {
+			t.Errorf("got extra '%s', want '%s'", extra, want)
+		}
+	}
+}
+
+func TestFileSampling(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	logger, err := NewFile(filename, Options{SampleEvery: 3, BufferSize: 100})
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	for i := range 9 {
+		logger.Tap(dns.Exchange{
+			Client:    netip.MustParseAddrPort("192.0.2.53:53"),
+			Transport: "tcp",
+			QueryTime: time.Unix(1700000000, 5),
+			Query:     []byte{byte(i)},
+			Response:  []byte{byte(i), 0x80},
+			Routing:   dns.Routing{Scope: -1},
+		})
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+	frames := readStream(t, file, nil)
+	if len(frames) != 6 {
+		t.Fatalf("got %d frames, want 6", len(frames))
+	}
+	for i, frame := range frames {
+		m := decode(t, decode(t, frame)[fieldMessage].([]byte))
+		// exchanges 0, 3 and 6 are sampled
+		want := []byte{byte(i / 2 * 3)}
+		got := m[fieldQueryMessage]
+		if i%2 == 1 {
+			want, got = append(want, 0x80), m[fieldResponseMessage]
+		}
+		if !bytes.Equal(got.([]byte), want) {
+			t.Errorf("frame %d: got message %v, want %v", i, got, want)
+		}
+		if m[fieldSocketFamily] != uint64(familyINET) || m[fieldSocketProtocol] != uint64(protocolTCP) ||
+			m[fieldQueryTimeSec] != uint64(1700000000) || m[fieldQueryTimeNsec] != uint32(5) {
+			t.Errorf("frame %d: bad fields %v", i, m)
+		}
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestDropWhenFull(t *testing.T) {
+	var output bytes.Buffer
+	opening, release := make(chan struct{}), make(chan struct{})
+	logger := newLogger(Options{SampleEvery: 1, BufferSize: 4}, func() (*frameWriter, error) {
+		close(opening)
+		<-release
+		return newFrameWriter(nopCloser{&output}, nil, nil)
+	})
+	exchange := dns.Exchange{Client: netip.MustParseAddrPort("192.0.2.53:53"), Transport: "udp", Query: []byte{1}, Response: []byte{2}}
+
+	// the writer takes the first query and waits for the output, the buffer takes 4 more
+	logger.Tap(exchange)
+	<-opening
+	for range 10 {
+		logger.Tap(exchange)
+	}
+	if stats := logger.Stats(); stats != (Stats{Dropped: 6}) {
+		t.Errorf("while the output blocks: got stats %+v, want 6 dropped", stats)
+	}
+	close(release)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if stats := logger.Stats(); stats != (Stats{Logged: 5, Dropped: 6}) {
+		t.Errorf("got stats %+v, want 5 logged and 6 dropped", stats)
+	}
+	if frames := readStream(t, &output, nil); len(frames) != 10 {
+		t.Errorf("got %d frames, want 10", len(frames))
+	}
+}
@@ -0,0 +1,144 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ContentType of the frames, a Frame Streams receiver only accepts streams of the content types it knows
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types
+const (
+	controlAccept uint32 = 1
+	controlStart  uint32 = 2
+	controlStop   uint32 = 3
+	controlReady  uint32 = 4
+	controlFinish uint32 = 5
+
+	controlFieldContentType uint32 = 1
+)
+
+// how long the receiver has to answer a control frame of the bidirectional handshake
+const handshakeTimeout = 5 * time.Second
+
+// frameWriter writes a Frame Streams stream: data frames are a 32 bit big endian length followed by the
+// payload, control frames start with a zero length (the escape). A file or other unidirectional output starts
+// with START and ends with STOP, on a socket the receiver first ACCEPTs our READY and answers STOP with FINISH.
+type frameWriter struct {
+	w      *bufio.Writer
+	closer io.Closer
+	// nil for unidirectional outputs
+	r io.Reader
+	// sets the deadline of the control frame exchanges on a socket, may be nil
+	setDeadline func(time.Time) error
+}
+
+// start a stream on output, reading the receiver's control frames from r when it is not nil
+func newFrameWriter(output io.WriteCloser, r io.Reader, setDeadline func(time.Time) error) (*frameWriter, error) {
+	fw := &frameWriter{w: bufio.NewWriter(output), closer: output, r: r, setDeadline: setDeadline}
+	if r != nil {
+		fw.deadline(time.Now().Add(handshakeTimeout))
+		if err := fw.control(controlReady, ContentType); err != nil {
+			return nil, err
+		}
+		if err := fw.expect(controlAccept); err != nil {
+			return nil, err
+		}
+		fw.deadline(time.Time{})
+	}
+	if err := fw.control(controlStart, ContentType); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (fw *frameWriter) deadline(t time.Time) {
+	if fw.setDeadline != nil {
+		fw.setDeadline(t)
+	}
+}
+
+// write a data frame, buffered until flush
+func (fw *frameWriter) write(payload []byte) error {
+	fw.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(payload))))
+	_, err := fw.w.Write(payload)
+	return err
+}
+
+func (fw *frameWriter) flush() error {
+	return fw.w.Flush()
+}
+
+// end the stream and close the output
+func (fw *frameWriter) close() error {
+	err := fw.control(controlStop, "")
+	if err == nil && fw.r != nil {
+		fw.deadline(time.Now().Add(handshakeTimeout))
+		err = fw.expect(controlFinish)
+	}
+	if closeErr := fw.closer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// write and flush a control frame, with the content type field when contentType is not empty
+func (fw *frameWriter) control(controlType uint32, contentType string) error {
+	frame := binary.BigEndian.AppendUint32(nil, controlType)
+	if contentType != "" {
+		frame = binary.BigEndian.AppendUint32(frame, controlFieldContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(contentType)))
+		frame = append(frame, contentType...)
+	}
+	fw.w.Write(binary.BigEndian.AppendUint32(nil, 0))
+	fw.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+	fw.w.Write(frame)
+	return fw.w.Flush()
+}
+
+// read the receiver's next frame, it must be the control frame controlType
+func (fw *frameWriter) expect(controlType uint32) error {
+	got, _, err := readControl(fw.r)
+	if err != nil {
+		return err
+	}
+	if got != controlType {
+		return fmt.Errorf("expected control frame %d from the dnstap receiver, got %d", controlType, got)
+	}
+	return nil
+}
+
+// read a control frame, returning its type and the content type field if any
+func readControl(r io.Reader) (controlType uint32, contentType string, err error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+	if escape := binary.BigEndian.Uint32(header[:]); escape != 0 {
+		return 0, "", fmt.Errorf("expected a control frame, got a data frame of %d bytes", escape)
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > 512 {
+		return 0, "", fmt.Errorf("invalid control frame length %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, "", err
+	}
+	controlType = binary.BigEndian.Uint32(frame)
+	for fields := frame[4:]; len(fields) >= 8; {
+		fieldType, fieldLength := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		if uint32(len(fields)-8) < fieldLength {
+			return 0, "", fmt.Errorf("invalid control frame field length %d", fieldLength)
+		}
+		if fieldType == controlFieldContentType {
+			contentType = string(fields[8 : 8+fieldLength])
+		}
+		fields = fields[8+fieldLength:]
+	}
+	return controlType, contentType, nil
+}
@@ -0,0 +1,420 @@
+package journal
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A journal directory holds journal-<generation>.log, the records of the changes made on top of the routing data file.
+// The file itself is always loaded first, so edits to it take effect on the next start or reload.
+//
+// A record is a big endian uint32 payload length, the CRC-32C of the payload and the payload of 20 byte changes:
+// op (0 insert, 1 delete), 16 byte address, prefix length, big endian uint16 PoP ID.
+// An insert of a rule with a window has op 2 and is followed by the window's not-before and not-after
+// as big endian int64 unix seconds (0 for an open end), 36 bytes in total.
+// Format version 2 adds op 3, an insert of a rule with weights or a backup: the op 2 change followed by
+// the uint16 backup PoP ID, 1 if the rule has a backup else 0, the uint16 number of weights
+// and that many uint16 PoP ID, uint32 weight pairs, 41 bytes plus 6 per weight.
+// Only such rules are written as op 3, version 1 journals read unchanged.
+// Compaction writes the next generation's journal, all changes folded into a single record, under a temporary name
+// and renames it into place before removing the old generation, so a crash at any point leaves one of them complete.
+const (
+	headerSize = 8
+	changeSize = 20
+	// a change of a rule with a window
+	boundedChangeSize = changeSize + 16
+	// a change of a rule with weights or a backup, without its weights
+	targetChangeSize = boundedChangeSize + 5
+	weightSize       = 6
+	// larger records can only come from a corrupted length
+	maxPayloadSize = 1 << 26
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Log is an append-only, checksummed write-ahead journal of the changes made to a routing table.
+// It implements optimised.Journal: every change is synced to disk before the table publishes it.
+type Log struct {
+	dir string
+
+	mu         sync.Mutex
+	generation uint64
+	file       *os.File
+	// length of the intact records in the current journal file
+	size int64
+	// records in the current journal file
+	records int
+	// bytes of a torn or corrupted tail cut off when the log was opened
+	truncated int64
+}
+
+// Open restores table from the journal in dir and installs the journal on it.
+// The table is loaded from baseFile and the journaled changes are replayed on top, a delete of a rule the file
+// no longer has is skipped. A torn record at the end of the journal (crash in the middle of an append)
+// is cut off, the change it held was never published.
+func Open(dir string, table *optimised.Data, baseFile string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory '%s': %w", dir, err)
+	}
+	l := &Log{dir: dir}
+	generation, err := l.latestGeneration()
+	if err != nil {
+		return nil, err
+	}
+	l.generation = generation
+	l.removeStale()
+
+	if err := table.LoadRoutingData(baseFile); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(l.journalPath(generation), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	changes, err := l.recover(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(changes) > 0 {
+		if err := table.Replay("replay "+file.Name(), changes); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to replay journal '%s': %w", file.Name(), err)
+		}
+	}
+
+	l.file = file
+	table.SetJournal(l)
+	return l, nil
+}
+
+// read all intact records, cut off anything after the last one and leave the file positioned for appending
+func (l *Log) recover(file *os.File) ([]optimised.Change, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat journal: %w", err)
+	}
+
+	var changes []optimised.Change
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		payload, err := readRecord(reader)
+		if err != nil {
+			// io.EOF after the last record, anything else is a torn or corrupted tail
+			break
+		}
+		decoded, err := decodeChanges(payload)
+		if err != nil {
+			break
+		}
+		changes = append(changes, decoded...)
+		valid += int64(headerSize + len(payload))
+		l.records++
+	}
+
+	if valid < info.Size() {
+		l.truncated = info.Size() - valid
+		if err := file.Truncate(valid); err != nil {
+			return nil, fmt.Errorf("failed to truncate journal: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync journal: %w", err)
+		}
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek journal: %w", err)
+	}
+	l.size = valid
+	return changes, nil
+}
+
+func readRecord(reader io.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length == 0 || length > maxPayloadSize {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+func encodeRecord(changes []optimised.Change) []byte {
+	record := make([]byte, headerSize, headerSize+len(changes)*changeSize)
+	for _, change := range changes {
+		var op byte
+		target := !change.Delete && (change.Weights != nil || change.HasBackup)
+		bounded := !change.Delete && (!change.NotBefore.IsZero() || !change.NotAfter.IsZero())
+		switch {
+		case change.Delete:
+			op = 1
+		case target:
+			op = 3
+		case bounded:
+			op = 2
+		}
+		addr := change.Prefix.Addr().As16()
+		record = append(record, op)
+		record = append(record, addr[:]...)
+		record = append(record, byte(change.Prefix.Bits()))
+		record = binary.BigEndian.AppendUint16(record, change.PoP)
+		if bounded || target {
+			record = binary.BigEndian.AppendUint64(record, uint64(unixSeconds(change.NotBefore)))
+			record = binary.BigEndian.AppendUint64(record, uint64(unixSeconds(change.NotAfter)))
+		}
+		if target {
+			var hasBackup byte
+			if change.HasBackup {
+				hasBackup = 1
+			}
+			record = binary.BigEndian.AppendUint16(record, change.Backup)
+			record = append(record, hasBackup)
+			record = binary.BigEndian.AppendUint16(record, uint16(len(change.Weights)))
+			for _, w := range change.Weights {
+				record = binary.BigEndian.AppendUint16(record, w.PoP)
+				record = binary.BigEndian.AppendUint32(record, w.Weight)
+			}
+		}
+	}
+	payload := record[headerSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, castagnoli))
+	return record
+}
+
+func decodeChanges(payload []byte) ([]optimised.Change, error) {
+	changes := make([]optimised.Change, 0, len(payload)/changeSize)
+	for offset := 0; offset < len(payload); {
+		size := changeSize
+		switch payload[offset] {
+		case 2:
+			size = boundedChangeSize
+		case 3:
+			size = targetChangeSize
+			if offset+size <= len(payload) {
+				size += weightSize * int(binary.BigEndian.Uint16(payload[offset+size-2:]))
+			}
+		}
+		if offset+size > len(payload) {
+			return nil, fmt.Errorf("truncated change at offset %d", offset)
+		}
+		entry := payload[offset : offset+size]
+		if entry[0] > 3 || entry[17] > 128 || entry[0] == 3 && entry[38] > 1 {
+			return nil, fmt.Errorf("invalid change at offset %d", offset)
+		}
+		change := optimised.Change{
+			Prefix: netip.PrefixFrom(netip.AddrFrom16([16]byte(entry[1:17])), int(entry[17])),
+			PoP:    binary.BigEndian.Uint16(entry[18:20]),
+			Delete: entry[0] == 1,
+		}
+		if entry[0] >= 2 {
+			change.NotBefore = fromUnixSeconds(int64(binary.BigEndian.Uint64(entry[20:28])))
+			change.NotAfter = fromUnixSeconds(int64(binary.BigEndian.Uint64(entry[28:36])))
+		}
+		if entry[0] == 3 {
+			change.Backup = binary.BigEndian.Uint16(entry[36:38])
+			change.HasBackup = entry[38] == 1
+			for weights := entry[targetChangeSize:]; len(weights) > 0; weights = weights[weightSize:] {
+				change.Weights = append(change.Weights, optimised.Weight{
+					PoP:    binary.BigEndian.Uint16(weights[0:2]),
+					Weight: binary.BigEndian.Uint32(weights[2:6]),
+				})
+			}
+		}
+		changes = append(changes, change)
+		offset += size
+	}
+	return changes, nil
+}
+
+// a window end as stored in a change, 0 for an open end
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixSeconds(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// Append writes the changes as one record and syncs it, the record is all or nothing on replay
+func (l *Log) Append(changes []optimised.Change) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := encodeRecord(changes)
+	_, err := l.file.Write(record)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// cut off a partially written record, later records must not end up behind it
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, io.SeekStart)
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+	l.size += int64(len(record))
+	l.records++
+	return nil
+}
+
+// Reset starts the next generation with changes as its only record, then drops the old generation
+func (l *Log) Reset(changes []optimised.Change) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.generation + 1
+	var record []byte
+	if len(changes) > 0 {
+		record = encodeRecord(changes)
+	}
+	file, err := writeJournal(l.journalPath(next), record)
+	if err == nil {
+		err = syncDir(l.dir)
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		// the table is not replaced, the old generation must stay the latest one
+		os.Remove(l.journalPath(next))
+		return fmt.Errorf("failed to start journal generation %d: %w", next, err)
+	}
+
+	// the new generation is complete, the old one is garbage from here on
+	l.file.Close()
+	os.Remove(l.journalPath(l.generation))
+	l.file, l.generation, l.size, l.records = file, next, int64(len(record)), min(len(record), 1)
+	return nil
+}
+
+// Records returns the number of records in the journal, a compaction folds them into one
+func (l *Log) Records() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records
+}
+
+// Truncated returns how many bytes of a torn or corrupted tail were cut off when the journal was opened
+func (l *Log) Truncated() int64 {
+	return l.truncated
+}
+
+// Close closes the journal file, the table must not be changed afterwards
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *Log) journalPath(generation uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("journal-%d.log", generation))
+}
+
+// the generation of the newest journal, 0 if there is none
+func (l *Log) latestGeneration() (uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read journal directory '%s': %w", l.dir, err)
+	}
+	var latest uint64
+	for _, entry := range entries {
+		if generation, ok := parseGeneration(entry.Name(), "journal-", ".log"); ok {
+			latest = max(latest, generation)
+		}
+	}
+	return latest, nil
+}
+
+// remove files of older generations and temporary files left behind by an interrupted compaction
+func (l *Log) removeStale() {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		journal, isJournal := parseGeneration(name, "journal-", ".log")
+		if strings.Contains(name, ".tmp") || (isJournal && journal != l.generation) {
+			os.Remove(filepath.Join(l.dir, name))
+		}
+	}
+}
+
+func parseGeneration(name, prefix, suffix string) (uint64, bool) {
+	number, found := strings.CutPrefix(name, prefix)
+	if !found {
+		return 0, false
+	}
+	number, found = strings.CutSuffix(number, suffix)
+	if !found {
+		return 0, false
+	}
+	generation, err := strconv.ParseUint(number, 10, 64)
+	return generation, err == nil
+}
+
+// write a journal holding record under a temporary name, rename it into place once it is synced
+// and return it opened for appending
+func writeJournal(filename string, record []byte) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal: %w", err)
+	}
+	if _, err := tmp.Write(record); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to sync journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to rename journal: %w", err)
+	}
+	return tmp, nil
+}
+
+// make renames and newly created files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open journal directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package journal
+
+import (
+	"CDN77-DNS/optimised"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const baseRules = "2001:db8::/32 100\n2001:db9::/32 200\n"
+
+func writeFile(t *testing.T, filePath, content string) {
+	t.Helper()
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write '%s': %v", filePath, err)
+	}
+}
+
+func rules(data *optimised.Data) []string {
+	var rules []string
+	for prefix, target := range data.Targets() {
+		rules = append(rules, fmt.Sprintf("%s %s", prefix, target))
+	}
+	return rules
+}
+
+func open(t *testing.T, dir, baseFile string) (*optimised.Data, *Log) {
+	t.Helper()
+	data := optimised.NewData()
+	l, err := Open(dir, data, baseFile)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return data, l
+}
+
+// changes made through every kind of change, returns the rules after each of them
+func makeChanges(t *testing.T, data *optimised.Data) [][]string {
+	t.Helper()
+	states := [][]string{rules(data)}
+	step := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("change failed: %v", err)
+		}
+		states = append(states, rules(data))
+	}
+	step(data.Insert(netip.MustParsePrefix("2001:db8:aaaa::/48"), 100))
+	step(data.Update(netip.MustParsePrefix("2001:db9::/32"), 201))
+	step(data.Delete(netip.MustParsePrefix("2001:db8:aaaa::/48")))
+	tx := data.Begin()
+	tx.Insert(netip.MustParsePrefix("2001:db8::/32"), 300)
+	tx.Insert(netip.MustParsePrefix("2001:db8:bbbb::/48"), 300)
+	tx.Delete(netip.MustParsePrefix("2001:db9::/32"))
+	// a rule with a window takes the longer change encoding
+	start := time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)
+	tx.InsertBounded(netip.MustParsePrefix("2001:dbc::/32"), 500, start, start.Add(24*time.Hour))
+	step(tx.Commit())
+	return states
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "routing.txt")
+	writeFile(t, baseFile, baseRules)
+	journalDir := filepath.Join(dir, "journal")
+
+	data, l := open(t, journalDir, baseFile)
+	states := makeChanges(t, data)
+	// rejected changes are not journaled
+	if err := data.Insert(netip.MustParsePrefix("2001:db8:cccc::/48"), 1); err == nil {
+		t.Fatal("expected conflicting insert to fail")
+	}
+	if l.Records() != 4 {
+		t.Errorf("expected 4 records, got %d", l.Records())
+	}
+	l.Close()
+
+	restored, _ := open(t, journalDir, baseFile)
+	if got, want := rules(restored), states[len(states)-1]; !slices.Equal(got, want) {
+		t.Errorf("restored table:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "routing.txt")
+	writeFile(t, baseFile, baseRules)
+	journalDir := filepath.Join(dir, "journal")
+
+	data, l := open(t, journalDir, baseFile)
+	makeChanges(t, data)
+	if err := data.CompactJournal(); err != nil {
+		t.Fatalf("CompactJournal failed: %v", err)
+	}
+	if l.Records() != 1 {
+		t.Errorf("expected the changes folded into 1 record, got %d records", l.Records())
+	}
+	if err := data.Insert(netip.MustParsePrefix("2001:dba::/32"), 400); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	want := rules(data)
+	l.Close()
+
+	entries, err := os.ReadDir(journalDir)
+	if err != nil {
+		t.Fatalf("Failed to list journal dir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{"journal-1.log"}) {
+		t.Errorf("expected only generation 1 files, got %v", names)
+	}
+
+	restored, l := open(t, journalDir, baseFile)
+	if got := rules(restored); !slices.Equal(got, want) {
+		t.Errorf("restored table:\ngot  %v\nwant %v", got, want)
+	}
+	l.Close()
+
+	// the base file is read on every start, the changes apply on top of its new rules
+	// (2001:db9::/32 was deleted through the journal and is gone from the file as well)
+	writeFile(t, baseFile, "2001:db8::/32 100\n2001:dbb::/32 1\n")
+	restored, _ = open(t, journalDir, baseFile)
+	want = append(want, "2001:dbb::/32 1")
+	slices.Sort(want)
+	if got := rules(restored); !slices.Equal(got, want) {
+		t.Errorf("restored table after editing the base file:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "routing.txt")
+	writeFile(t, baseFile, baseRules)
+	journalDir := filepath.Join(dir, "journal")
+
+	data, l := open(t, journalDir, baseFile)
+	if err := data.Insert(netip.MustParsePrefix("2001:db8:aaaa::/48"), 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := data.Update(netip.MustParsePrefix("2001:db9::/32"), 201); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// the reload keeps the changes made through the API on top of the edited file
+	writeFile(t, baseFile, baseRules+"2001:dbb::/32 1\n")
+	if err := data.ReloadRoutingData(baseFile); err != nil {
+		t.Fatalf("ReloadRoutingData failed: %v", err)
+	}
+	want := []string{"2001:db8::/32 100", "2001:db8:aaaa::/48 100", "2001:db9::/32 201", "2001:dbb::/32 1"}
+	if got := rules(data); !slices.Equal(got, want) {
+		t.Errorf("reloaded table:\ngot  %v\nwant %v", got, want)
+	}
+
+	// a file the changes conflict with is not loaded
+	writeFile(t, baseFile, "2001:db8::/32 300\n")
+	if err := data.ReloadRoutingData(baseFile); err == nil {
+		t.Error("expected a reload conflicting with the journaled changes to fail")
+	}
+	if got := rules(data); !slices.Equal(got, want) {
+		t.Errorf("failed reload changed the table: %v", got)
+	}
+	l.Close()
+
+	writeFile(t, baseFile, baseRules+"2001:dbb::/32 1\n")
+	restored, _ := open(t, journalDir, baseFile)
+	if got := rules(restored); !slices.Equal(got, want) {
+		t.Errorf("restored table:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+// rules with weights or a backup reach the journal through a rollback or reload and keep them on replay
+func TestRoutingDataTargets(t *testing.T) {
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "routing.txt")
+	writeFile(t, baseFile, baseRules+"2001:dba::/32 1:70,2:30\n2001:dbb::/32 1 backup=5\n2001:dbc::/32 3:1,4:1 backup=6 not-after=2030-03-01T00:00:00Z\n")
+	journalDir := filepath.Join(dir, "journal")
+
+	data, l := open(t, journalDir, baseFile)
+	want := rules(data)
+	serial := data.Serial()
+	writeFile(t, baseFile, baseRules)
+	if err := data.ReloadRoutingData(baseFile); err != nil {
+		t.Fatalf("ReloadRoutingData failed: %v", err)
+	}
+	if err := data.Rollback(serial); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	l.Close()
+
+	restored, _ := open(t, journalDir, baseFile)
+	if got := rules(restored); !slices.Equal(got, want) {
+		t.Errorf("restored table:\ngot  %v\nwant %v", got, want)
+	}
+
+	// every change form decodes to what was encoded
+	changes := []optimised.Change{
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), PoP: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), Delete: true},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), PoP: 1, NotAfter: time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), PoP: 1, Weights: []optimised.Weight{{PoP: 1, Weight: 70}, {PoP: 2, Weight: 30}}},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), PoP: 1, Backup: 5, HasBackup: true,
+			NotBefore: time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	decoded, err := decodeChanges(encodeRecord(changes)[headerSize:])
+	if err != nil {
+		t.Fatalf("decodeChanges failed: %v", err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(changes) {
+		t.Errorf("decoded changes:\ngot  %v\nwant %v", decoded, changes)
+	}
+}
+
+// a crash can cut the journal off at any byte, replay must then restore exactly the changes whose records are complete
+func TestTruncatedJournal(t *testing.T) {
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "routing.txt")
+	writeFile(t, baseFile, baseRules)
+
+	data, l := open(t, filepath.Join(dir, "journal"), baseFile)
+	states := makeChanges(t, data)
+	l.Close()
+	full, err := os.ReadFile(filepath.Join(dir, "journal", "journal-0.log"))
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	// end offset of every record
+	var ends []int64
+	reader := bytes.NewReader(full)
+	for {
+		payload, err := readRecord(reader)
+		if err != nil {
+			break
+		}
+		end := int64(headerSize + len(payload))
+		if len(ends) > 0 {
+			end += ends[len(ends)-1]
+		}
+		ends = append(ends, end)
+	}
+	if len(ends) != len(states)-1 || ends[len(ends)-1] != int64(len(full)) {
+		t.Fatalf("expected %d records covering the file, got ends %v of %d bytes", len(states)-1, ends, len(full))
+	}
+
+	for offset := 0; offset <= len(full); offset++ {
+		complete := 0
+		for complete < len(ends) && ends[complete] <= int64(offset) {
+			complete++
+		}
+		journalDir := filepath.Join(dir, fmt.Sprintf("cut-%d", offset))
+		if err := os.Mkdir(journalDir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeFile(t, filepath.Join(journalDir, "journal-0.log"), string(full[:offset]))
+
+		restored, l := open(t, journalDir, baseFile)
+		if got := rules(restored); !slices.Equal(got, states[complete]) {
+			t.Fatalf("cut at %d: got %v, want state after %d changes %v", offset, got, complete, states[complete])
+		}
+		// the torn tail is gone, appending continues right after the last complete record
+		var wantSize int64
+		if complete > 0 {
+			wantSize = ends[complete-1]
+		}
+		if l.size != wantSize || l.Truncated() != int64(offset)-wantSize {
+			t.Fatalf("cut at %d: size %d truncated %d, want size %d", offset, l.size, l.Truncated(), wantSize)
+		}
+	}
+
+	t.Run("Corrupted", func(t *testing.T) {
+		journalDir := filepath.Join(dir, "corrupted")
+		if err := os.Mkdir(journalDir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		corrupted := slices.Clone(full)
+		corrupted[len(corrupted)-1] ^= 0xff
+		writeFile(t, filepath.Join(journalDir, "journal-0.log"), string(corrupted))
+
+		restored, _ := open(t, journalDir, baseFile)
+		if got, want := rules(restored), states[len(states)-2]; !slices.Equal(got, want) {
+			t.Errorf("record with a bad checksum must be dropped:\ngot  %v\nwant %v", got, want)
+		}
+	})
+}
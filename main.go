@@ -5,9 +5,18 @@ import (
 	"CDN77-DNS/optimised"
 	"fmt"
 	"net"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	nd := naive.Data{}
 	err := nd.LoadRoutingData("routing-data.txt")
 	if err != nil {
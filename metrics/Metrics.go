@@ -0,0 +1,277 @@
+package metrics
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the lookup latency histogram buckets in seconds, a trie lookup takes well under a microsecond
+var lookupBuckets = [...]float64{0.0000001, 0.00000025, 0.0000005, 0.000001, 0.0000025, 0.000005, 0.00001, 0.000025, 0.0001, 0.001}
+
+// Collector gathers routing metrics through the optimised.Observer hook and serves them in Prometheus text format
+type Collector struct {
+	// sorted by name
+	tables []*tableMetrics
+}
+
+// tableMetrics are the metrics of one table, installed as its observer
+type tableMetrics struct {
+	table *optimised.Data
+	// value of the table label, empty for the single table of New
+	name string
+
+	lookupsMatched   atomic.Uint64
+	lookupsUnmatched atomic.Uint64
+	// PoP ID -> *atomic.Uint64, sync.Map keeps the lookup path lock free once a PoP has been seen
+	lookupsByPoP sync.Map
+
+	// cumulative bucket counts are computed on scrape, each lookup increments only its own bucket
+	latencyBuckets [len(lookupBuckets) + 1]atomic.Uint64 // last one is the +Inf bucket
+	latencySumNs   atomic.Uint64
+
+	conflicts atomic.Uint64
+
+	// trie stats of the version with statsSerial, a scrape only walks the trie again once it has changed
+	statsMu     sync.Mutex
+	stats       optimised.Stats
+	statsSerial uint64
+	statsValid  bool
+
+	loadsMu sync.Mutex
+	loads   map[loadKey]uint64
+	// duration of the last load and reload
+	lastLoadDuration map[string]time.Duration
+}
+
+type loadKey struct {
+	kind    string
+	success bool
+}
+
+// New creates a collector for table and installs it as the table's observer
+func New(table *optimised.Data) *Collector {
+	c := &Collector{}
+	c.add("", table)
+	return c
+}
+
+// NewTables creates a collector for the tables by name and installs it as the observer of each of them,
+// every metric is labeled with the table's name
+func NewTables(tables map[string]*optimised.Data) *Collector {
+	c := &Collector{}
+	for _, name := range slices.Sorted(maps.Keys(tables)) {
+		c.add(name, tables[name])
+	}
+	return c
+}
+
+// AddTable adds the table called name to a collector of NewTables and installs it as the table's observer.
+// Add tables before their routing data is loaded to record the initial load, and before serving the metrics.
+func (c *Collector) AddTable(name string, table *optimised.Data) {
+	c.add(name, table)
+	slices.SortFunc(c.tables, func(a, b *tableMetrics) int { return strings.Compare(a.name, b.name) })
+}
+
+func (c *Collector) add(name string, table *optimised.Data) {
+	t := &tableMetrics{
+		table:            table,
+		name:             name,
+		loads:            map[loadKey]uint64{},
+		lastLoadDuration: map[string]time.Duration{},
+	}
+	table.SetObserver(t)
+	c.tables = append(c.tables, t)
+}
+
+func (t *tableMetrics) ObserveRoute(pop uint16, matched bool, duration time.Duration) {
+	if !matched {
+		t.lookupsUnmatched.Add(1)
+	} else {
+		t.lookupsMatched.Add(1)
+		counter, ok := t.lookupsByPoP.Load(pop)
+		if !ok {
+			counter, _ = t.lookupsByPoP.LoadOrStore(pop, new(atomic.Uint64))
+		}
+		counter.(*atomic.Uint64).Add(1)
+	}
+
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(lookupBuckets[:], seconds)
+	t.latencyBuckets[bucket].Add(1)
+	t.latencySumNs.Add(uint64(duration.Nanoseconds()))
+}
+
+func (t *tableMetrics) ObserveLoad(reload bool, duration time.Duration, err error) {
+	kind := "load"
+	if reload {
+		kind = "reload"
+	}
+	t.loadsMu.Lock()
+	defer t.loadsMu.Unlock()
+	t.loads[loadKey{kind: kind, success: err == nil}]++
+	t.lastLoadDuration[kind] = duration
+}
+
+func (t *tableMetrics) ObserveConflict(err error) {
+	t.conflicts.Add(1)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	c.writeLookups(bw)
+	c.writeTables(bw)
+	c.writeLoads(bw)
+	writeHeader(bw, "routing_conflicts_total", "counter", "Rules rejected because they conflict with an existing rule.")
+	for _, t := range c.tables {
+		fmt.Fprintf(bw, "routing_conflicts_total%s %d\n", t.labels(), t.conflicts.Load())
+	}
+	bw.Flush()
+}
+
+func (c *Collector) writeLookups(w *bufio.Writer) {
+	writeHeader(w, "routing_lookups_total", "counter", "Route lookups by result.")
+	for _, t := range c.tables {
+		fmt.Fprintf(w, "routing_lookups_total%s %d\n", t.labels("result", "matched"), t.lookupsMatched.Load())
+		fmt.Fprintf(w, "routing_lookups_total%s %d\n", t.labels("result", "unmatched"), t.lookupsUnmatched.Load())
+	}
+
+	writeHeader(w, "routing_lookups_by_pop_total", "counter", "Matched Route lookups by returned PoP.")
+	for _, t := range c.tables {
+		var pops []uint16
+		t.lookupsByPoP.Range(func(key, value any) bool {
+			pops = append(pops, key.(uint16))
+			return true
+		})
+		sort.Slice(pops, func(i, j int) bool { return pops[i] < pops[j] })
+		for _, pop := range pops {
+			counter, _ := t.lookupsByPoP.Load(pop)
+			fmt.Fprintf(w, "routing_lookups_by_pop_total%s %d\n", t.labels("pop", strconv.Itoa(int(pop))), counter.(*atomic.Uint64).Load())
+		}
+	}
+
+	writeHeader(w, "routing_lookup_duration_seconds", "histogram", "Route lookup latency.")
+	for _, t := range c.tables {
+		var cumulative uint64
+		for i, bound := range lookupBuckets {
+			cumulative += t.latencyBuckets[i].Load()
+			fmt.Fprintf(w, "routing_lookup_duration_seconds_bucket%s %d\n", t.labels("le", formatFloat(bound)), cumulative)
+		}
+		cumulative += t.latencyBuckets[len(lookupBuckets)].Load()
+		fmt.Fprintf(w, "routing_lookup_duration_seconds_bucket%s %d\n", t.labels("le", "+Inf"), cumulative)
+		fmt.Fprintf(w, "routing_lookup_duration_seconds_sum%s %s\n", t.labels(), formatFloat(float64(t.latencySumNs.Load())/1e9))
+		fmt.Fprintf(w, "routing_lookup_duration_seconds_count%s %d\n", t.labels(), cumulative)
+	}
+}
+
+func (c *Collector) writeTables(w *bufio.Writer) {
+	stats := make([]optimised.Stats, len(c.tables))
+	for i, t := range c.tables {
+		stats[i] = t.tableStats()
+	}
+	writeHeader(w, "routing_table_rules", "gauge", "Rules in the routing table.")
+	for i, t := range c.tables {
+		fmt.Fprintf(w, "routing_table_rules%s %d\n", t.labels(), stats[i].Rules)
+	}
+	writeHeader(w, "routing_table_nodes", "gauge", "Nodes in the routing trie.")
+	for i, t := range c.tables {
+		fmt.Fprintf(w, "routing_table_nodes%s %d\n", t.labels(), stats[i].Nodes)
+	}
+	writeHeader(w, "routing_table_compressible_nodes", "gauge", "Trie nodes with no rule and a single child.")
+	for i, t := range c.tables {
+		fmt.Fprintf(w, "routing_table_compressible_nodes%s %d\n", t.labels(), stats[i].CompressibleNodes)
+	}
+	writeHeader(w, "routing_table_estimated_bytes", "gauge", "Estimated memory used by the routing trie.")
+	for i, t := range c.tables {
+		fmt.Fprintf(w, "routing_table_estimated_bytes%s %d\n", t.labels(), stats[i].EstimatedBytes)
+	}
+	writeHeader(w, "routing_table_nodes_by_depth", "gauge", "Nodes in the routing trie by depth, depths without nodes are left out.")
+	for i, t := range c.tables {
+		for depth, nodes := range stats[i].DepthHistogram {
+			if nodes > 0 {
+				fmt.Fprintf(w, "routing_table_nodes_by_depth%s %d\n", t.labels("depth", strconv.Itoa(depth)), nodes)
+			}
+		}
+	}
+	writeHeader(w, "routing_table_rules_by_prefix_length", "gauge", "Rules in the routing table by prefix length, lengths without rules are left out.")
+	for i, t := range c.tables {
+		for bits, rules := range stats[i].PrefixLenHistogram {
+			if rules > 0 {
+				fmt.Fprintf(w, "routing_table_rules_by_prefix_length%s %d\n", t.labels("prefix_length", strconv.Itoa(bits)), rules)
+			}
+		}
+	}
+	writeHeader(w, "routing_table_serial", "gauge", "Serial of the routing table version being served.")
+	for _, t := range c.tables {
+		fmt.Fprintf(w, "routing_table_serial%s %d\n", t.labels(), t.table.Serial())
+	}
+}
+
+// the stats of the served table, computed once per version: the serial is read before the walk,
+// so stats of a newer version are only cached until the next scrape sees its serial
+func (t *tableMetrics) tableStats() optimised.Stats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	serial := t.table.Serial()
+	if !t.statsValid || t.statsSerial != serial {
+		t.stats, t.statsSerial, t.statsValid = t.table.Stats(), serial, true
+	}
+	return t.stats
+}
+
+func (c *Collector) writeLoads(w *bufio.Writer) {
+	for _, t := range c.tables {
+		t.loadsMu.Lock()
+		defer t.loadsMu.Unlock()
+	}
+
+	writeHeader(w, "routing_table_loads_total", "counter", "Routing data loads and reloads by result.")
+	for _, t := range c.tables {
+		for _, kind := range []string{"load", "reload"} {
+			fmt.Fprintf(w, "routing_table_loads_total%s %d\n", t.labels("kind", kind, "result", "success"), t.loads[loadKey{kind: kind, success: true}])
+			fmt.Fprintf(w, "routing_table_loads_total%s %d\n", t.labels("kind", kind, "result", "failure"), t.loads[loadKey{kind: kind, success: false}])
+		}
+	}
+	writeHeader(w, "routing_table_load_duration_seconds", "gauge", "Duration of the last routing data load or reload.")
+	for _, t := range c.tables {
+		for _, kind := range []string{"load", "reload"} {
+			if duration, ok := t.lastLoadDuration[kind]; ok {
+				fmt.Fprintf(w, "routing_table_load_duration_seconds%s %s\n", t.labels("kind", kind), formatFloat(duration.Seconds()))
+			}
+		}
+	}
+}
+
+// the label set of a sample from name value pairs, led by the table label when the table has a name
+func (t *tableMetrics) labels(pairs ...string) string {
+	var labels []string
+	if t.name != "" {
+		labels = append(labels, fmt.Sprintf("table=%q", t.name))
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func writeHeader(w *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"CDN77-DNS/optimised"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRoutingFile(t *testing.T, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "routing.txt")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	return filePath
+}
+
+func route(t *testing.T, data *optimised.Data, cidr string) {
+	t.Helper()
+	_, ecs, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse '%s': %v", cidr, err)
+	}
+	data.Route(ecs)
+}
+
+func scrape(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape returned status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read scrape body: %v", err)
+	}
+	return string(body)
+}
+
+func TestCollector(t *testing.T) {
+	data := optimised.NewData()
+	collector := New(data)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", collector)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if err := data.LoadRoutingData(writeRoutingFile(t, "2001:db8::/32 100\n2001:db8:aaaa::/48 100\n2001:db9::/32 200\n")); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	// conflicting file -> failed reload, old table stays
+	if err := data.ReloadRoutingData(writeRoutingFile(t, "2001:db8::/32 100\n2001:db8:aaaa::/48 300\n")); err == nil {
+		t.Fatal("expected conflicting reload to fail")
+	}
+
+	route(t, data, "2001:db8:aaaa::/64")
+	route(t, data, "2001:db8:bbbb::/64")
+	route(t, data, "2001:db9::/64")
+	route(t, data, "2002::/64")
+
+	body := scrape(t, server)
+	for _, want := range []string{
+		"# TYPE routing_lookups_total counter",
+		`routing_lookups_total{result="matched"} 3`,
+		`routing_lookups_total{result="unmatched"} 1`,
+		`routing_lookups_by_pop_total{pop="100"} 2`,
+		`routing_lookups_by_pop_total{pop="200"} 1`,
+		"# TYPE routing_lookup_duration_seconds histogram",
+		`routing_lookup_duration_seconds_bucket{le="+Inf"} 4`,
+		"routing_lookup_duration_seconds_count 4",
+		"routing_table_rules 3",
+		"routing_table_nodes ",
+		`routing_table_nodes_by_depth{depth="0"} 1`,
+		`routing_table_rules_by_prefix_length{prefix_length="32"} 2`,
+		`routing_table_rules_by_prefix_length{prefix_length="48"} 1`,
+		"routing_table_serial 2",
+		`routing_table_loads_total{kind="load",result="success"} 1`,
+		`routing_table_loads_total{kind="reload",result="failure"} 1`,
+		`routing_table_load_duration_seconds{kind="load"} `,
+		"routing_conflicts_total 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape is missing %q:\n%s", want, body)
+		}
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		if err := data.ReloadRoutingData(writeRoutingFile(t, "2001:dba::/32 300\n")); err != nil {
+			t.Fatalf("ReloadRoutingData failed: %v", err)
+		}
+		body := scrape(t, server)
+		for _, want := range []string{
+			"routing_table_rules 1",
+			"routing_table_serial 3",
+			`routing_table_loads_total{kind="reload",result="success"} 1`,
+			`routing_table_load_duration_seconds{kind="reload"} `,
+			`routing_table_rules_by_prefix_length{prefix_length="32"} 1`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("scrape is missing %q:\n%s", want, body)
+			}
+		}
+		// the stats cached for the previous serial are not served again
+		if strings.Contains(body, `prefix_length="48"`) {
+			t.Errorf("scrape still has the rules of the previous version:\n%s", body)
+		}
+	})
+}
+
+func TestTables(t *testing.T) {
+	video, static := optimised.NewData(), optimised.NewData()
+	collector := NewTables(map[string]*optimised.Data{"video": video})
+	// added later, before its load
+	collector.AddTable("static", static)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", collector)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if err := video.LoadRoutingData(writeRoutingFile(t, "2001:db8::/32 100\n2001:db9::/32 200\n")); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	if err := static.LoadRoutingData(writeRoutingFile(t, "::/0 1\n")); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	route(t, video, "2001:db8::/64")
+	route(t, video, "2002::/64")
+	route(t, static, "2001:db8::/64")
+
+	body := scrape(t, server)
+	for _, want := range []string{
+		`routing_lookups_total{table="static",result="matched"} 1`,
+		`routing_lookups_total{table="video",result="matched"} 1`,
+		`routing_lookups_total{table="video",result="unmatched"} 1`,
+		`routing_lookups_by_pop_total{table="static",pop="1"} 1`,
+		`routing_lookup_duration_seconds_bucket{table="video",le="+Inf"} 2`,
+		`routing_lookup_duration_seconds_count{table="video"} 2`,
+		`routing_table_rules{table="static"} 1`,
+		`routing_table_rules{table="video"} 2`,
+		`routing_table_loads_total{table="video",kind="load",result="success"} 1`,
+		`routing_table_loads_total{table="static",kind="load",result="success"} 1`,
+		`routing_conflicts_total{table="static"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape is missing %q:\n%s", want, body)
+		}
+	}
+	// every metric family is described once
+	if n := strings.Count(body, "# TYPE routing_table_rules "); n != 1 {
+		t.Errorf("routing_table_rules described %d times", n)
+	}
+	// tables are listed by name whatever order they were added in
+	if strings.Index(body, `routing_table_rules{table="static"}`) > strings.Index(body, `routing_table_rules{table="video"}`) {
+		t.Errorf("tables not sorted by name:\n%s", body)
+	}
+}
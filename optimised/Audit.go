@@ -0,0 +1,158 @@
+package optimised
+
+import (
+	"net/netip"
+	"time"
+)
+
+// SystemActor is the actor of changes not made through As, e.g. reloads of the routing data file
+const SystemActor = "system"
+
+// AuditRecord describes how one rule changed in a published table
+type AuditRecord struct {
+	Time  time.Time
+	Actor string
+	// description of the published change as in the version history
+	Source string
+	// version published by the change
+	Serial uint64
+	Prefix netip.Prefix
+	// target of the rule before and after the change, nil when there was or is no rule for Prefix
+	Before *Target
+	After  *Target
+}
+
+// Auditor receives a record for every rule changed by a published change (load, reload, API change, rollback).
+// Audit is called in order while changes are serialised, so it should not block for long.
+type Auditor interface {
+	Audit(record AuditRecord)
+}
+
+// SetAuditor installs the audit hook, nil removes it. Set it before the table is shared between goroutines.
+func (data *Data) SetAuditor(auditor Auditor) {
+	data.auditor = auditor
+}
+
+// Actor makes changes attributed to a named actor in the audit trail
+type Actor struct {
+	data *Data
+	name string
+}
+
+// As returns a handle making changes to the table on behalf of actor
+func (data *Data) As(actor string) *Actor {
+	return &Actor{data: data, name: actor}
+}
+
+// Insert is Data.Insert made by the actor
+func (a *Actor) Insert(prefix netip.Prefix, popID uint16) error {
+	return a.InsertBounded(prefix, popID, time.Time{}, time.Time{})
+}
+
+// Update is Data.Update made by the actor
+func (a *Actor) Update(prefix netip.Prefix, popID uint16) error {
+	return a.UpdateBounded(prefix, popID, time.Time{}, time.Time{})
+}
+
+// InsertBounded is Data.InsertBounded made by the actor
+func (a *Actor) InsertBounded(prefix netip.Prefix, popID uint16, notBefore, notAfter time.Time) error {
+	change := Change{Prefix: prefix, PoP: popID, NotBefore: notBefore, NotAfter: notAfter}
+	return a.data.change(a.name, "insert", change, func(m *mutation, prefix netip.Prefix) error {
+		target, err := change.target()
+		if err != nil {
+			return err
+		}
+		if err := m.checkRoutingDataTarget(prefix, target); err != nil {
+			return err
+		}
+		return m.insert(prefix, target, false)
+	})
+}
+
+// UpdateBounded is Data.UpdateBounded made by the actor
+func (a *Actor) UpdateBounded(prefix netip.Prefix, popID uint16, notBefore, notAfter time.Time) error {
+	change := Change{Prefix: prefix, PoP: popID, NotBefore: notBefore, NotAfter: notAfter}
+	return a.data.change(a.name, "update", change, func(m *mutation, prefix netip.Prefix) error {
+		target, err := change.target()
+		if err != nil {
+			return err
+		}
+		if err := m.checkRoutingDataTarget(prefix, target); err != nil {
+			return err
+		}
+		return m.insert(prefix, target, true)
+	})
+}
+
+// Delete is Data.Delete made by the actor
+func (a *Actor) Delete(prefix netip.Prefix) error {
+	return a.data.change(a.name, "delete", Change{Prefix: prefix, Delete: true}, func(m *mutation, prefix netip.Prefix) error {
+		return m.remove(prefix)
+	})
+}
+
+// Begin is Data.Begin for a transaction made by the actor
+func (a *Actor) Begin() *Tx {
+	return &Tx{data: a.data, actor: a.name}
+}
+
+// Rollback is Data.Rollback made by the actor
+func (a *Actor) Rollback(serial uint64) error {
+	return a.data.rollback(a.name, serial)
+}
+
+// ReloadRoutingData is Data.ReloadRoutingData made by the actor
+func (a *Actor) ReloadRoutingData(filename string) error {
+	return a.data.load(a.name, filename, true)
+}
+
+// report every rule that differs between the previously published trie and the new one,
+// must be called while holding writeMu right after the new trie was published
+func (data *Data) audit(previous, current *TrieNode, actor, source string) {
+	if data.auditor == nil {
+		return
+	}
+	record := AuditRecord{Time: time.Now(), Actor: actor, Source: source, Serial: data.serial.Load()}
+	var path [16]byte
+	diffRules(previous, current, &path, 0, func(prefix netip.Prefix, before, after *RuleInfo) {
+		record.Prefix, record.Before, record.After = prefix, nil, nil
+		if before != nil {
+			target := before.target
+			record.Before = &target
+		}
+		if after != nil {
+			target := after.target
+			record.After = &target
+		}
+		data.auditor.Audit(record)
+	})
+}
+
+// walk two tries in lockstep and call fn for every prefix whose rule differs,
+// subtrees shared by both (everything copy-on-write did not touch) are skipped
+func diffRules(before, after *TrieNode, path *[16]byte, depth int, fn func(prefix netip.Prefix, before, after *RuleInfo)) {
+	if before == after {
+		return
+	}
+	var beforeRule, afterRule *RuleInfo
+	var beforeChildren, afterChildren [2]*TrieNode
+	if before != nil {
+		beforeRule, beforeChildren = before.ruleInfo, before.children
+	}
+	if after != nil {
+		afterRule, afterChildren = after.ruleInfo, after.children
+	}
+	if (beforeRule == nil) != (afterRule == nil) || (beforeRule != nil && beforeRule.target != afterRule.target) {
+		fn(pathPrefix(path, depth), beforeRule, afterRule)
+	}
+	if depth >= 128 {
+		return
+	}
+
+	byteIndex := depth / 8
+	bitMask := byte(1) << (7 - depth%8)
+	diffRules(beforeChildren[0], afterChildren[0], path, depth+1, fn)
+	path[byteIndex] |= bitMask
+	diffRules(beforeChildren[1], afterChildren[1], path, depth+1, fn)
+	path[byteIndex] &^= bitMask
+}
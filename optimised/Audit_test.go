@@ -0,0 +1,82 @@
+package optimised
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type recordingAuditor struct {
+	records []string
+}
+
+func (a *recordingAuditor) Audit(record AuditRecord) {
+	format := func(target *Target) string {
+		if target == nil {
+			return "-"
+		}
+		return target.String()
+	}
+	a.records = append(a.records, fmt.Sprintf("%d %s %s: %s %s -> %s",
+		record.Serial, record.Actor, record.Source, record.Prefix, format(record.Before), format(record.After)))
+}
+
+func TestAudit(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	checkInsert(t, data, "2001:db9::/32", 200, "")
+	auditor := &recordingAuditor{}
+	data.SetAuditor(auditor)
+	before := data.Serial()
+
+	alice := data.As("alice")
+	if err := alice.Insert(netip.MustParsePrefix("2001:db8:aaaa::/48"), 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := alice.Update(netip.MustParsePrefix("2001:db9::/32"), 201); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	// rejected changes leave no trace
+	if err := alice.Insert(netip.MustParsePrefix("2001:db8:bbbb::/48"), 300); err == nil {
+		t.Fatal("expected conflicting insert to fail")
+	}
+	tx := data.As("bob").Begin()
+	tx.Insert(netip.MustParsePrefix("2001:db8::/32"), 300)
+	tx.Insert(netip.MustParsePrefix("2001:db8:aaaa::/48"), 300)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := data.Delete(netip.MustParsePrefix("2001:db8:aaaa::/48")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := data.As("carol").Rollback(before); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "routing.txt")
+	if err := os.WriteFile(filePath, []byte("2001:db8::/32 100\n2001:dba::/32 400\n"), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	if err := data.ReloadRoutingData(filePath); err != nil {
+		t.Fatalf("ReloadRoutingData failed: %v", err)
+	}
+
+	want := []string{
+		"4 alice insert 2001:db8:aaaa::/48 100: 2001:db8:aaaa::/48 - -> 100",
+		"5 alice update 2001:db9::/32 201: 2001:db9::/32 200 -> 201",
+		"6 bob transaction of 2 changes: 2001:db8::/32 100 -> 300",
+		"6 bob transaction of 2 changes: 2001:db8:aaaa::/48 100 -> 300",
+		"7 system delete 2001:db8:aaaa::/48: 2001:db8:aaaa::/48 300 -> -",
+		"8 carol rollback to serial 3: 2001:db8::/32 300 -> 100",
+		"8 carol rollback to serial 3: 2001:db9::/32 201 -> 200",
+		// unchanged rules of a reload are not reported
+		"9 system reload " + filePath + ": 2001:db9::/32 200 -> -",
+		"9 system reload " + filePath + ": 2001:dba::/32 - -> 400",
+	}
+	if !slices.Equal(auditor.records, want) {
+		t.Errorf("audit records:\ngot  %q\nwant %q", auditor.records, want)
+	}
+}
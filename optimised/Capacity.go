@@ -0,0 +1,221 @@
+package optimised
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Capacity is the load a PoP can take and where its traffic goes beyond that: while the reported load
+// is over Limit, the Spill fraction of the subnets its rules match is answered by one of the Overflow PoPs.
+// Subnets are picked by a hash of the ECS subnet, so the same subnets spill every time and resolvers keep
+// their cached answers, the overflow PoP of a subnet is picked by the hash as well.
+type Capacity struct {
+	PoP uint16
+	// in the unit of the load reports, eg. Gbit/s or requests per second
+	Limit float64
+	// fraction of the PoP's subnets moved while it is over its limit, in [0, 1]
+	Spill    float64
+	Overflow []uint16
+}
+
+func (c Capacity) validate() error {
+	switch {
+	case c.Limit <= 0:
+		return fmt.Errorf("capacity limit of PoP %d must be positive", c.PoP)
+	case c.Spill < 0 || c.Spill > 1:
+		return fmt.Errorf("spill fraction of PoP %d must be between 0 and 1, got %g", c.PoP, c.Spill)
+	case len(c.Overflow) == 0:
+		return fmt.Errorf("PoP %d needs at least one overflow PoP", c.PoP)
+	case slices.Contains(c.Overflow, c.PoP):
+		return fmt.Errorf("PoP %d can not overflow to itself", c.PoP)
+	}
+	return nil
+}
+
+// SetCapacity sets the capacity of c.PoP, replacing any previous one
+func (h *Health) SetCapacity(c Capacity) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	c.Overflow = slices.Clone(c.Overflow)
+	h.update(func(next *healthState) {
+		next.capacity = maps.Clone(next.capacity)
+		next.capacity[c.PoP] = c
+	})
+	return nil
+}
+
+// RemoveCapacity drops the capacity of popID, it no longer spills whatever its load
+func (h *Health) RemoveCapacity(popID uint16) bool {
+	removed := false
+	h.update(func(next *healthState) {
+		if _, removed = next.capacity[popID]; removed {
+			next.capacity = maps.Clone(next.capacity)
+			delete(next.capacity, popID)
+		}
+	})
+	return removed
+}
+
+// Capacities returns the configured capacities by PoP ID
+func (h *Health) Capacities() []Capacity {
+	capacity := h.current.Load().capacity
+	return slices.SortedFunc(maps.Values(capacity), func(a, b Capacity) int { return int(a.PoP) - int(b.PoP) })
+}
+
+// ReportLoad records the current load of PoPs, PoPs not in the report keep their last load
+func (h *Health) ReportLoad(loads map[uint16]float64) {
+	h.update(func(next *healthState) {
+		next.load = maps.Clone(next.load)
+		maps.Copy(next.load, loads)
+	})
+}
+
+// Loads returns the last reported load of every PoP that reported one
+func (h *Health) Loads() map[uint16]float64 {
+	return maps.Clone(h.current.Load().load)
+}
+
+// Overloaded reports whether popID's last reported load is over its capacity limit
+func (h *Health) Overloaded(popID uint16) bool {
+	_, ok := h.current.Load().overloaded[popID]
+	return ok
+}
+
+// publish a copy of the state changed by fn, with the overloaded PoPs worked out again
+func (h *Health) update(fn func(next *healthState)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	next := *h.current.Load()
+	fn(&next)
+	next.overloaded = map[uint16]Capacity{}
+	for popID, c := range next.capacity {
+		if next.load[popID] > c.Limit {
+			next.overloaded[popID] = c
+		}
+	}
+	h.current.Store(&next)
+}
+
+// the overflow PoP answering the query instead of popID, ok is false when the subnet stays.
+// The overflow PoP is the subnet's pick among the overflow PoPs that are up and not overloaded themselves,
+// failing that among those that are up, and when none is up the subnet stays.
+func (v *healthView) spill(popID uint16) (overflow uint16, ok bool) {
+	c, overloaded := v.overloaded[popID]
+	if !overloaded || c.Spill == 0 {
+		return 0, false
+	}
+	// the answer depends on the subnet whether it spills or not
+	v.partial = true
+	hash := subnetHash(v.ecs, "spill")
+	if float64(hash>>11)/(1<<53) >= c.Spill {
+		return 0, false
+	}
+	first := int(hash % uint64(len(c.Overflow)))
+	for _, withCapacity := range []bool{true, false} {
+		for i := range c.Overflow {
+			candidate := c.Overflow[(first+i)%len(c.Overflow)]
+			if _, full := v.overloaded[candidate]; (full && withCapacity) || v.state(candidate) != PoPUp {
+				continue
+			}
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// LoadCapacities reads capacities from filename, one "PoP limit=N spill=F overflow=PoP,PoP" line per PoP,
+// empty lines and lines starting with # are skipped
+func LoadCapacities(filename string) ([]Capacity, error) {
+	var capacities []Capacity
+	err := readLines("capacity", filename, func(fields []string) error {
+		popID, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("failed to parse PoP ID '%s': %w", fields[0], err)
+		}
+		c := Capacity{PoP: uint16(popID)}
+		for _, option := range fields[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "limit", "spill":
+				number, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return fmt.Errorf("failed to parse %s '%s': %w", key, value, err)
+				}
+				if key == "limit" {
+					c.Limit = number
+				} else {
+					c.Spill = number
+				}
+			case "overflow":
+				for _, s := range strings.Split(value, ",") {
+					overflow, err := strconv.ParseUint(s, 10, 16)
+					if err != nil {
+						return fmt.Errorf("failed to parse overflow PoP ID '%s': %w", s, err)
+					}
+					c.Overflow = append(c.Overflow, uint16(overflow))
+				}
+			default:
+				return fmt.Errorf("unknown capacity option '%s'", option)
+			}
+		}
+		if err := c.validate(); err != nil {
+			return err
+		}
+		capacities = append(capacities, c)
+		return nil
+	})
+	return capacities, err
+}
+
+// LoadReports reads a load report from filename, one "PoP load" line per PoP,
+// empty lines and lines starting with # are skipped
+func LoadReports(filename string) (map[uint16]float64, error) {
+	loads := map[uint16]float64{}
+	err := readLines("load report", filename, func(fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("expected 2 fields (PoP, load), got %d", len(fields))
+		}
+		popID, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("failed to parse PoP ID '%s': %w", fields[0], err)
+		}
+		load, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse load '%s': %w", fields[1], err)
+		}
+		loads[uint16(popID)] = load
+		return nil
+	})
+	return loads, err
+}
+
+// call fn with the fields of every line of filename that is not empty or a comment,
+// an error is reported with the line number, kind names the file in messages
+func readLines(kind, filename string, fn func(fields []string) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %s file '%s': %w", kind, filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(strings.Fields(line)); err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s file '%s': %w", kind, filename, err)
+	}
+	return nil
+}
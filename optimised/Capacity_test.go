@@ -0,0 +1,150 @@
+package optimised
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCapacitySpill(t *testing.T) {
+	data := loadString(t, "2001:db8::/32 1\n2001:db9::/32 4\n")
+	health := NewHealth()
+	data.SetHealth(health)
+	if err := health.SetCapacity(Capacity{PoP: 1, Limit: 100, Spill: 0.3, Overflow: []uint16{2, 3}}); err != nil {
+		t.Fatalf("SetCapacity failed: %v", err)
+	}
+
+	const subnets = 4000
+	// PoP of every subnet, checking that the answers hold for the subnet only while PoP 1 spills
+	answers := func(wantScope int) map[string]uint16 {
+		result := map[string]uint16{}
+		for i := range subnets {
+			subnet := fmt.Sprintf("2001:db8:%x:%x::/64", i>>8, i&0xff)
+			pop, scope := data.Route(mustParseCIDR(t, subnet))
+			if scope != wantScope {
+				t.Fatalf("Route(%s): got scope %d, want %d", subnet, scope, wantScope)
+			}
+			result[subnet] = pop
+		}
+		return result
+	}
+	count := func(answers map[string]uint16, pop uint16) int {
+		n := 0
+		for _, answer := range answers {
+			if answer == pop {
+				n++
+			}
+		}
+		return n
+	}
+
+	health.ReportLoad(map[uint16]float64{1: 100, 2: 10})
+	if got := count(answers(32), 1); got != subnets {
+		t.Fatalf("at the limit: %d subnets on PoP 1, want all", got)
+	}
+
+	health.ReportLoad(map[uint16]float64{1: 120})
+	spilled := answers(64)
+	for _, pop := range []uint16{2, 3} {
+		if fraction := float64(count(spilled, pop)) / subnets; math.Abs(fraction-0.15) > 0.03 {
+			t.Errorf("over the limit: %.3f of the subnets on PoP %d, want 0.15", fraction, pop)
+		}
+	}
+	if !health.Overloaded(1) || health.Overloaded(2) {
+		t.Error("expected only PoP 1 overloaded")
+	}
+	checkRoute(t, data, "2001:db9::/64", 4, 32)
+
+	t.Run("Stable", func(t *testing.T) {
+		// a larger fraction keeps the subnets already spilled where they are
+		health.SetCapacity(Capacity{PoP: 1, Limit: 100, Spill: 0.6, Overflow: []uint16{2, 3}})
+		defer health.SetCapacity(Capacity{PoP: 1, Limit: 100, Spill: 0.3, Overflow: []uint16{2, 3}})
+		more := answers(64)
+		for subnet, pop := range spilled {
+			if pop != 1 && more[subnet] != pop {
+				t.Fatalf("%s moved from PoP %d to %d", subnet, pop, more[subnet])
+			}
+		}
+		if got := count(more, 1); math.Abs(float64(got)/subnets-0.4) > 0.03 {
+			t.Errorf("%d subnets left on PoP 1, want 40%%", got)
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		// an overloaded overflow PoP is only used when no other one has capacity, a down one not at all
+		health.SetCapacity(Capacity{PoP: 2, Limit: 5, Spill: 0.1, Overflow: []uint16{3}})
+		defer health.RemoveCapacity(2)
+		if got := count(answers(64), 3); math.Abs(float64(got)/subnets-0.3) > 0.03 {
+			t.Errorf("overflow PoP 2 over its limit: %d subnets on PoP 3, want 30%%", got)
+		}
+		health.Set(3, PoPDown)
+		defer health.Set(3, PoPUp)
+		if got := count(answers(64), 2); math.Abs(float64(got)/subnets-0.3) > 0.03 {
+			t.Errorf("overflow PoP 3 down: %d subnets on PoP 2, want 30%%", got)
+		}
+	})
+
+	if !health.RemoveCapacity(1) || health.RemoveCapacity(1) {
+		t.Fatal("expected to remove the capacity exactly once")
+	}
+	checkRoute(t, data, "2001:db8::/64", 1, 32)
+
+	for _, c := range []Capacity{
+		{PoP: 1, Limit: 0, Overflow: []uint16{2}},
+		{PoP: 1, Limit: 10, Spill: 1.5, Overflow: []uint16{2}},
+		{PoP: 1, Limit: 10, Spill: 0.5},
+		{PoP: 1, Limit: 10, Spill: 0.5, Overflow: []uint16{1}},
+	} {
+		if err := health.SetCapacity(c); err == nil {
+			t.Errorf("SetCapacity(%+v): expected error", c)
+		}
+	}
+}
+
+func TestLoadCapacities(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write '%s': %v", filePath, err)
+		}
+		return filePath
+	}
+
+	capacities, err := LoadCapacities(write("capacity.txt", "# PoP options\n1 limit=40 spill=0.25 overflow=2,3\n\n2 limit=1e3 overflow=1\n"))
+	if err != nil {
+		t.Fatalf("LoadCapacities failed: %v", err)
+	}
+	if len(capacities) != 2 || capacities[0].Limit != 40 || capacities[0].Spill != 0.25 || !slices.Equal(capacities[0].Overflow, []uint16{2, 3}) ||
+		capacities[1].Limit != 1000 || capacities[1].Spill != 0 {
+		t.Errorf("unexpected capacities %+v", capacities)
+	}
+
+	loads, err := LoadReports(write("load.txt", "# PoP load\n1 38.5\n2 700\n"))
+	if err != nil {
+		t.Fatalf("LoadReports failed: %v", err)
+	}
+	if len(loads) != 2 || loads[1] != 38.5 || loads[2] != 700 {
+		t.Errorf("unexpected loads %v", loads)
+	}
+
+	for _, tc := range []struct {
+		load    func(string) error
+		content string
+		want    string
+	}{
+		{func(f string) error { _, err := LoadCapacities(f); return err }, "1 limit=40 spill=x overflow=2", "line 1: failed to parse spill 'x'"},
+		{func(f string) error { _, err := LoadCapacities(f); return err }, "\n1 limit=40 burst=2 overflow=2", "line 2: unknown capacity option 'burst=2'"},
+		{func(f string) error { _, err := LoadCapacities(f); return err }, "1 limit=40", "needs at least one overflow PoP"},
+		{func(f string) error { _, err := LoadReports(f); return err }, "1 38.5 Gbps", "expected 2 fields (PoP, load)"},
+		{func(f string) error { _, err := LoadReports(f); return err }, "x 38.5", "failed to parse PoP ID 'x'"},
+	} {
+		if err := tc.load(write("bad.txt", tc.content)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.content, tc.want, err)
+		}
+	}
+}
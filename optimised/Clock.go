@@ -0,0 +1,17 @@
+package optimised
+
+import "time"
+
+// Clock tells the time to the time dependent parts of routing, tests replace it to move time without sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
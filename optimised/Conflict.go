@@ -0,0 +1,81 @@
+package optimised
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// ConflictKind tells where the existing rule sits relative to the rejected one
+type ConflictKind int
+
+const (
+	// ConflictBroader -> an existing rule containing the new prefix has a different PoP
+	ConflictBroader ConflictKind = iota
+	// ConflictExact -> a rule for the same prefix exists with a different PoP
+	ConflictExact
+	// ConflictNarrower -> an existing rule inside the new prefix has a different PoP
+	ConflictNarrower
+)
+
+func (kind ConflictKind) String() string {
+	switch kind {
+	case ConflictBroader:
+		return "broader"
+	case ConflictExact:
+		return "exact"
+	case ConflictNarrower:
+		return "narrower"
+	}
+	return fmt.Sprintf("ConflictKind(%d)", int(kind))
+}
+
+// ConflictError is returned when a rule is rejected because it overlaps an existing rule with a different PoP
+type ConflictError struct {
+	Kind ConflictKind
+	// the rejected rule, PoP is the primary PoP of a weighted rule whose set is in Weights ("pop:weight,...", empty for a single PoP)
+	Prefix  netip.Prefix
+	PoP     uint16
+	Weights string
+	// the existing rule it conflicts with
+	Existing        netip.Prefix
+	ExistingPoP     uint16
+	ExistingWeights string
+}
+
+func newConflictError(kind ConflictKind, prefix netip.Prefix, target Target, existing netip.Prefix, existingTarget Target) *ConflictError {
+	conflict := &ConflictError{Kind: kind, Prefix: prefix, PoP: target.PoP, Existing: existing, ExistingPoP: existingTarget.PoP}
+	if target.Weighted() {
+		conflict.Weights = target.PoPs()
+	}
+	if existingTarget.Weighted() {
+		conflict.ExistingWeights = existingTarget.PoPs()
+	}
+	return conflict
+}
+
+// the rejected and the existing rule's target as printed in the messages
+func (e *ConflictError) targets() (string, string) {
+	target, existing := fmt.Sprint(e.PoP), fmt.Sprint(e.ExistingPoP)
+	if e.Weights != "" {
+		target = e.Weights
+	}
+	if e.ExistingWeights != "" {
+		existing = e.ExistingWeights
+	}
+	return target, existing
+}
+
+func (e *ConflictError) Error() string {
+	target, existing := e.targets()
+	switch e.Kind {
+	case ConflictBroader:
+		return fmt.Sprintf("conflict: new rule %s (PoP %s) conflicts with broader rule at scope /%d (PoP %s)",
+			e.Prefix, target, e.Existing.Bits(), existing)
+	case ConflictExact:
+		return fmt.Sprintf("conflict: rule for exact prefix %s exists with different PoP %s (new PoP %s)",
+			e.Prefix, existing, target)
+	default:
+		return fmt.Sprintf("conflict: new rule %s (PoP %s) conflicts with existing narrower rule: found conflicting narrower rule %s at scope /%d with PoP %s",
+			e.Prefix, target, e.Existing, e.Existing.Bits(), existing)
+	}
+}
@@ -3,26 +3,71 @@ package optimised
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"os"
-	"strconv"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type RuleInfo struct {
-	popID uint16
-	scope int
+	target Target
+	scope  int
+	// number of times Route returned this rule, only counted while hit counting is enabled
+	hits atomic.Uint64
 }
 type TrieNode struct {
 	children [2]*TrieNode
 	ruleInfo *RuleInfo
 }
 type Data struct {
-	root *TrieNode
+	// published trie, swapped atomically so lookups never see a half built table
+	root atomic.Pointer[TrieNode]
+	// per rule hit counting, see EnableHitCounters
+	countHits atomic.Bool
+	// start of the current hit counting window in unix nanoseconds
+	hitsSince atomic.Int64
+	// optional hook for lookups, loads and conflicts, see SetObserver
+	observer Observer
+	// serialises changes, lookups never take it
+	writeMu sync.Mutex
+	// serial of the published table, see Versions
+	serial atomic.Uint64
+	// when the served table was published in unix nanoseconds
+	published atomic.Int64
+	// published tables kept for rollback, oldest first, guarded by writeMu
+	history      []version
+	historyLimit int
+	// optional write-ahead journal, see SetJournal
+	journal Journal
+	// the rules as last loaded from the routing data file, the journal records the changes on top of it.
+	// Guarded by writeMu, nil before the first load.
+	base *TrieNode
+	// optional audit trail of rule changes, see SetAuditor
+	auditor Auditor
+	// optional PoP states Route fails over from, see SetHealth
+	health *Health
+	// time rule windows are evaluated with, nil for the system clock (see SetClock)
+	clock Clock
 }
 
 func NewData() *Data {
-	return &Data{root: &TrieNode{}}
+	data := &Data{}
+	data.newMutation().publish("empty table")
+	return data
+}
+
+// the currently published trie, nil for a nil Data
+func (data *Data) currentRoot() *TrieNode {
+	if data == nil {
+		return nil
+	}
+	return data.root.Load()
 }
 
 // extract a specific bit from a byte
@@ -61,34 +106,67 @@ func validateSubnet(subnet *net.IPNet) error {
 	return nil
 }
 
-// helper for insert method to detect overlaps (check nodes below startNode for conflicting PoP IDs)
-func checkDescendantConflicts(startNode *TrieNode, expectedPopID uint16) error {
-	if startNode == nil {
-		return nil
+// helper for insert method to detect overlaps (check nodes below startNode for conflicting targets),
+// path and depth locate startNode so that the conflicting rule can be reported with its prefix
+func checkDescendantConflicts(startNode *TrieNode, path [16]byte, depth int, expected Target) (conflict netip.Prefix, conflictTarget Target, found bool) {
+	walk(startNode, &path, depth, func(node *TrieNode, path *[16]byte, nodeDepth int) bool {
+		// startNode itself is checked by checkSameNodeConflict
+		if nodeDepth == depth || node.ruleInfo == nil || !node.ruleInfo.target.conflictsWith(expected) {
+			return true
+		}
+		conflict, conflictTarget, found = pathPrefix(path, nodeDepth), node.ruleInfo.target, true
+		return false // first conflict is enough
+	})
+	return conflict, conflictTarget, found // no conflicts yayyyy when not found
+}
+
+// walk the trie in address order (parent before children, 0 before 1) and call fn for every node,
+// path holds the address bits leading to the node, depth is the node's prefix length,
+// fn returns false to stop the walk, walk reports whether it ran to completion
+func walk(node *TrieNode, path *[16]byte, depth int, fn func(node *TrieNode, path *[16]byte, depth int) bool) bool {
+	if node == nil {
+		return true
+	}
+	if !fn(node, path, depth) {
+		return false
+	}
+	if depth >= 128 {
+		return true
+	}
+	byteIndex := depth / 8
+	bitMask := byte(1) << (7 - depth%8)
+	if !walk(node.children[0], path, depth+1, fn) {
+		return false
+	}
+	if node.children[1] != nil {
+		path[byteIndex] |= bitMask
+		completed := walk(node.children[1], path, depth+1, fn)
+		path[byteIndex] &^= bitMask
+		return completed
 	}
+	return true
+}
 
-	for _, child := range startNode.children {
-		if child != nil {
-			// do not skip the children directly
-			if child.ruleInfo != nil && child.ruleInfo.popID != expectedPopID {
-				return fmt.Errorf("found conflicting narrower rule at scope /%d with PoP %d", child.ruleInfo.scope, child.ruleInfo.popID)
-			}
-			// recursively check the subtree
-			if err := checkDescendantConflicts(child, expectedPopID); err != nil {
-				return err // return found error
-			}
-		}
+// build the prefix of a node reached by walk
+func pathPrefix(path *[16]byte, depth int) netip.Prefix {
+	return netip.PrefixFrom(netip.AddrFrom16(*path), depth)
+}
+
+// validate the subnet and convert it to the masked prefix form the trie works with
+func subnetPrefix(subnet *net.IPNet) (netip.Prefix, error) {
+	if err := validateSubnet(subnet); err != nil {
+		return netip.Prefix{}, err
 	}
-	return nil // no conflicts yayyyy
+	prefixLen, _ := subnet.Mask.Size()
+	return netip.PrefixFrom(netip.AddrFrom16([16]byte(subnet.IP.To16())), prefixLen).Masked(), nil
 }
 
 // eg. to insert 192.168.0.0/8 ppid:8 VS 192.0.0.0/8 ppid:111 exists
-func checkSameNodeConflict(node *TrieNode, prefixLen int, subnetIP net.IP, popID uint16) error {
-	if node.ruleInfo != nil && node.ruleInfo.popID != popID {
+// (a different backup PoP is not a conflict, the new rule replaces the old one)
+func checkSameNodeConflict(node *TrieNode, prefix netip.Prefix, target Target) error {
+	if node.ruleInfo != nil && !node.ruleInfo.target.routesLike(target) {
 		// conflict found -> rule for this prefix exists with a different PoP ID
-		return fmt.Errorf("conflict: rule for exact prefix %s/%d exists with different PoP %d (new PoP %d)",
-			subnetIP, prefixLen, // Pass IP/len for better error message
-			node.ruleInfo.popID, popID)
+		return newConflictError(ConflictExact, prefix, target, prefix, node.ruleInfo.target)
 	}
 	return nil // No conflict
 }
@@ -96,107 +174,206 @@ func checkSameNodeConflict(node *TrieNode, prefixLen int, subnetIP net.IP, popID
 // insert address into the trie in MSB order with prefix overlap checks
 func (data *Data) insert(subnet *net.IPNet, popID uint16) error {
 
-	if err := validateSubnet(subnet); err != nil {
+	prefix, err := subnetPrefix(subnet)
+	if err != nil {
 		return err
 	}
+	return data.Insert(prefix, popID)
+}
 
-	prefixLen, _ := subnet.Mask.Size()
-	ip := subnet.IP.To16()
-
-	// traverse the path, crete nodes if needed
-	currentNode := data.root
-	for i := 0; i < prefixLen; i++ {
-		// ancestor conflicts check
-		if currentNode.ruleInfo != nil && currentNode.ruleInfo.popID != popID {
-			// conflict found -> broader rule with different PoP ID exists
-			return fmt.Errorf("conflict: new rule %s/%d (PoP %d) conflicts with broader rule at scope /%d (PoP %d)",
-				subnet.IP, prefixLen, popID,
-				currentNode.ruleInfo.scope, currentNode.ruleInfo.popID)
-		}
-
-		bit, err := getBit(ip, uint8(i))
-		if err != nil {
-			return fmt.Errorf("error getting bit %d for ip %v: %w", i, ip, err)
-		}
-
-		// a common path does not exist yet, create node
-		if currentNode.children[bit] == nil {
-			currentNode.children[bit] = &TrieNode{}
-		}
-		currentNode = currentNode.children[bit]
-	}
-
-	if err := checkSameNodeConflict(currentNode, prefixLen, subnet.IP, popID); err != nil {
-		// conflict found -> rule with this exact prefix exists with a different PoP ID
-		return err
-	}
+func (data *Data) Route(ecs *net.IPNet) (pop uint16, scope int) {
+	pop, scope, _ = data.observedRoute(ecs)
+	return pop, scope
+}
 
-	if err := checkDescendantConflicts(currentNode, popID); err != nil {
-		// conflict found -> narrower rule with different PoP ID exists
-		return fmt.Errorf("conflict: new rule %s/%d (PoP %d) conflicts with existing narrower rule: %w",
-			subnet.IP, prefixLen, popID,
-			err)
+// RouteRule is Route also returning the matched rule's prefix: the most specific rule in effect containing ecs,
+// which failover and spill start from. The prefix is invalid when no rule matched.
+func (data *Data) RouteRule(ecs *net.IPNet) (pop uint16, scope int, rule netip.Prefix) {
+	pop, scope, matched := data.observedRoute(ecs)
+	if matched != nil {
+		rule = netip.PrefixFrom(netip.AddrFrom16([16]byte(ecs.IP.To16())), matched.scope).Masked()
 	}
+	return pop, scope, rule
+}
 
-	// no conflicts
-	currentNode.ruleInfo = &RuleInfo{
-		popID: popID,
-		scope: prefixLen,
+func (data *Data) observedRoute(ecs *net.IPNet) (pop uint16, scope int, matched *RuleInfo) {
+	if data != nil && data.observer != nil {
+		start := time.Now()
+		pop, scope, matched = data.route(ecs)
+		data.observer.ObserveRoute(pop, scope >= 0, time.Since(start))
+		return pop, scope, matched
 	}
-	return nil
+	return data.route(ecs)
 }
 
-func (data *Data) Route(ecs *net.IPNet) (pop uint16, scope int) {
+func (data *Data) route(ecs *net.IPNet) (pop uint16, scope int, matched *RuleInfo) {
 	var bestPop uint16 = 0
 	var bestScope int = -1
 
-	if data == nil || data.root == nil || ecs == nil {
-		return bestPop, bestScope
+	root := data.currentRoot()
+	if root == nil || ecs == nil {
+		return bestPop, bestScope, nil
 	}
 
 	searchIP := ecs.IP.To16()
 	if searchIP == nil {
-		return bestPop, bestScope
+		return bestPop, bestScope, nil
 	}
 
-	currentNode := data.root
+	bestRule := longestMatch(root, searchIP, data.clock)
+	if bestRule == nil {
+		return bestPop, bestScope, nil
+	}
+	if data.countHits.Load() {
+		bestRule.hits.Add(1)
+	}
+	pop, scope = bestRule.target.PoP, bestRule.scope
+	if bestRule.target.Weighted() {
+		// the PoP depends on the client subnet, so the answer only applies to that subnet
+		ones, bits := ecs.Mask.Size()
+		pop, scope = bestRule.target.pick(ecs), max(bestRule.scope, ones+128-bits)
+	}
+	if data.health != nil {
+		if health, ok := data.health.view(ecs); ok {
+			if health.state(pop) != PoPUp {
+				pop, scope = failover(root, ecs, searchIP, data.clock, &health)
+			}
+			if overflow, ok := health.spill(pop); ok {
+				pop = overflow
+			}
+			if health.partial {
+				// the PoP keeps only part of its subnets during maintenance or while over capacity,
+				// the answer holds for this subnet only
+				ones, bits := ecs.Mask.Size()
+				scope = max(scope, ones+128-bits)
+			}
+		}
+	}
+	return pop, scope, bestRule
+}
+
+// follow the searched address down the trie, remembering the most specific rule in effect on the way
+func longestMatch(root *TrieNode, searchIP net.IP, clock Clock) *RuleInfo {
+	lt := lookupTime{clock: clock}
+	currentNode := root
 	// check root node
-	if currentNode.ruleInfo != nil {
-		bestPop = currentNode.ruleInfo.popID
-		bestScope = currentNode.ruleInfo.scope
+	var bestRule *RuleInfo
+	if currentNode.ruleInfo != nil && lt.active(currentNode.ruleInfo) {
+		bestRule = currentNode.ruleInfo
 	}
 
 	for i := 0; i < 128; i++ {
 		bit, err := getBit(searchIP, uint8(i))
 		if err != nil {
 			fmt.Println(err)
-			return bestPop, bestScope
+			return bestRule
 		}
 
 		if currentNode.children[bit] == nil {
-			return bestPop, bestScope
+			return bestRule
 		}
 		currentNode = currentNode.children[bit]
 
-		if currentNode.ruleInfo != nil {
-			bestPop = currentNode.ruleInfo.popID
-			bestScope = currentNode.ruleInfo.scope
+		if currentNode.ruleInfo != nil && lt.active(currentNode.ruleInfo) {
+			bestRule = currentNode.ruleInfo
+		}
+	}
+	return bestRule
+}
+
+// lookupTime tells which rules are in effect during one lookup,
+// the clock is only read once a rule with a window is met so permanent tables never pay for it
+type lookupTime struct {
+	clock Clock
+	now   time.Time
+}
+
+func (lt *lookupTime) active(rule *RuleInfo) bool {
+	if !rule.target.timed() {
+		return true
+	}
+	if lt.now.IsZero() {
+		if lt.clock == nil {
+			lt.clock = SystemClock
 		}
+		lt.now = lt.clock.Now()
 	}
-	return bestPop, bestScope
+	return rule.target.ActiveAt(lt.now)
 }
 
+// SetClock replaces the clock rule windows are evaluated with (the system clock by default),
+// like the other hooks it must be set before the Data is shared between goroutines
+func (data *Data) SetClock(clock Clock) {
+	data.clock = clock
+}
+
+// the current time of the table's clock
+func (data *Data) now() time.Time {
+	if data.clock == nil {
+		return SystemClock.Now()
+	}
+	return data.clock.Now()
+}
+
+// LoadRoutingData adds the rules from filename to the table.
+// The rules are published together once the whole file is read, on error none of them are added.
 func (data *Data) LoadRoutingData(filename string) error {
+	return data.load(SystemActor, filename, false)
+}
+
+// ReloadRoutingData replaces all rules with the ones from filename.
+// The new table is built on the side and published at once, lookups running meanwhile keep using the old one.
+// With a journal the changes journaled on top of the previous file are applied again on top of the new one,
+// a change conflicting with the new rules fails the reload. On error the old table stays in place.
+func (data *Data) ReloadRoutingData(filename string) error {
+	return data.As(SystemActor).ReloadRoutingData(filename)
+}
+
+func (data *Data) load(actor, filename string, reload bool) error {
+	start := time.Now()
+	data.writeMu.Lock()
+	m := data.newMutation()
+	m.actor = actor
+	source := "load " + filename
+	if reload {
+		// start over from an empty trie
+		m.clear()
+		source = "reload " + filename
+	}
+	err := m.loadRoutingData(filename)
+	base := data.base
+	switch {
+	case err != nil:
+	case reload && data.journal != nil:
+		// keep the journaled changes, on top of the new rules from here on
+		base = m.root
+		overlay := changesBetween(data.base, data.currentRoot())
+		m = data.newMutation()
+		m.root, m.actor = base, actor
+		if _, problems := m.apply(overlay, true); len(problems) > 0 {
+			err = fmt.Errorf("journaled changes do not apply on top of '%s': %w", filename, &TxError{Errors: problems})
+		}
+	case reload || data.journal == nil:
+		// loads made with a journal are journaled as changes, without one they build up the base table
+		base = m.root
+	}
+	if err == nil {
+		err = m.commitTable(source, base)
+	}
+	data.writeMu.Unlock()
+	if data.observer != nil {
+		data.observer.ObserveLoad(reload, time.Since(start), err)
+	}
+	return err
+}
+
+func (m *mutation) loadRoutingData(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open routing ruleInfo file '%s': %w", filename, err)
 	}
 	defer file.Close()
 
-	if data.root == nil {
-		data.root = &TrieNode{}
-	}
-
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -206,26 +383,31 @@ func (data *Data) LoadRoutingData(filename string) error {
 		}
 
 		parts := strings.Fields(line)
-		if len(parts) != 2 {
-			return fmt.Errorf("expected 2 fields (ECS IP, PopID), got %d in '%s'", len(parts), line)
+		// anything after the PoP ID must be a key=value rule option
+		if len(parts) < 2 || slices.ContainsFunc(parts[2:], func(option string) bool { return !strings.Contains(option, "=") }) {
+			return fmt.Errorf("expected 2 fields (ECS IP, PopID) and optional key=value rule options, got %d in '%s'", len(parts), line)
 		}
 
 		cidrStr := parts[0]
-		popIDStr := parts[1]
+		// PoP ID or weighted set followed by the rule options
+		targetStr := strings.Join(parts[1:], " ")
 
 		_, ipNet, err := net.ParseCIDR(cidrStr)
 		if err != nil {
 			return fmt.Errorf("failed to parse CIDR '%s': %w", cidrStr, err)
 		}
 
-		popIDUint64, err := strconv.ParseUint(popIDStr, 10, 16)
+		target, err := ParseTarget(targetStr)
 		if err != nil {
-			return fmt.Errorf("failed to parse PoP ID '%s': %w", popIDStr, err)
+			return err
 		}
-		popID := uint16(popIDUint64)
 
-		if err := data.insert(ipNet, popID); err != nil {
-			return fmt.Errorf("error inserting rule (%s %d): %w", cidrStr, popID, err)
+		prefix, err := subnetPrefix(ipNet)
+		if err != nil {
+			return fmt.Errorf("error inserting rule (%s %s): %w", cidrStr, target, err)
+		}
+		if err := m.insert(prefix, target, false); err != nil {
+			return fmt.Errorf("error inserting rule (%s %s): %w", cidrStr, target, err)
 		}
 	}
 
@@ -235,3 +417,49 @@ func (data *Data) LoadRoutingData(filename string) error {
 
 	return nil
 }
+
+// WriteRoutingData writes all rules in the "CIDR PoP [backup=PoP]" (or "CIDR pop:weight,...") line format LoadRoutingData reads.
+// The output is canonical: one rule per line in address order, CIDRs masked and in the shortest lowercase IPv6 form,
+// so a load -> write -> load round-trips exactly and two tables with the same rules produce identical bytes
+func (data *Data) WriteRoutingData(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for prefix, target := range data.Targets() {
+		fmt.Fprintf(bw, "%s %s\n", prefix, target)
+	}
+	return bw.Flush()
+}
+
+// ExportRoutingData writes the canonical form of the table to filename, replacing it atomically
+func (data *Data) ExportRoutingData(filename string) error {
+	// write next to the destination so the rename stays on the same filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for '%s': %w", filename, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp makes the file private, keep the mode of the file replaced, a new one is 0644
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set the mode of routing data file '%s': %w", filename, err)
+	}
+	if err := data.WriteRoutingData(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write routing data file '%s': %w", filename, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync routing data file '%s': %w", filename, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close routing data file '%s': %w", filename, err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace routing data file '%s': %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package optimised
+
+import (
+	"math/big"
+	"net/netip"
+	"sort"
+)
+
+// Answer is what Route returns for an address, Scope is -1 when no rule matches
+type Answer struct {
+	PoP   uint16
+	Scope int
+	// routing data form of a weighted target (see ParseTarget), empty for a single PoP
+	Weights string
+}
+
+// RangeChange is an address range whose answer differs between two tables
+type RangeChange struct {
+	Prefix netip.Prefix
+	Before Answer
+	After  Answer
+}
+
+// PoPDelta is the amount of address space a PoP gained and lost between two tables
+type PoPDelta struct {
+	PoP    uint16
+	Gained *big.Int
+	Lost   *big.Int
+}
+
+type TableDiff struct {
+	// minimal list of prefixes with a changed PoP or scope, in address order
+	Changes []RangeChange
+	// per PoP address space totals, sorted by PoP ID
+	PoPs []PoPDelta
+}
+
+var noMatch = Answer{PoP: 0, Scope: -1}
+
+// Diff compares the answers of two tables for every address,
+// with ignoreScope only PoP changes are reported and Scope is 0 for every matched answer
+func Diff(before, after *Data, ignoreScope bool) *TableDiff {
+	beforeRoot, afterRoot := before.currentRoot(), after.currentRoot()
+
+	diff := &TableDiff{}
+	var path [16]byte
+	walker := differ{ignoreScope: ignoreScope}
+	walker.emit = func(path *[16]byte, depth int, beforeAnswer, afterAnswer Answer) {
+		diff.Changes = append(diff.Changes, RangeChange{
+			Prefix: pathPrefix(path, depth),
+			Before: beforeAnswer,
+			After:  afterAnswer,
+		})
+	}
+	// one answer per table for the whole space -> either nothing changed or the root itself did
+	if beforeAnswer, afterAnswer, uniform := walker.diffNodes(beforeRoot, afterRoot, noMatch, noMatch, &path, 0); uniform && beforeAnswer != afterAnswer {
+		walker.emit(&path, 0, beforeAnswer, afterAnswer)
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		a, b := diff.Changes[i].Prefix, diff.Changes[j].Prefix
+		if cmp := a.Addr().Compare(b.Addr()); cmp != 0 {
+			return cmp < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+	diff.PoPs = popDeltas(diff.Changes)
+	return diff
+}
+
+type differ struct {
+	ignoreScope bool
+	emit        func(path *[16]byte, depth int, beforeAnswer, afterAnswer Answer)
+}
+
+func (d *differ) answer(node *TrieNode, inherited Answer) Answer {
+	if node == nil || node.ruleInfo == nil {
+		return inherited
+	}
+	answer := Answer{PoP: node.ruleInfo.target.PoP, Scope: node.ruleInfo.scope}
+	if node.ruleInfo.target.Weighted() {
+		answer.Weights = node.ruleInfo.target.PoPs()
+	}
+	if d.ignoreScope {
+		answer.Scope = 0
+	}
+	return answer
+}
+
+// walk both tries in lockstep carrying the answer inherited from the nearest rule above,
+// returns the answers when they are the same for the whole range below so that the parent can merge it
+func (d *differ) diffNodes(before, after *TrieNode, beforeAnswer, afterAnswer Answer, path *[16]byte, depth int) (Answer, Answer, bool) {
+	beforeAnswer = d.answer(before, beforeAnswer)
+	afterAnswer = d.answer(after, afterAnswer)
+
+	// no narrower rules in either table -> answers can not change within this range
+	if !hasChildren(before) && !hasChildren(after) {
+		return beforeAnswer, afterAnswer, true
+	}
+
+	byteIndex := depth / 8
+	bitMask := byte(1) << (7 - depth%8)
+	leftBefore, leftAfter, leftUniform := d.diffNodes(child(before, 0), child(after, 0), beforeAnswer, afterAnswer, path, depth+1)
+	path[byteIndex] |= bitMask
+	rightBefore, rightAfter, rightUniform := d.diffNodes(child(before, 1), child(after, 1), beforeAnswer, afterAnswer, path, depth+1)
+	path[byteIndex] &^= bitMask
+
+	if leftUniform && rightUniform && leftBefore == rightBefore && leftAfter == rightAfter {
+		return leftBefore, leftAfter, true
+	}
+
+	if leftUniform && leftBefore != leftAfter {
+		d.emit(path, depth+1, leftBefore, leftAfter)
+	}
+	if rightUniform && rightBefore != rightAfter {
+		path[byteIndex] |= bitMask
+		d.emit(path, depth+1, rightBefore, rightAfter)
+		path[byteIndex] &^= bitMask
+	}
+	return Answer{}, Answer{}, false
+}
+
+func hasChildren(node *TrieNode) bool {
+	return node != nil && (node.children[0] != nil || node.children[1] != nil)
+}
+
+func child(node *TrieNode, bit int) *TrieNode {
+	if node == nil {
+		return nil
+	}
+	return node.children[bit]
+}
+
+// sum up the address space moved between PoPs, scope only changes do not move anything
+func popDeltas(changes []RangeChange) []PoPDelta {
+	deltas := map[uint16]*PoPDelta{}
+	get := func(pop uint16) *PoPDelta {
+		delta, ok := deltas[pop]
+		if !ok {
+			delta = &PoPDelta{PoP: pop, Gained: new(big.Int), Lost: new(big.Int)}
+			deltas[pop] = delta
+		}
+		return delta
+	}
+
+	for _, change := range changes {
+		beforeMatched := change.Before.Scope >= 0
+		afterMatched := change.After.Scope >= 0
+		if beforeMatched == afterMatched && change.Before.PoP == change.After.PoP {
+			continue
+		}
+		size := new(big.Int).Lsh(big.NewInt(1), uint(128-change.Prefix.Bits()))
+		if beforeMatched {
+			lost := get(change.Before.PoP).Lost
+			lost.Add(lost, size)
+		}
+		if afterMatched {
+			gained := get(change.After.PoP).Gained
+			gained.Add(gained, size)
+		}
+	}
+
+	result := make([]PoPDelta, 0, len(deltas))
+	for _, delta := range deltas {
+		result = append(result, *delta)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].PoP < result[j].PoP })
+	return result
+}
@@ -0,0 +1,106 @@
+package optimised
+
+import (
+	"math/big"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	t.Run("IdenticalTables", func(t *testing.T) {
+		before, after := NewData(), NewData()
+		checkInsert(t, before, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db8::/32", 100, "")
+
+		diff := Diff(before, after, false)
+		if len(diff.Changes) != 0 || len(diff.PoPs) != 0 {
+			t.Errorf("expected no changes, got %+v", diff)
+		}
+	})
+
+	t.Run("AddedRule", func(t *testing.T) {
+		before, after := NewData(), NewData()
+		checkInsert(t, before, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db9::/32", 200, "")
+
+		diff := Diff(before, after, false)
+		want := []RangeChange{{
+			Prefix: netip.MustParsePrefix("2001:db9::/32"),
+			Before: Answer{PoP: 0, Scope: -1},
+			After:  Answer{PoP: 200, Scope: 32},
+		}}
+		if !reflect.DeepEqual(diff.Changes, want) {
+			t.Errorf("Changes: got %+v, want %+v", diff.Changes, want)
+		}
+		if len(diff.PoPs) != 1 || diff.PoPs[0].PoP != 200 || diff.PoPs[0].Gained.Cmp(new(big.Int).Lsh(big.NewInt(1), 96)) != 0 || diff.PoPs[0].Lost.Sign() != 0 {
+			t.Errorf("PoPs: got %+v, want PoP 200 gaining 2^96", diff.PoPs)
+		}
+	})
+
+	t.Run("ScopeOnlyChange", func(t *testing.T) {
+		before, after := NewData(), NewData()
+		checkInsert(t, before, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db8:aaaa::/48", 100, "")
+
+		diff := Diff(before, after, false)
+		want := []RangeChange{{
+			Prefix: netip.MustParsePrefix("2001:db8:aaaa::/48"),
+			Before: Answer{PoP: 100, Scope: 32},
+			After:  Answer{PoP: 100, Scope: 48},
+		}}
+		if !reflect.DeepEqual(diff.Changes, want) {
+			t.Errorf("Changes: got %+v, want %+v", diff.Changes, want)
+		}
+		if len(diff.PoPs) != 0 {
+			t.Errorf("scope change must not move address space, got %+v", diff.PoPs)
+		}
+
+		if diff := Diff(before, after, true); len(diff.Changes) != 0 {
+			t.Errorf("ignoreScope: expected no changes, got %+v", diff.Changes)
+		}
+	})
+
+	t.Run("MovedHalf", func(t *testing.T) {
+		before, after := NewData(), NewData()
+		checkInsert(t, before, "2001:db8::/32", 100, "")
+		checkInsert(t, after, "2001:db8::/33", 100, "")
+		checkInsert(t, after, "2001:db8:8000::/34", 200, "")
+		checkInsert(t, after, "2001:db8:c000::/34", 200, "")
+
+		diff := Diff(before, after, true)
+		want := []RangeChange{{
+			Prefix: netip.MustParsePrefix("2001:db8:8000::/33"),
+			Before: Answer{PoP: 100, Scope: 0},
+			After:  Answer{PoP: 200, Scope: 0},
+		}}
+		if !reflect.DeepEqual(diff.Changes, want) {
+			t.Errorf("Changes: got %+v, want %+v", diff.Changes, want)
+		}
+
+		half := new(big.Int).Lsh(big.NewInt(1), 95)
+		if len(diff.PoPs) != 2 ||
+			diff.PoPs[0].PoP != 100 || diff.PoPs[0].Lost.Cmp(half) != 0 || diff.PoPs[0].Gained.Sign() != 0 ||
+			diff.PoPs[1].PoP != 200 || diff.PoPs[1].Gained.Cmp(half) != 0 || diff.PoPs[1].Lost.Sign() != 0 {
+			t.Errorf("PoPs: got %+v, want PoP 100 losing and PoP 200 gaining 2^95", diff.PoPs)
+		}
+
+		// with scope the /33 rule changes the scope of the remaining half too
+		diff = Diff(before, after, false)
+		if len(diff.Changes) != 2 || diff.Changes[0].Prefix != netip.MustParsePrefix("2001:db8::/33") {
+			t.Errorf("Changes with scope: got %+v", diff.Changes)
+		}
+	})
+
+	t.Run("DefaultRoute", func(t *testing.T) {
+		before, after := NewData(), NewData()
+		checkInsert(t, after, "::/0", 1, "")
+
+		diff := Diff(before, after, false)
+		if len(diff.Changes) != 1 || diff.Changes[0].Prefix != netip.MustParsePrefix("::/0") {
+			t.Errorf("Changes: got %+v, want the whole space", diff.Changes)
+		}
+	})
+}
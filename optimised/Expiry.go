@@ -0,0 +1,32 @@
+package optimised
+
+import "fmt"
+
+// RemoveExpired deletes the rules whose window is over by the table's clock and returns how many were removed.
+// Route already ignores them, removing them keeps the trie, exports and the journal from filling up with dead rules.
+// The removal is published (and journaled) as one change like a transaction, nothing is published when no rule expired.
+func (data *Data) RemoveExpired() (int, error) {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+
+	now := data.now()
+	m := data.newMutation()
+	var changes []Change
+	for prefix, target := range allRules(m.root) {
+		if target.ExpiredAt(now) {
+			changes = append(changes, Change{Prefix: prefix, Delete: true})
+		}
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	for _, change := range changes {
+		if err := m.remove(change.Prefix); err != nil {
+			return 0, err
+		}
+	}
+	if err := m.commitChanges(fmt.Sprintf("expire %d rules", len(changes)), changes); err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,99 @@
+package optimised
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleWindows(t *testing.T) {
+	data := loadString(t, strings.Join([]string{
+		"2001:db8::/32 1",
+		"2001:db8:1::/48 1 not-after=2026-03-01T12:00:00Z",
+		// a temporary move to PoP 2 followed by another one to PoP 3
+		"2001:db9::/32 2 not-after=2026-03-01T12:00:00Z",
+		"2001:db9::/48 3 not-before=2026-03-01T12:00:01Z not-after=2026-03-02T00:00:00Z",
+	}, "\n"))
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 11, 0, 0, 0, time.UTC)}
+	data.SetClock(clock)
+
+	checkRoute(t, data, "2001:db8:1::/56", 1, 48)
+	checkRoute(t, data, "2001:db9::/56", 2, 32)
+	// the last second of a window is still in it
+	clock.now = time.Date(2026, 3, 1, 12, 0, 0, 999, time.UTC)
+	checkRoute(t, data, "2001:db9::/56", 2, 32)
+	clock.now = time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC)
+	checkRoute(t, data, "2001:db8:1::/56", 1, 32)
+	checkRoute(t, data, "2001:db9::/56", 3, 48)
+	checkRoute(t, data, "2001:db9:1::/56", 0, -1)
+
+	t.Run("Conflicts", func(t *testing.T) {
+		start := time.Date(2026, 3, 1, 6, 0, 0, 0, time.UTC)
+		for _, tc := range []struct {
+			prefix              string
+			pop                 uint16
+			notBefore, notAfter time.Time
+			wantErr             string
+		}{
+			// a permanent rule overlaps every window
+			{"2001:db9:1::/48", 4, time.Time{}, time.Time{}, "conflicts with broader rule at scope /32"},
+			{"2001:db9::/56", 4, start, start.Add(time.Hour), "conflicts with broader rule at scope /32"},
+			{"2001:db9::/40", 4, start.Add(7 * time.Hour), time.Time{}, "conflicts with existing narrower rule"},
+			// a prefix holds one rule, whatever the windows
+			{"2001:db9::/32", 4, start.Add(24 * time.Hour), time.Time{}, "rule for exact prefix 2001:db9::/32 exists"},
+			{"2001:db8:2::/48", 4, start, start.Add(-time.Hour), "rule window ends before it starts"},
+			// after the PoP 2 window, overlapping the PoP 3 one only outside its range
+			{"2001:db9:1::/48", 4, start.Add(7 * time.Hour), time.Time{}, ""},
+			{"2001:dba::/31", 4, start.Add(24 * time.Hour), time.Time{}, ""},
+		} {
+			err := data.InsertBounded(netip.MustParsePrefix(tc.prefix), tc.pop, tc.notBefore, tc.notAfter)
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("InsertBounded(%s, %d): %v", tc.prefix, tc.pop, err)
+			} else if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("InsertBounded(%s, %d): expected error containing %q, got %v", tc.prefix, tc.pop, tc.wantErr, err)
+			}
+		}
+		checkRoute(t, data, "2001:db9:1::/56", 4, 48)
+		checkRoute(t, data, "2001:dba::/56", 0, -1)
+		clock.now = start.Add(25 * time.Hour)
+		checkRoute(t, data, "2001:dba::/56", 4, 31)
+	})
+
+	t.Run("Minimise", func(t *testing.T) {
+		windowed := loadString(t, "2001:db8::/32 1\n2001:db8::/33 1 not-before=2026-03-01T00:00:00Z\n2001:db8:8000::/33 1\n")
+		// the /32 answers the lower half before the window starts
+		minimised, err := windowed.Minimise(true)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got, want := exportString(t, minimised), exportString(t, windowed); got != want {
+			t.Errorf("Minimise(true):\ngot  %q\nwant %q", got, want)
+		}
+	})
+
+	t.Run("RemoveExpired", func(t *testing.T) {
+		before := exportString(t, data)
+		clock.now = time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC)
+		if removed, err := data.RemoveExpired(); err != nil || removed != 2 {
+			t.Fatalf("RemoveExpired: removed %d, %v, want 2", removed, err)
+		}
+		if _, ok := data.Target(netip.MustParsePrefix("2001:db9::/32")); ok {
+			t.Error("expired rule is still in the table")
+		}
+		if _, ok := data.Target(netip.MustParsePrefix("2001:db9::/48")); !ok {
+			t.Error("rule in its window was removed")
+		}
+		if versions := data.Versions(); versions[len(versions)-1].Source != "expire 2 rules" {
+			t.Errorf("unexpected version source %q", versions[len(versions)-1].Source)
+		}
+		// nothing left to expire -> nothing published
+		serial := data.Serial()
+		if removed, err := data.RemoveExpired(); err != nil || removed != 0 || data.Serial() != serial {
+			t.Errorf("second RemoveExpired: removed %d, %v, serial %d -> %d", removed, err, serial, data.Serial())
+		}
+		if exportString(t, data) == before {
+			t.Error("export did not change")
+		}
+	})
+}
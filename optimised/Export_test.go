@@ -0,0 +1,98 @@
+package optimised
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportRoutingData(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	// unsorted, unmasked, uppercase and expanded forms
+	content := `
+2001:DB9::/32 200
+
+2001:db8:aaaa:0:0:0:0:1/48   100
+2001:db8::/32 100
+::ffff:10.0.0.0/104 7
+2001:0db8:aaaa:bb00::/56 100
+`
+	if err := os.WriteFile(input, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create input file: %v", err)
+	}
+
+	data := NewData()
+	if err := data.LoadRoutingData(input); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+
+	exported := filepath.Join(dir, "exported.txt")
+	if err := data.ExportRoutingData(exported); err != nil {
+		t.Fatalf("ExportRoutingData failed: %v", err)
+	}
+	got, err := os.ReadFile(exported)
+	if err != nil {
+		t.Fatalf("Failed to read exported file: %v", err)
+	}
+	want := `::ffff:10.0.0.0/104 7
+2001:db8::/32 100
+2001:db8:aaaa::/48 100
+2001:db8:aaaa:bb00::/56 100
+2001:db9::/32 200
+`
+	if string(got) != want {
+		t.Errorf("ExportRoutingData:\ngot:\n%swant:\n%s", got, want)
+	}
+	checkMode := func(t *testing.T, want os.FileMode) {
+		t.Helper()
+		info, err := os.Stat(exported)
+		if err != nil {
+			t.Fatalf("Failed to stat exported file: %v", err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("exported file mode: got %v, want %v", info.Mode().Perm(), want)
+		}
+	}
+	checkMode(t, 0644)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		reloaded := NewData()
+		if err := reloaded.LoadRoutingData(exported); err != nil {
+			t.Fatalf("LoadRoutingData of exported file failed: %v", err)
+		}
+		// export over the existing file to check the atomic replace as well
+		if err := reloaded.ExportRoutingData(exported); err != nil {
+			t.Fatalf("ExportRoutingData failed: %v", err)
+		}
+		again, err := os.ReadFile(exported)
+		if err != nil {
+			t.Fatalf("Failed to read exported file: %v", err)
+		}
+		if string(again) != want {
+			t.Errorf("round trip changed the export:\ngot:\n%swant:\n%s", again, want)
+		}
+		// the replaced file keeps its mode
+		if err := os.Chmod(exported, 0640); err != nil {
+			t.Fatalf("Chmod failed: %v", err)
+		}
+		if err := reloaded.ExportRoutingData(exported); err != nil {
+			t.Fatalf("ExportRoutingData failed: %v", err)
+		}
+		checkMode(t, 0640)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to list dir: %v", err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("expected only input and exported files, temporary files left behind: %v", entries)
+		}
+	})
+
+	t.Run("MissingDir", func(t *testing.T) {
+		if err := data.ExportRoutingData(filepath.Join(dir, "missing", "out.txt")); err == nil {
+			t.Error("expected error for missing directory, got nil")
+		}
+	})
+}
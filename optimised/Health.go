@@ -0,0 +1,235 @@
+package optimised
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoPState is the health of a PoP as far as routing is concerned
+type PoPState uint8
+
+const (
+	// PoPUp -> the PoP takes traffic, the state of every PoP not marked otherwise
+	PoPUp PoPState = iota
+	// PoPDraining -> the PoP is taken out of rotation, only used when no alternative is up
+	PoPDraining
+	// PoPDown -> the PoP is only used when every alternative is down as well
+	PoPDown
+)
+
+func (s PoPState) String() string {
+	switch s {
+	case PoPUp:
+		return "up"
+	case PoPDraining:
+		return "draining"
+	case PoPDown:
+		return "down"
+	default:
+		return fmt.Sprintf("PoPState(%d)", uint8(s))
+	}
+}
+
+// ParsePoPState reads the String form of a state
+func ParsePoPState(s string) (PoPState, error) {
+	for _, state := range []PoPState{PoPUp, PoPDraining, PoPDown} {
+		if s == state.String() {
+			return state, nil
+		}
+	}
+	return PoPUp, fmt.Errorf("unknown PoP state '%s' (expected up, draining or down)", s)
+}
+
+// Health holds the state of every PoP, the scheduled maintenance windows and the PoPs' capacity and load,
+// one Health is usually shared by all tables routing to the same PoPs.
+// Lookups read the current state without locking, changes publish a new copy like the trie does.
+type Health struct {
+	// serialises changes
+	mu      sync.Mutex
+	current atomic.Pointer[healthState]
+	// time of the maintenance windows, see SetClock
+	clock             Clock
+	lastMaintenanceID uint64
+}
+
+// healthState is never modified once published
+type healthState struct {
+	// PoPs that are not up
+	states map[uint16]PoPState
+	// sorted by start
+	windows []Maintenance
+	// when the first of the windows finishes, the first lookup from then on drops the finished ones
+	nextFinish time.Time
+	// configured capacity limits and the last reported load by PoP
+	capacity map[uint16]Capacity
+	load     map[uint16]float64
+	// PoPs whose load is over their limit, the only ones Route has to look at for spilling
+	overloaded map[uint16]Capacity
+}
+
+func NewHealth() *Health {
+	h := &Health{clock: SystemClock}
+	h.current.Store(&healthState{states: map[uint16]PoPState{}, capacity: map[uint16]Capacity{}, load: map[uint16]float64{}})
+	return h
+}
+
+// SetClock replaces the clock maintenance windows are evaluated with, it must be set before the Health is shared
+func (h *Health) SetClock(clock Clock) {
+	h.clock = clock
+}
+
+// SetHealth makes Route fail over from PoPs health reports as not up, nil turns failover off.
+// Like the other hooks it must be set before the Data is shared between goroutines.
+func (data *Data) SetHealth(health *Health) {
+	data.health = health
+}
+
+// Set changes the state of popID and returns the previous one
+func (h *Health) Set(popID uint16, state PoPState) PoPState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.current.Load()
+	previous := current.states[popID]
+	if previous == state {
+		return previous
+	}
+	states := maps.Clone(current.states)
+	if state == PoPUp {
+		delete(states, popID)
+	} else {
+		states[popID] = state
+	}
+	next := *current
+	next.states = states
+	h.current.Store(&next)
+	return previous
+}
+
+// State returns the state of popID as set, maintenance windows are not taken into account
+func (h *Health) State(popID uint16) PoPState {
+	return h.current.Load().states[popID]
+}
+
+// States returns the PoPs that are not up with their state
+func (h *Health) States() map[uint16]PoPState {
+	return maps.Clone(h.current.Load().states)
+}
+
+// healthView answers the state of PoPs for a single query
+type healthView struct {
+	*healthState
+	ecs *net.IPNet
+	now time.Time
+	// position of the query's subnet in the order maintenance drains subnets, in [0, 1), hashed on first use
+	point  float64
+	hashed bool
+	// a maintenance window was half way or the PoP spills, so the answer depends on the subnet
+	partial bool
+}
+
+// the view for a query, ok is false when every PoP is up
+func (h *Health) view(ecs *net.IPNet) (view healthView, ok bool) {
+	current := h.current.Load()
+	if len(current.windows) > 0 {
+		view.now = h.clock.Now()
+		if !view.now.Before(current.nextFinish) {
+			current = h.dropFinished(view.now)
+		}
+	}
+	if len(current.states) == 0 && len(current.windows) == 0 && len(current.overloaded) == 0 {
+		return healthView{}, false
+	}
+	view.healthState, view.ecs = current, ecs
+	return view, true
+}
+
+func (v *healthView) drainPoint() float64 {
+	if !v.hashed {
+		v.point, v.hashed = float64(subnetHash(v.ecs, "maintenance")>>11)/(1<<53), true
+	}
+	return v.point
+}
+
+// state of popID for the query, a PoP in maintenance is draining for the subnets its share no longer covers
+func (v *healthView) state(popID uint16) PoPState {
+	if state := v.states[popID]; state != PoPUp {
+		return state
+	}
+	for _, w := range v.windows {
+		if w.PoP != popID {
+			continue
+		}
+		// only a window half way depends on the subnet
+		switch share := w.Share(v.now); {
+		case share <= 0:
+			return PoPDraining
+		case share < 1:
+			v.partial = true
+			if v.drainPoint() >= share {
+				return PoPDraining
+			}
+		}
+	}
+	return PoPUp
+}
+
+// answer the query again avoiding PoPs that are not up: the matched rule's PoP and backup are tried first,
+// then those of the rules above it, nearest first. The first PoP that is up wins, otherwise the first draining one,
+// and when every candidate is down the matched rule's PoP stays.
+// A failover answer depends on the backups of all rules on the way, so its scope is narrowed to the range
+// below the last trie node on the searched address' path, where no other rule can differ.
+func failover(root *TrieNode, ecs *net.IPNet, searchIP net.IP, clock Clock, health *healthView) (pop uint16, scope int) {
+	lt := lookupTime{clock: clock}
+	// rules in effect on the searched address' path, broadest first
+	var rules []*RuleInfo
+	currentNode, depth := root, 0
+	for {
+		if currentNode.ruleInfo != nil && lt.active(currentNode.ruleInfo) {
+			rules = append(rules, currentNode.ruleInfo)
+		}
+		if depth == 128 {
+			break
+		}
+		bit, _ := getBit(searchIP, uint8(depth))
+		if currentNode.children[bit] == nil {
+			break
+		}
+		currentNode = currentNode.children[bit]
+		depth++
+	}
+	// the answer holds for the range of the last node if nothing branches off below it, else for the empty half next to it
+	scope = depth
+	if hasChildren(currentNode) {
+		scope = depth + 1
+	}
+
+	ecsDependent := false
+	bestState := PoPDown + 1
+	for i := len(rules) - 1; i >= 0 && bestState != PoPUp; i-- {
+		target := rules[i].target
+		candidates := []uint16{target.pick(ecs)}
+		if target.Weighted() {
+			ecsDependent = true
+		}
+		if backup, ok := target.Backup(); ok {
+			candidates = append(candidates, backup)
+		}
+		for _, candidate := range candidates {
+			if state := health.state(candidate); state < bestState {
+				pop, bestState = candidate, state
+				if state == PoPUp {
+					break
+				}
+			}
+		}
+	}
+	if ecsDependent || health.partial {
+		ones, bits := ecs.Mask.Size()
+		scope = max(scope, ones+128-bits)
+	}
+	return pop, scope
+}
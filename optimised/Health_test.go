@@ -0,0 +1,129 @@
+package optimised
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadString(t *testing.T, content string) *Data {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "routing.txt")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	data := NewData()
+	if err := data.LoadRoutingData(filePath); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	return data
+}
+
+func TestHealthStates(t *testing.T) {
+	h := NewHealth()
+	if h.State(1) != PoPUp || len(h.States()) != 0 {
+		t.Fatal("expected every PoP to start up")
+	}
+	if previous := h.Set(1, PoPDown); previous != PoPUp {
+		t.Errorf("Set: got previous %s, want up", previous)
+	}
+	h.Set(2, PoPDraining)
+	if previous := h.Set(1, PoPUp); previous != PoPDown {
+		t.Errorf("Set: got previous %s, want down", previous)
+	}
+	if states := h.States(); len(states) != 1 || states[2] != PoPDraining {
+		t.Errorf("States: got %v", states)
+	}
+
+	for _, name := range []string{"up", "draining", "down"} {
+		if state, err := ParsePoPState(name); err != nil || state.String() != name {
+			t.Errorf("ParsePoPState(%s): got %s %v", name, state, err)
+		}
+	}
+	if _, err := ParsePoPState("sideways"); err == nil {
+		t.Error("expected error for unknown state")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// the /48s inside the /32 have no backup of their own except for bbbb
+	data := loadString(t, `
+2001:db8::/32 1 backup=2
+2001:db8:aaaa::/48 1
+2001:db8:bbbb::/48 1 backup=3
+2001:db9::/32 4
+`)
+	health := NewHealth()
+	data.SetHealth(health)
+
+	checkRoute(t, data, "2001:db8:aaaa::/56", 1, 48)
+	health.Set(1, PoPDown)
+	tests := []struct {
+		ecs   string
+		pop   uint16
+		scope int
+	}{
+		// the rule's own backup
+		{"2001:db8:bbbb::/56", 3, 48},
+		// the nearest rule above with a backup
+		{"2001:db8:aaaa::/56", 2, 48},
+		// the /32's backup, but not for the range of the narrower rules next to the address
+		{"2001:db8:cccc::/56", 2, 34},
+		{"2001:db8:8000::/56", 2, 35},
+		{"2001:db8:a000::/56", 2, 37},
+		// PoPs that are up are unaffected
+		{"2001:db9::/56", 4, 32},
+	}
+	for _, tc := range tests {
+		checkRoute(t, data, tc.ecs, tc.pop, tc.scope)
+	}
+
+	t.Run("Draining", func(t *testing.T) {
+		health.Set(3, PoPDraining)
+		// the up backup of the /32 wins over the draining one of the /48
+		checkRoute(t, data, "2001:db8:bbbb::/56", 2, 48)
+		health.Set(2, PoPDown)
+		// nothing up, draining beats down
+		checkRoute(t, data, "2001:db8:bbbb::/56", 3, 48)
+		health.Set(3, PoPDown)
+		// everything down, the rule's PoP stays
+		checkRoute(t, data, "2001:db8:bbbb::/56", 1, 48)
+		health.Set(2, PoPUp)
+		health.Set(3, PoPUp)
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		weighted := loadString(t, "2001:db8::/32 1:50,2:50 backup=3\n")
+		weighted.SetHealth(health)
+		// PoP 1 is down, subnets picking it fail over to the backup, the others keep PoP 2
+		seen := map[uint16]bool{}
+		for _, ecs := range []string{"2001:db8:1::/48", "2001:db8:2::/48", "2001:db8:3::/48", "2001:db8:4::/48", "2001:db8:5::/48", "2001:db8:6::/48"} {
+			pop, scope := weighted.Route(mustParseCIDR(t, ecs))
+			if (pop != 2 && pop != 3) || scope != 48 {
+				t.Errorf("Route(%s): got pop %d scope %d", ecs, pop, scope)
+			}
+			seen[pop] = true
+		}
+		if !seen[2] || !seen[3] {
+			t.Errorf("expected both the up PoP and the backup, got %v", seen)
+		}
+	})
+
+	t.Run("Minimise", func(t *testing.T) {
+		// backups of narrower rules and of covered rules are kept, descendants with the same target are dropped
+		minimised, err := loadString(t, "2001:db8::/32 1 backup=2\n2001:db8::/33 1\n2001:db8:8000::/33 1 backup=3\n2001:db8:8000::/48 1 backup=3\n").Minimise(false)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got, want := exportString(t, minimised), "2001:db8::/32 1 backup=2\n2001:db8::/33 1\n2001:db8:8000::/33 1 backup=3\n"; got != want {
+			t.Errorf("Minimise:\ngot:\n%swant:\n%s", got, want)
+		}
+		kept, err := loadString(t, "2001:db8::/32 1 backup=2\n2001:db8::/33 1\n2001:db8:8000::/33 1\n").Minimise(true)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got := exportString(t, kept); got != "2001:db8::/32 1 backup=2\n2001:db8::/33 1\n2001:db8:8000::/33 1\n" {
+			t.Errorf("Minimise keeping scope dropped the covered rule with a backup:\n%s", got)
+		}
+	})
+}
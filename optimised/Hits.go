@@ -0,0 +1,90 @@
+package optimised
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// RuleHits is the number of times Route returned a rule within the current window
+type RuleHits struct {
+	Prefix netip.Prefix
+	PoP    uint16
+	Hits   uint64
+}
+
+// HitReport summarises rule usage since the window started
+type HitReport struct {
+	Since time.Time
+	// rules never returned by Route within the window, in address order
+	Unused []RuleHits
+	// the most used rules, most hits first
+	Hottest []RuleHits
+}
+
+// EnableHitCounters turns per rule hit counting in Route on or off, turning it on starts a new window.
+// Counters are atomic per rule so lookups of different rules never contend, counting is off by default.
+func (data *Data) EnableHitCounters(enabled bool) {
+	if enabled && !data.countHits.Load() {
+		data.ResetHitCounters()
+	}
+	data.countHits.Store(enabled)
+}
+
+// HitCountersEnabled reports whether Route counts rule hits
+func (data *Data) HitCountersEnabled() bool {
+	return data.countHits.Load()
+}
+
+// ResetHitCounters zeroes all counters and starts a new window
+func (data *Data) ResetHitCounters() {
+	for _, rule := range data.rules() {
+		rule.info.hits.Store(0)
+	}
+	data.hitsSince.Store(time.Now().UnixNano())
+}
+
+// HitReport lists the rules with zero hits in the current window and the topN rules with the most hits,
+// a negative topN lists none
+func (data *Data) HitReport(topN int) HitReport {
+	var report HitReport
+	if since := data.hitsSince.Load(); since != 0 {
+		report.Since = time.Unix(0, since)
+	}
+
+	var used []RuleHits
+	for _, rule := range data.rules() {
+		hits := RuleHits{Prefix: rule.prefix, PoP: rule.info.target.PoP, Hits: rule.info.hits.Load()}
+		if hits.Hits == 0 {
+			report.Unused = append(report.Unused, hits)
+		} else {
+			used = append(used, hits)
+		}
+	}
+
+	// stable sort keeps address order between rules with the same number of hits
+	sort.SliceStable(used, func(i, j int) bool { return used[i].Hits > used[j].Hits })
+	if topN < len(used) {
+		used = used[:max(topN, 0)]
+	}
+	report.Hottest = used
+	return report
+}
+
+type storedRule struct {
+	prefix netip.Prefix
+	info   *RuleInfo
+}
+
+// collect all rules with their prefixes in address order
+func (data *Data) rules() []storedRule {
+	var rules []storedRule
+	var path [16]byte
+	walk(data.currentRoot(), &path, 0, func(node *TrieNode, path *[16]byte, depth int) bool {
+		if node.ruleInfo != nil {
+			rules = append(rules, storedRule{prefix: pathPrefix(path, depth), info: node.ruleInfo})
+		}
+		return true
+	})
+	return rules
+}
@@ -0,0 +1,86 @@
+package optimised
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestHitCounters(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+	checkInsert(t, data, "2001:db9::/32", 200, "")
+	checkInsert(t, data, "2001:dba::/32", 300, "")
+
+	// counting is off by default
+	checkRoute(t, data, "2001:db9::/64", 200, 32)
+	if report := data.HitReport(10); len(report.Hottest) != 0 || len(report.Unused) != 4 || !report.Since.IsZero() {
+		t.Fatalf("expected no hits while counting is off, got %+v", report)
+	}
+
+	data.EnableHitCounters(true)
+	for i := 0; i < 3; i++ {
+		checkRoute(t, data, "2001:db8:aaaa::/64", 100, 48)
+	}
+	checkRoute(t, data, "2001:db8:bbbb::/64", 100, 32)
+	checkRoute(t, data, "2001:db9::/64", 200, 32)
+	checkRoute(t, data, "2001:db9:1::/64", 200, 32)
+	checkRoute(t, data, "2002::/64", 0, -1)
+
+	report := data.HitReport(2)
+	if report.Since.IsZero() {
+		t.Error("expected window start to be set")
+	}
+	wantHottest := []RuleHits{
+		{Prefix: netip.MustParsePrefix("2001:db8:aaaa::/48"), PoP: 100, Hits: 3},
+		{Prefix: netip.MustParsePrefix("2001:db9::/32"), PoP: 200, Hits: 2},
+	}
+	if len(report.Hottest) != len(wantHottest) || report.Hottest[0] != wantHottest[0] || report.Hottest[1] != wantHottest[1] {
+		t.Errorf("Hottest: got %+v, want %+v", report.Hottest, wantHottest)
+	}
+	if len(report.Unused) != 1 || report.Unused[0].Prefix != netip.MustParsePrefix("2001:dba::/32") {
+		t.Errorf("Unused: got %+v, want only 2001:dba::/32", report.Unused)
+	}
+	if report := data.HitReport(-1); len(report.Hottest) != 0 || len(report.Unused) != 1 {
+		t.Errorf("negative topN: got %+v, want no hottest rules", report)
+	}
+
+	t.Run("Reset", func(t *testing.T) {
+		data.ResetHitCounters()
+		if report := data.HitReport(10); len(report.Hottest) != 0 || len(report.Unused) != 4 {
+			t.Errorf("expected all rules unused after reset, got %+v", report)
+		}
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		data.EnableHitCounters(false)
+		checkRoute(t, data, "2001:dba::/64", 300, 32)
+		if report := data.HitReport(10); len(report.Hottest) != 0 {
+			t.Errorf("expected no hits while counting is off, got %+v", report.Hottest)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		data.EnableHitCounters(true)
+		ecs := mustParseCIDR(t, "2001:db8:aaaa::/64")
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					data.Route(ecs)
+				}
+			}()
+		}
+		// reports may run alongside lookups
+		data.HitReport(1)
+		wg.Wait()
+
+		report := data.HitReport(1)
+		if len(report.Hottest) != 1 || report.Hottest[0].Hits != 8000 {
+			t.Errorf("expected 8000 hits on the /48, got %+v", report.Hottest)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package optimised
+
+import (
+	"iter"
+	"net/netip"
+)
+
+// All yields every rule as its prefix and PoP ID in address order (broader prefix before the narrower ones it contains),
+// weighted rules yield their primary PoP
+func (data *Data) All() iter.Seq2[netip.Prefix, uint16] {
+	return primaryPoPs(allRules(data.currentRoot()))
+}
+
+// Targets yields every rule as its prefix and target in address order, like All
+func (data *Data) Targets() iter.Seq2[netip.Prefix, Target] {
+	return allRules(data.currentRoot())
+}
+
+func allRules(root *TrieNode) iter.Seq2[netip.Prefix, Target] {
+	return func(yield func(netip.Prefix, Target) bool) {
+		var path [16]byte
+		walk(root, &path, 0, func(node *TrieNode, path *[16]byte, depth int) bool {
+			if node.ruleInfo == nil {
+				return true
+			}
+			return yield(pathPrefix(path, depth), node.ruleInfo.target)
+		})
+	}
+}
+
+// Covering yields the rules whose prefix contains prefix (a rule for prefix itself included), broadest first.
+// These are the rules Route falls back through for addresses in prefix. Non IPv6 prefixes yield nothing.
+func (data *Data) Covering(prefix netip.Prefix) iter.Seq2[netip.Prefix, uint16] {
+	return primaryPoPs(coveringRules(data.currentRoot(), prefix))
+}
+
+func (m *mutation) covering(prefix netip.Prefix) iter.Seq2[netip.Prefix, Target] {
+	return coveringRules(m.root, prefix)
+}
+
+func coveringRules(root *TrieNode, prefix netip.Prefix) iter.Seq2[netip.Prefix, Target] {
+	return func(yield func(netip.Prefix, Target) bool) {
+		if !isIPv6Prefix(prefix) {
+			return
+		}
+		prefix = prefix.Masked()
+		ip := prefix.Addr().As16()
+
+		currentNode := root
+		for depth := 0; currentNode != nil; depth++ {
+			if currentNode.ruleInfo != nil {
+				if !yield(netip.PrefixFrom(prefix.Addr(), depth).Masked(), currentNode.ruleInfo.target) {
+					return
+				}
+			}
+			if depth == prefix.Bits() {
+				return
+			}
+			bit, _ := getBit(ip[:], uint8(depth))
+			currentNode = currentNode.children[bit]
+		}
+	}
+}
+
+// Within yields the rules whose prefix is contained in prefix (a rule for prefix itself included) in address order.
+// Non IPv6 prefixes yield nothing.
+func (data *Data) Within(prefix netip.Prefix) iter.Seq2[netip.Prefix, uint16] {
+	return primaryPoPs(withinRules(data.currentRoot(), prefix))
+}
+
+// WithinTargets yields the rules inside prefix with their targets, like Within
+func (data *Data) WithinTargets(prefix netip.Prefix) iter.Seq2[netip.Prefix, Target] {
+	return withinRules(data.currentRoot(), prefix)
+}
+
+func (m *mutation) within(prefix netip.Prefix) iter.Seq2[netip.Prefix, Target] {
+	return withinRules(m.root, prefix)
+}
+
+func withinRules(root *TrieNode, prefix netip.Prefix) iter.Seq2[netip.Prefix, Target] {
+	return func(yield func(netip.Prefix, Target) bool) {
+		currentNode := root
+		if currentNode == nil || !isIPv6Prefix(prefix) {
+			return
+		}
+		prefix = prefix.Masked()
+		path := prefix.Addr().As16()
+
+		// follow the prefix down to its node, nothing stored if the path ends early
+		for depth := 0; depth < prefix.Bits(); depth++ {
+			bit, _ := getBit(path[:], uint8(depth))
+			currentNode = currentNode.children[bit]
+			if currentNode == nil {
+				return
+			}
+		}
+
+		walk(currentNode, &path, prefix.Bits(), func(node *TrieNode, path *[16]byte, depth int) bool {
+			if node.ruleInfo == nil {
+				return true
+			}
+			return yield(pathPrefix(path, depth), node.ruleInfo.target)
+		})
+	}
+}
+
+// map rules to their primary PoP for the PoP ID based iterators
+func primaryPoPs(rules iter.Seq2[netip.Prefix, Target]) iter.Seq2[netip.Prefix, uint16] {
+	return func(yield func(netip.Prefix, uint16) bool) {
+		for prefix, target := range rules {
+			if !yield(prefix, target.PoP) {
+				return
+			}
+		}
+	}
+}
+
+// the trie only stores IPv6 prefixes (IPv4-mapped included)
+func isIPv6Prefix(prefix netip.Prefix) bool {
+	return prefix.IsValid() && prefix.Addr().Is6() && prefix.Addr().Zone() == ""
+}
@@ -0,0 +1,108 @@
+package optimised
+
+import (
+	"fmt"
+	"iter"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// collect an iterator into "prefix pop" strings
+func collectRules(seq iter.Seq2[netip.Prefix, uint16]) []string {
+	var rules []string
+	for prefix, popID := range seq {
+		rules = append(rules, fmt.Sprintf("%s %d", prefix, popID))
+	}
+	return rules
+}
+
+func iteratorTestData(t *testing.T) *Data {
+	t.Helper()
+	data := NewData()
+	checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+	checkInsert(t, data, "2001:db9::/32", 200, "")
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	checkInsert(t, data, "2001:db8:aaaa:bb00::/56", 100, "")
+	checkInsert(t, data, "2001:db8:1::/48", 100, "")
+	return data
+}
+
+func TestAll(t *testing.T) {
+	data := iteratorTestData(t)
+	want := []string{
+		"2001:db8::/32 100",
+		"2001:db8:1::/48 100",
+		"2001:db8:aaaa::/48 100",
+		"2001:db8:aaaa:bb00::/56 100",
+		"2001:db9::/32 200",
+	}
+	if got := collectRules(data.All()); !slices.Equal(got, want) {
+		t.Errorf("All():\ngot  %v\nwant %v", got, want)
+	}
+
+	t.Run("EarlyStop", func(t *testing.T) {
+		var got []netip.Prefix
+		for prefix := range data.All() {
+			got = append(got, prefix)
+			if len(got) == 2 {
+				break
+			}
+		}
+		if len(got) != 2 {
+			t.Errorf("expected iteration to stop after 2 rules, got %v", got)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if got := collectRules(NewData().All()); len(got) != 0 {
+			t.Errorf("expected no rules, got %v", got)
+		}
+	})
+}
+
+func TestCovering(t *testing.T) {
+	data := iteratorTestData(t)
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"2001:db8:aaaa:bb00::/64", []string{"2001:db8::/32 100", "2001:db8:aaaa::/48 100", "2001:db8:aaaa:bb00::/56 100"}},
+		{"2001:db8:aaaa::/48", []string{"2001:db8::/32 100", "2001:db8:aaaa::/48 100"}},
+		{"2001:db8:cccc::1/128", []string{"2001:db8::/32 100"}},
+		{"2001:db8::/16", nil},
+		{"2002::/64", nil},
+		{"10.0.0.0/8", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.prefix, func(t *testing.T) {
+			got := collectRules(data.Covering(netip.MustParsePrefix(tc.prefix)))
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("Covering(%s):\ngot  %v\nwant %v", tc.prefix, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	data := iteratorTestData(t)
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"2001:db8:aaaa::/48", []string{"2001:db8:aaaa::/48 100", "2001:db8:aaaa:bb00::/56 100"}},
+		{"2001:db8::/31", []string{"2001:db8::/32 100", "2001:db8:1::/48 100", "2001:db8:aaaa::/48 100", "2001:db8:aaaa:bb00::/56 100", "2001:db9::/32 200"}},
+		// unmasked prefix is masked first
+		{"2001:db8:aaaa:bb00::1/56", []string{"2001:db8:aaaa:bb00::/56 100"}},
+		{"2001:db8:cccc::/48", nil},
+		{"10.0.0.0/8", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.prefix, func(t *testing.T) {
+			got := collectRules(data.Within(netip.MustParsePrefix(tc.prefix)))
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("Within(%s):\ngot  %v\nwant %v", tc.prefix, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package optimised
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrJournal wraps errors of the journal, the change was not published
+var ErrJournal = errors.New("journal failed")
+
+// Change is a single rule change as recorded in a journal, an insert replaces the target of an existing rule
+type Change struct {
+	Prefix netip.Prefix
+	PoP    uint16
+	Delete bool
+	// window of an inserted rule, zero for an open end (see Target.WithWindow)
+	NotBefore, NotAfter time.Time
+	// weighted set of an inserted rule replacing PoP, nil for a single PoP (see NewWeightedTarget)
+	Weights []Weight
+	// backup PoP of an inserted rule, only meaningful with HasBackup
+	Backup    uint16
+	HasBackup bool
+}
+
+func (c Change) String() string {
+	if c.Delete {
+		return "delete " + c.Prefix.String()
+	}
+	target, err := c.target()
+	if err != nil {
+		return fmt.Sprintf("insert %s (%v)", c.Prefix, err)
+	}
+	return fmt.Sprintf("insert %s %s", c.Prefix, target)
+}
+
+// the target an insert stores
+func (c Change) target() (Target, error) {
+	target := Target{PoP: c.PoP}
+	if c.Weights != nil {
+		var err error
+		if target, err = NewWeightedTarget(c.Weights); err != nil {
+			return Target{}, err
+		}
+	}
+	if c.HasBackup {
+		target = target.WithBackup(c.Backup)
+	}
+	return target.WithWindow(c.NotBefore, c.NotAfter), nil
+}
+
+// the change inserting prefix -> target
+func insertChange(prefix netip.Prefix, target Target) Change {
+	notBefore, notAfter := target.Window()
+	backup, hasBackup := target.Backup()
+	return Change{Prefix: prefix, PoP: target.PoP, NotBefore: notBefore, NotAfter: notAfter,
+		Weights: target.Weights(), Backup: backup, HasBackup: hasBackup}
+}
+
+// Journal makes changes durable before they are published, e.g. a write-ahead log replayed at startup.
+// It records the changes made on top of the base table, the rules as last loaded from the routing data file,
+// so that the file can be edited and reloaded without losing them.
+// Its methods are called while changes are serialised, an error aborts the change and the table stays as it was.
+type Journal interface {
+	// Append records changes applied in order on top of the journaled table (one Insert, Update, Delete or transaction)
+	Append(changes []Change) error
+	// Reset replaces all records by changes turning the base table into the current one
+	// (load, reload, rollback, compaction), the previous records are no longer needed
+	Reset(changes []Change) error
+}
+
+// SetJournal installs the journal, nil removes it. Set it before the table is shared between goroutines.
+func (data *Data) SetJournal(journal Journal) {
+	data.journal = journal
+}
+
+// CompactJournal resets the journal to the difference between the base table and the current one,
+// no change can happen meanwhile
+func (data *Data) CompactJournal() error {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+	if data.journal == nil {
+		return nil
+	}
+	return data.journal.Reset(changesBetween(data.base, data.currentRoot()))
+}
+
+// Replay publishes changes read back from a journal on top of the table, validated and published together
+// like a transaction. Deleting a rule that does not exist is skipped rather than rejected: the routing data file
+// the changes were made on top of may have dropped it since.
+func (data *Data) Replay(source string, changes []Change) error {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+
+	m := data.newMutation()
+	changes, problems := m.apply(changes, true)
+	if len(problems) > 0 {
+		return &TxError{Errors: problems}
+	}
+	return m.commitChanges(source, changes)
+}
+
+// journal the changes made by the mutation and publish it
+func (m *mutation) commitChanges(source string, changes []Change) error {
+	if m.data.journal != nil && len(changes) > 0 {
+		if err := m.data.journal.Append(changes); err != nil {
+			return fmt.Errorf("%w to record changes: %w", ErrJournal, err)
+		}
+	}
+	m.publish(source)
+	return nil
+}
+
+// journal the whole table built by the mutation as changes on top of base and publish it, base becomes the base table
+func (m *mutation) commitTable(source string, base *TrieNode) error {
+	if m.data.journal != nil {
+		if err := m.data.journal.Reset(changesBetween(base, m.root)); err != nil {
+			return fmt.Errorf("%w to record table: %w", ErrJournal, err)
+		}
+	}
+	m.data.base = base
+	m.publish(source)
+	return nil
+}
+
+// the changes turning the rules of from into the rules of to
+func changesBetween(from, to *TrieNode) []Change {
+	var changes []Change
+	var path [16]byte
+	diffRules(from, to, &path, 0, func(prefix netip.Prefix, _, after *RuleInfo) {
+		if after == nil {
+			changes = append(changes, Change{Prefix: prefix, Delete: true})
+			return
+		}
+		changes = append(changes, insertChange(prefix, after.target))
+	})
+	return changes
+}
@@ -0,0 +1,119 @@
+package optimised
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Maintenance is a planned window in which a PoP is taken out of rotation gradually:
+// starting at Start its share of the subnets its rules match drains linearly to none over Drain,
+// stays at none until End and ramps back up linearly over Ramp.
+// Drained subnets fail over like from a draining PoP (see Health), the same subnets drain first every time
+// so resolvers keep their cached answers as the share shrinks.
+type Maintenance struct {
+	// assigned by Health.AddMaintenance
+	ID         uint64
+	PoP        uint16
+	Start, End time.Time
+	Drain      time.Duration
+	Ramp       time.Duration
+}
+
+// Share returns the fraction of the PoP's subnets it keeps at now, 1 outside the window
+func (m Maintenance) Share(now time.Time) float64 {
+	switch {
+	case now.Before(m.Start):
+		return 1
+	case now.Before(m.Start.Add(m.Drain)):
+		return 1 - float64(now.Sub(m.Start))/float64(m.Drain)
+	case now.Before(m.End):
+		return 0
+	case now.Before(m.End.Add(m.Ramp)):
+		return float64(now.Sub(m.End)) / float64(m.Ramp)
+	default:
+		return 1
+	}
+}
+
+// Finished reports whether the PoP has fully ramped back up at now
+func (m Maintenance) Finished(now time.Time) bool {
+	return !now.Before(m.End.Add(m.Ramp))
+}
+
+// AddMaintenance schedules a window and returns it with its ID, finished windows are dropped meanwhile
+// (lookups drop them as well once they finish)
+func (h *Health) AddMaintenance(m Maintenance) (Maintenance, error) {
+	if m.Drain < 0 || m.Ramp < 0 {
+		return Maintenance{}, fmt.Errorf("drain and ramp durations must not be negative")
+	}
+	if m.End.Before(m.Start.Add(m.Drain)) {
+		return Maintenance{}, fmt.Errorf("maintenance of PoP %d ends before it has drained", m.PoP)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastMaintenanceID++
+	m.ID = h.lastMaintenanceID
+	current := h.current.Load()
+	now := h.clock.Now()
+	windows := []Maintenance{m}
+	for _, w := range current.windows {
+		if !w.Finished(now) {
+			windows = append(windows, w)
+		}
+	}
+	slices.SortFunc(windows, func(a, b Maintenance) int { return a.Start.Compare(b.Start) })
+	h.storeWindows(current, windows)
+	return m, nil
+}
+
+// RemoveMaintenance cancels the window with id, the PoP takes its full share again at once
+func (h *Health) RemoveMaintenance(id uint64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.current.Load()
+	windows := slices.DeleteFunc(slices.Clone(current.windows), func(w Maintenance) bool { return w.ID == id })
+	if len(windows) == len(current.windows) {
+		return false
+	}
+	h.storeWindows(current, windows)
+	return true
+}
+
+// drop the windows finished at now and return the state published then,
+// lookups call it once the first window has finished so that they stop evaluating it
+func (h *Health) dropFinished(now time.Time) *healthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.current.Load()
+	if len(current.windows) == 0 || now.Before(current.nextFinish) {
+		return current // dropped by another lookup meanwhile
+	}
+	h.storeWindows(current, slices.DeleteFunc(slices.Clone(current.windows), func(w Maintenance) bool { return w.Finished(now) }))
+	return h.current.Load()
+}
+
+// publish current with windows (sorted by start) in place of its windows, must be called while holding h.mu
+func (h *Health) storeWindows(current *healthState, windows []Maintenance) {
+	next := *current
+	next.windows, next.nextFinish = windows, time.Time{}
+	for _, w := range windows {
+		if finish := w.End.Add(w.Ramp); next.nextFinish.IsZero() || finish.Before(next.nextFinish) {
+			next.nextFinish = finish
+		}
+	}
+	h.current.Store(&next)
+}
+
+// Maintenance returns the scheduled windows that have not finished yet, by start time
+func (h *Health) Maintenance() []Maintenance {
+	now := h.clock.Now()
+	var windows []Maintenance
+	for _, w := range h.current.Load().windows {
+		if !w.Finished(now) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
@@ -0,0 +1,144 @@
+package optimised
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClock is moved by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestMaintenanceShare(t *testing.T) {
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	m := Maintenance{PoP: 1, Start: start, End: start.Add(2 * time.Hour), Drain: 20 * time.Minute, Ramp: 40 * time.Minute}
+	for _, tc := range []struct {
+		offset time.Duration
+		share  float64
+	}{
+		{-time.Minute, 1},
+		{0, 1},
+		{5 * time.Minute, 0.75},
+		{20 * time.Minute, 0},
+		{time.Hour, 0},
+		{2 * time.Hour, 0},
+		{2*time.Hour + 10*time.Minute, 0.25},
+		{2*time.Hour + 40*time.Minute, 1},
+	} {
+		if got := m.Share(start.Add(tc.offset)); math.Abs(got-tc.share) > 1e-9 {
+			t.Errorf("Share at %s: got %f, want %f", tc.offset, got, tc.share)
+		}
+	}
+	if m.Finished(start.Add(2*time.Hour+39*time.Minute)) || !m.Finished(start.Add(2*time.Hour+40*time.Minute)) {
+		t.Error("expected the window to finish once ramped back up")
+	}
+}
+
+func TestMaintenanceRouting(t *testing.T) {
+	data := loadString(t, "2001:db8::/32 1 backup=2\n2001:db9::/32 3\n")
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(-time.Hour)}
+	health := NewHealth()
+	health.SetClock(clock)
+	data.SetHealth(health)
+
+	m, err := health.AddMaintenance(Maintenance{PoP: 1, Start: start, End: start.Add(time.Hour), Drain: 10 * time.Minute, Ramp: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("AddMaintenance failed: %v", err)
+	}
+
+	const subnets = 4000
+	ecs := make([]string, subnets)
+	for i := range ecs {
+		ecs[i] = fmt.Sprintf("2001:db8:%x:%x::/64", i>>8, i&0xff)
+	}
+	// subnets on the backup, checking the scope of every answer on the way
+	drained := func() map[string]bool {
+		result := map[string]bool{}
+		for _, subnet := range ecs {
+			pop, scope := data.Route(mustParseCIDR(t, subnet))
+			share := m.Share(clock.now)
+			wantScope := 32
+			if share > 0 && share < 1 {
+				wantScope = 64
+			}
+			if scope != wantScope {
+				t.Fatalf("Route(%s) at share %f: got scope %d, want %d", subnet, share, scope, wantScope)
+			}
+			if pop == 2 {
+				result[subnet] = true
+			}
+		}
+		return result
+	}
+
+	if got := len(drained()); got != 0 {
+		t.Fatalf("before the window: %d subnets drained", got)
+	}
+	var previous map[string]bool
+	for _, minutes := range []int{0, 3, 5, 8, 10, 30, 60, 65, 70} {
+		clock.now = start.Add(time.Duration(minutes) * time.Minute)
+		current := drained()
+		wantFraction := 1 - m.Share(clock.now)
+		if fraction := float64(len(current)) / subnets; math.Abs(fraction-wantFraction) > 0.03 {
+			t.Errorf("after %d minutes: %.3f of the subnets drained, want %.3f", minutes, fraction, wantFraction)
+		}
+		// while draining the drained subnets only grow, while ramping up they only shrink
+		if previous != nil {
+			grow, shrink := previous, current
+			if minutes > 60 {
+				grow, shrink = current, previous
+			}
+			for subnet := range grow {
+				if !shrink[subnet] {
+					t.Fatalf("after %d minutes: %s moved against the drain direction", minutes, subnet)
+				}
+			}
+		}
+		previous = current
+	}
+	// other PoPs are not affected
+	checkRoute(t, data, "2001:db9::/56", 3, 32)
+	// the lookups dropped the finished window, they no longer evaluate it
+	if windows := health.current.Load().windows; len(windows) != 0 {
+		t.Errorf("finished windows kept: %+v", windows)
+	}
+
+	t.Run("Cancel", func(t *testing.T) {
+		clock.now = start.Add(30 * time.Minute)
+		m, err := health.AddMaintenance(m)
+		if err != nil {
+			t.Fatalf("AddMaintenance failed: %v", err)
+		}
+		checkRoute(t, data, "2001:db8::/64", 2, 32)
+		if len(health.Maintenance()) != 1 || !health.RemoveMaintenance(m.ID) || health.RemoveMaintenance(m.ID) {
+			t.Fatal("expected to cancel the window exactly once")
+		}
+		checkRoute(t, data, "2001:db8::/64", 1, 32)
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		if _, err := health.AddMaintenance(Maintenance{PoP: 1, Start: start, End: start.Add(time.Minute), Drain: time.Hour}); err == nil {
+			t.Error("expected error for a window ending before it has drained")
+		}
+		if _, err := health.AddMaintenance(Maintenance{PoP: 1, Start: start, End: start, Ramp: -time.Minute}); err == nil {
+			t.Error("expected error for a negative ramp")
+		}
+		// finished windows are dropped
+		clock.now = start.Add(2 * time.Hour)
+		if _, err := health.AddMaintenance(Maintenance{PoP: 4, Start: start, End: start.Add(time.Hour)}); err != nil {
+			t.Fatalf("AddMaintenance failed: %v", err)
+		}
+		next, _ := health.AddMaintenance(Maintenance{PoP: 5, Start: clock.now, End: clock.now.Add(time.Hour)})
+		if windows := health.Maintenance(); len(windows) != 1 || windows[0] != next {
+			t.Errorf("got windows %+v, want only %+v", windows, next)
+		}
+	})
+}
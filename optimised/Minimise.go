@@ -0,0 +1,135 @@
+package optimised
+
+import (
+	"fmt"
+)
+
+// Minimise builds a new table that gives the same PoP for every address as data, using as few rules as possible.
+// With keepScope the returned scope stays the same for every address as well, so only rules that can never be
+// the longest match (their whole range is covered by narrower rules) are dropped.
+// Without keepScope same-PoP descendants are dropped and sibling prefixes with the same PoP are merged into their parent.
+func (data *Data) Minimise(keepScope bool) (*Data, error) {
+	minimised := NewData()
+	root := data.currentRoot()
+	if root == nil {
+		return minimised, nil
+	}
+
+	// build the whole table in one mutation, new nodes are then filled in place
+	minimised.writeMu.Lock()
+	defer minimised.writeMu.Unlock()
+	m := minimised.newMutation()
+
+	var path [16]byte
+	var err error
+	if keepScope {
+		emitLiveRules(root, &path, 0, func(path *[16]byte, depth int, target Target) {
+			if err == nil {
+				err = m.insert(pathPrefix(path, depth), target, false)
+			}
+		})
+	} else {
+		emit := func(path *[16]byte, depth int, target Target) {
+			if err == nil {
+				err = m.insert(pathPrefix(path, depth), target, false)
+			}
+		}
+		// the whole table resolves to one PoP -> a single default rule
+		if target, uniform := emitMergedRules(root, &path, 0, Target{}, false, emit); uniform {
+			emit(&path, 0, target)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build minimised table: %w", err)
+	}
+	m.publish(fmt.Sprintf("minimise, keep scope %t", keepScope))
+	return minimised, nil
+}
+
+// emit every rule that is the longest match for at least one address at some time,
+// returns whether every address below node is matched by some permanent rule in its subtree
+// (a rule with a window leaves its range to the rules above it outside the window)
+func emitLiveRules(node *TrieNode, path *[16]byte, depth int, emit func(path *[16]byte, depth int, target Target)) bool {
+	if node == nil {
+		return false
+	}
+	if depth >= 128 {
+		if node.ruleInfo != nil {
+			emit(path, depth, node.ruleInfo.target)
+			return !node.ruleInfo.target.timed()
+		}
+		return false
+	}
+
+	byteIndex := depth / 8
+	bitMask := byte(1) << (7 - depth%8)
+	leftCovered := emitLiveRules(node.children[0], path, depth+1, emit)
+	path[byteIndex] |= bitMask
+	rightCovered := emitLiveRules(node.children[1], path, depth+1, emit)
+	path[byteIndex] &^= bitMask
+
+	if node.ruleInfo == nil {
+		return leftCovered && rightCovered
+	}
+	// both halves answered by narrower rules -> this rule is never returned, drop it,
+	// unless its backup PoP is what the narrower rules fail over to
+	if _, hasBackup := node.ruleInfo.target.Backup(); !leftCovered || !rightCovered || hasBackup {
+		emit(path, depth, node.ruleInfo.target)
+	}
+	return !node.ruleInfo.target.timed() || (leftCovered && rightCovered)
+}
+
+// emit the smallest set of prefixes covering the same ranges with the same targets,
+// returns the target when the whole range below node resolves to it so that the parent can merge it,
+// inherited is the target of the nearest rule above (uniform reports whether there is one).
+// Thanks to the conflict checks everything below a rule shares its PoPs, only descendants with another backup PoP
+// or another window (which may route elsewhere) are kept.
+func emitMergedRules(node *TrieNode, path *[16]byte, depth int, inherited Target, inheritedUniform bool, emit func(path *[16]byte, depth int, target Target)) (target Target, uniform bool) {
+	if node == nil {
+		return inherited, inheritedUniform
+	}
+	if node.ruleInfo != nil {
+		inherited, inheritedUniform = node.ruleInfo.target, true
+	}
+	if depth >= 128 {
+		return inherited, inheritedUniform
+	}
+
+	byteIndex := depth / 8
+	bitMask := byte(1) << (7 - depth%8)
+	leftTarget, leftUniform := emitMergedRules(node.children[0], path, depth+1, inherited, inheritedUniform, emit)
+	path[byteIndex] |= bitMask
+	rightTarget, rightUniform := emitMergedRules(node.children[1], path, depth+1, inherited, inheritedUniform, emit)
+	path[byteIndex] &^= bitMask
+
+	if node.ruleInfo != nil {
+		// the rule answers its whole range, descendants were already emitted unless they are uniform,
+		// uniform halves only need a rule of their own when they differ from it
+		target = node.ruleInfo.target
+		if leftUniform && leftTarget != target {
+			emit(path, depth+1, leftTarget)
+		}
+		if rightUniform && rightTarget != target {
+			path[byteIndex] |= bitMask
+			emit(path, depth+1, rightTarget)
+			path[byteIndex] &^= bitMask
+		}
+		return target, true
+	}
+
+	// siblings with the same PoP -> let the parent decide whether to merge further
+	if leftUniform && rightUniform && leftTarget == rightTarget {
+		return leftTarget, true
+	}
+
+	// halves can not be merged, emit whichever is uniform on its own (the rule above already covers its own target)
+	if leftUniform && !(inheritedUniform && leftTarget == inherited) {
+		emit(path, depth+1, leftTarget)
+	}
+	if rightUniform && !(inheritedUniform && rightTarget == inherited) {
+		path[byteIndex] |= bitMask
+		emit(path, depth+1, rightTarget)
+		path[byteIndex] &^= bitMask
+	}
+	return Target{}, false
+}
@@ -0,0 +1,100 @@
+package optimised
+
+import (
+	"bytes"
+	"testing"
+)
+
+// exportString dumps data in routing file format for comparisons
+func exportString(t *testing.T, data *Data) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := data.WriteRoutingData(&buf); err != nil {
+		t.Fatalf("WriteRoutingData failed: %v", err)
+	}
+	return buf.String()
+}
+
+func TestMinimise(t *testing.T) {
+	t.Run("MergeSiblings", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/33", 100, "")
+		checkInsert(t, data, "2001:db8:8000::/33", 100, "")
+		checkInsert(t, data, "2001:db9::/32", 200, "")
+
+		minimised, err := data.Minimise(false)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		want := "2001:db8::/32 100\n2001:db9::/32 200\n"
+		if got := exportString(t, minimised); got != want {
+			t.Errorf("Minimise(false):\ngot:\n%swant:\n%s", got, want)
+		}
+	})
+
+	t.Run("MergeAcrossLevels", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/34", 100, "")
+		checkInsert(t, data, "2001:db8:4000::/34", 100, "")
+		checkInsert(t, data, "2001:db8:8000::/33", 100, "")
+
+		minimised, err := data.Minimise(false)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got, want := exportString(t, minimised), "2001:db8::/32 100\n"; got != want {
+			t.Errorf("Minimise(false):\ngot:\n%swant:\n%s", got, want)
+		}
+	})
+
+	t.Run("DropDescendants", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa:bb00::/56", 100, "")
+
+		minimised, err := data.Minimise(false)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got, want := exportString(t, minimised), "2001:db8::/32 100\n"; got != want {
+			t.Errorf("Minimise(false):\ngot:\n%swant:\n%s", got, want)
+		}
+		checkRoute(t, minimised, "2001:db8:aaaa:bb00::/64", 100, 32)
+		checkRoute(t, minimised, "2001:db9::/64", 0, -1)
+	})
+
+	t.Run("KeepScope", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		// /40 is fully covered by its two /41 halves, so it is never the longest match
+		checkInsert(t, data, "2001:db9::/40", 200, "")
+		checkInsert(t, data, "2001:db9::/41", 200, "")
+		checkInsert(t, data, "2001:db9:80::/41", 200, "")
+
+		minimised, err := data.Minimise(true)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		want := "2001:db8::/32 100\n2001:db8:aaaa::/48 100\n2001:db9::/41 200\n2001:db9:80::/41 200\n"
+		if got := exportString(t, minimised); got != want {
+			t.Errorf("Minimise(true):\ngot:\n%swant:\n%s", got, want)
+		}
+
+		for _, ecs := range []string{"2001:db8:aaaa::/64", "2001:db8:bbbb::/64", "2001:db9::/64", "2001:db9:ff::/64", "2001:dba::/64"} {
+			wantPop, wantScope := data.Route(mustParseCIDR(t, ecs))
+			checkRoute(t, minimised, ecs, wantPop, wantScope)
+		}
+	})
+
+	t.Run("EmptyTable", func(t *testing.T) {
+		minimised, err := NewData().Minimise(false)
+		if err != nil {
+			t.Fatalf("Minimise failed: %v", err)
+		}
+		if got := exportString(t, minimised); got != "" {
+			t.Errorf("expected empty output, got %q", got)
+		}
+	})
+}
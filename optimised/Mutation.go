@@ -0,0 +1,273 @@
+package optimised
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrRuleNotFound is returned when updating or deleting a prefix that has no rule
+var ErrRuleNotFound = errors.New("rule not found")
+
+// ErrRoutingDataTarget is returned when a change would replace a rule with weights or a backup,
+// such rules are only changed in the routing data
+var ErrRoutingDataTarget = errors.New("rule has weights or a backup")
+
+// Insert adds the rule prefix -> popID, conflicting rules are reported as *ConflictError
+// and replacing a rule with weights or a backup as ErrRoutingDataTarget.
+// Like all changes it is published atomically, concurrent Route calls see either the old or the new table.
+func (data *Data) Insert(prefix netip.Prefix, popID uint16) error {
+	return data.As(SystemActor).Insert(prefix, popID)
+}
+
+// Update changes the PoP of the existing rule for prefix, ErrRuleNotFound if there is none
+func (data *Data) Update(prefix netip.Prefix, popID uint16) error {
+	return data.As(SystemActor).Update(prefix, popID)
+}
+
+// InsertBounded adds the rule prefix -> popID in effect only from notBefore to notAfter (zero for an open end).
+// Rules whose windows do not overlap never conflict, Route ignores the rule outside its window
+// and RemoveExpired drops it once the window is over.
+func (data *Data) InsertBounded(prefix netip.Prefix, popID uint16, notBefore, notAfter time.Time) error {
+	return data.As(SystemActor).InsertBounded(prefix, popID, notBefore, notAfter)
+}
+
+// UpdateBounded changes the PoP and the window of the existing rule for prefix, ErrRuleNotFound if there is none
+func (data *Data) UpdateBounded(prefix netip.Prefix, popID uint16, notBefore, notAfter time.Time) error {
+	return data.As(SystemActor).UpdateBounded(prefix, popID, notBefore, notAfter)
+}
+
+// Delete removes the rule for prefix, ErrRuleNotFound if there is none
+func (data *Data) Delete(prefix netip.Prefix) error {
+	return data.As(SystemActor).Delete(prefix)
+}
+
+// Rule returns the PoP of the rule stored for exactly prefix (the primary PoP of a weighted rule)
+func (data *Data) Rule(prefix netip.Prefix) (popID uint16, ok bool) {
+	target, ok := data.Target(prefix)
+	return target.PoP, ok
+}
+
+// Target returns the target of the rule stored for exactly prefix
+func (data *Data) Target(prefix netip.Prefix) (target Target, ok bool) {
+	prefix, err := triePrefix(prefix)
+	if err != nil {
+		return Target{}, false
+	}
+	node := (&mutation{root: data.currentRoot()}).find(prefix)
+	if node == nil || node.ruleInfo == nil {
+		return Target{}, false
+	}
+	return node.ruleInfo.target, true
+}
+
+// run a single change as its own mutation and publish it when it succeeds,
+// the verb and the change describe it in the version history, actor made it
+func (data *Data) change(actor, verb string, change Change, apply func(m *mutation, prefix netip.Prefix) error) error {
+	prefix, err := triePrefix(change.Prefix)
+	if err != nil {
+		return err
+	}
+	change.Prefix = prefix
+
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+
+	m := data.newMutation()
+	m.actor = actor
+	if err := apply(m, prefix); err != nil {
+		return err
+	}
+	source := verb + " " + prefix.String()
+	if !change.Delete {
+		target, _ := change.target()
+		source += " " + target.String()
+	}
+	// the journal only knows upserts, an update is recorded as an insert
+	return m.commitChanges(source, []Change{change})
+}
+
+// the trie only stores IPv6 prefixes, always masked
+func triePrefix(prefix netip.Prefix) (netip.Prefix, error) {
+	if !isIPv6Prefix(prefix) {
+		return netip.Prefix{}, fmt.Errorf("expected IPv6 prefix, got %s", prefix)
+	}
+	return prefix.Masked(), nil
+}
+
+// mutation changes the trie copy-on-write so that lookups running meanwhile are never affected.
+// Nodes of the published trie are never modified: each node on a changed path is copied once,
+// the copies are owned by the mutation and modified in place until publish swaps in the new root.
+// A mutation must only be used while holding data.writeMu.
+type mutation struct {
+	data  *Data
+	root  *TrieNode
+	owned map[*TrieNode]struct{}
+	// who the published change is attributed to in the audit trail
+	actor string
+}
+
+func (data *Data) newMutation() *mutation {
+	return &mutation{data: data, root: data.root.Load(), owned: map[*TrieNode]struct{}{}, actor: SystemActor}
+}
+
+// drop all rules, the mutation continues from an empty trie
+func (m *mutation) clear() {
+	m.root = nil
+}
+
+// make the trie built by the mutation the one lookups use and record it as a new version described by source
+func (m *mutation) publish(source string) {
+	if m.root == nil {
+		m.root = &TrieNode{}
+	}
+	previous := m.data.root.Swap(m.root)
+	m.data.recordVersion(m.root, source)
+	m.data.audit(previous, m.root, m.actor, source)
+}
+
+// return a node that may be modified in place, copying it unless the mutation already owns it (nil -> new node)
+func (m *mutation) own(node *TrieNode) *TrieNode {
+	if node == nil {
+		node = &TrieNode{}
+	} else if _, ok := m.owned[node]; ok {
+		return node
+	} else {
+		nodeCopy := *node
+		node = &nodeCopy
+	}
+	m.owned[node] = struct{}{}
+	return node
+}
+
+// copy the path down to prefix (creating missing nodes) and return the owned nodes from the root to prefix's node
+func (m *mutation) ownPath(prefix netip.Prefix) []*TrieNode {
+	ip := prefix.Addr().As16()
+	path := make([]*TrieNode, 0, prefix.Bits()+1)
+
+	m.root = m.own(m.root)
+	currentNode := m.root
+	path = append(path, currentNode)
+	for i := 0; i < prefix.Bits(); i++ {
+		bit, _ := getBit(ip[:], uint8(i))
+		child := m.own(currentNode.children[bit])
+		currentNode.children[bit] = child
+		currentNode = child
+		path = append(path, currentNode)
+	}
+	return path
+}
+
+// find the node for prefix without modifying anything, nil if the path does not exist
+func (m *mutation) find(prefix netip.Prefix) *TrieNode {
+	ip := prefix.Addr().As16()
+	currentNode := m.root
+	for i := 0; i < prefix.Bits() && currentNode != nil; i++ {
+		bit, _ := getBit(ip[:], uint8(i))
+		currentNode = currentNode.children[bit]
+	}
+	return currentNode
+}
+
+// check that prefix -> target does not conflict with any rule, an existing rule for prefix itself is only
+// a conflict when not replacing it. Identical weighted sets do not conflict, like identical single PoPs,
+// and nested rules may have different backup PoPs.
+func (m *mutation) checkConflicts(prefix netip.Prefix, target Target, replace bool) error {
+	ip := prefix.Addr().As16()
+
+	// ancestor conflicts check
+	currentNode := m.root
+	for i := 0; i < prefix.Bits() && currentNode != nil; i++ {
+		if currentNode.ruleInfo != nil && currentNode.ruleInfo.target.conflictsWith(target) {
+			// conflict found -> broader rule with different PoP ID exists
+			return newConflictError(ConflictBroader, prefix, target, netip.PrefixFrom(prefix.Addr(), i).Masked(), currentNode.ruleInfo.target)
+		}
+		bit, _ := getBit(ip[:], uint8(i))
+		currentNode = currentNode.children[bit]
+	}
+	if currentNode == nil {
+		// nothing at or below prefix yet
+		return nil
+	}
+
+	if !replace {
+		if err := checkSameNodeConflict(currentNode, prefix, target); err != nil {
+			return err
+		}
+	}
+
+	if conflict, conflictTarget, found := checkDescendantConflicts(currentNode, ip, prefix.Bits(), target); found {
+		// conflict found -> narrower rule with different PoP ID exists
+		return newConflictError(ConflictNarrower, prefix, target, conflict, conflictTarget)
+	}
+	return nil
+}
+
+// reject replacing a rule with weights or a backup by a different target, the changes made through the API
+// only carry a single PoP and would silently drop them
+func (m *mutation) checkRoutingDataTarget(prefix netip.Prefix, target Target) error {
+	existing := m.find(prefix)
+	if existing == nil || existing.ruleInfo == nil || existing.ruleInfo.target == target {
+		return nil
+	}
+	if _, hasBackup := existing.ruleInfo.target.Backup(); existing.ruleInfo.target.Weighted() || hasBackup {
+		return fmt.Errorf("cannot replace %s -> %s, change it in the routing data: %w", prefix, existing.ruleInfo.target, ErrRoutingDataTarget)
+	}
+	return nil
+}
+
+// add the rule prefix -> target, with replace the rule must already exist and gets its target changed
+func (m *mutation) insert(prefix netip.Prefix, target Target, replace bool) error {
+	existing := m.find(prefix)
+	if replace && (existing == nil || existing.ruleInfo == nil) {
+		return fmt.Errorf("cannot update %s: %w", prefix, ErrRuleNotFound)
+	}
+	if err := target.checkWindow(); err != nil {
+		return err
+	}
+	if err := m.checkConflicts(prefix, target, replace); err != nil {
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			return m.data.conflict(err)
+		}
+		return err
+	}
+	// no conflicts
+	m.set(prefix, target)
+	return nil
+}
+
+// store prefix -> target without any conflict checks, an identical stored rule is kept (with its hit counter)
+func (m *mutation) set(prefix netip.Prefix, target Target) {
+	if existing := m.find(prefix); existing != nil && existing.ruleInfo != nil && existing.ruleInfo.target == target {
+		return
+	}
+	path := m.ownPath(prefix)
+	path[len(path)-1].ruleInfo = &RuleInfo{
+		target: target,
+		scope:  prefix.Bits(),
+	}
+}
+
+// remove the rule for prefix and the nodes that are left without any purpose
+func (m *mutation) remove(prefix netip.Prefix) error {
+	if existing := m.find(prefix); existing == nil || existing.ruleInfo == nil {
+		return fmt.Errorf("cannot delete %s: %w", prefix, ErrRuleNotFound)
+	}
+
+	path := m.ownPath(prefix)
+	path[len(path)-1].ruleInfo = nil
+
+	// prune empty nodes bottom up, the root always stays
+	ip := prefix.Addr().As16()
+	for depth := prefix.Bits(); depth > 0; depth-- {
+		node := path[depth]
+		if node.ruleInfo != nil || node.children[0] != nil || node.children[1] != nil {
+			break
+		}
+		bit, _ := getBit(ip[:], uint8(depth-1))
+		path[depth-1].children[bit] = nil
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package optimised
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestInsertUpdateDelete(t *testing.T) {
+	data := NewData()
+	prefix := netip.MustParsePrefix("2001:db8:aaaa::/48")
+
+	if err := data.Insert(prefix, 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if popID, ok := data.Rule(prefix); !ok || popID != 100 {
+		t.Errorf("Rule(%s): got %d, %v, want 100, true", prefix, popID, ok)
+	}
+	checkRoute(t, data, "2001:db8:aaaa::1/64", 100, 48)
+
+	if err := data.Update(prefix, 200); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	checkRoute(t, data, "2001:db8:aaaa::1/64", 200, 48)
+
+	if err := data.Delete(prefix); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	checkRoute(t, data, "2001:db8:aaaa::1/64", 0, -1)
+	if _, ok := data.Rule(prefix); ok {
+		t.Error("Rule still found after Delete")
+	}
+	// pruning leaves only the empty root behind
+	if stats := data.Stats(); stats.Nodes != 1 {
+		t.Errorf("expected only the root after Delete, got %d nodes", stats.Nodes)
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		if err := data.Update(prefix, 1); !errors.Is(err, ErrRuleNotFound) {
+			t.Errorf("Update of missing rule: got %v, want ErrRuleNotFound", err)
+		}
+		if err := data.Delete(prefix); !errors.Is(err, ErrRuleNotFound) {
+			t.Errorf("Delete of missing rule: got %v, want ErrRuleNotFound", err)
+		}
+	})
+
+	t.Run("NotIPv6", func(t *testing.T) {
+		if err := data.Insert(netip.MustParsePrefix("10.0.0.0/8"), 1); err == nil {
+			t.Error("expected error for IPv4 prefix, got nil")
+		}
+	})
+
+	t.Run("DeleteKeepsNeighbours", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa:bb00::/56", 100, "")
+		if err := data.Delete(netip.MustParsePrefix("2001:db8:aaaa::/48")); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		checkRoute(t, data, "2001:db8:aaaa:bb00::/64", 100, 56)
+		checkRoute(t, data, "2001:db8:aaaa:cc00::/64", 100, 32)
+	})
+
+	t.Run("UpdateConflict", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		err := data.Update(netip.MustParsePrefix("2001:db8::/32"), 200)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("expected ConflictError, got %v", err)
+		}
+		if conflict.Kind != ConflictNarrower || conflict.Existing != netip.MustParsePrefix("2001:db8:aaaa::/48") || conflict.ExistingPoP != 100 {
+			t.Errorf("unexpected conflict %+v", conflict)
+		}
+		checkRoute(t, data, "2001:db8:bbbb::/64", 100, 32)
+	})
+}
+
+func TestConflictError(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	checkInsert(t, data, "2001:db9:aaaa::/48", 200, "")
+
+	tests := []struct {
+		prefix string
+		want   ConflictError
+	}{
+		{"2001:db8:aaaa::/48", ConflictError{Kind: ConflictBroader, Existing: netip.MustParsePrefix("2001:db8::/32"), ExistingPoP: 100}},
+		{"2001:db8::/32", ConflictError{Kind: ConflictExact, Existing: netip.MustParsePrefix("2001:db8::/32"), ExistingPoP: 100}},
+		{"2001:db9::/32", ConflictError{Kind: ConflictNarrower, Existing: netip.MustParsePrefix("2001:db9:aaaa::/48"), ExistingPoP: 200}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.want.Kind.String(), func(t *testing.T) {
+			err := data.Insert(netip.MustParsePrefix(tc.prefix), 300)
+			var conflict *ConflictError
+			if !errors.As(err, &conflict) {
+				t.Fatalf("expected ConflictError, got %v", err)
+			}
+			tc.want.Prefix = netip.MustParsePrefix(tc.prefix)
+			tc.want.PoP = 300
+			if *conflict != tc.want {
+				t.Errorf("got %+v, want %+v", *conflict, tc.want)
+			}
+		})
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+	oldRoot := data.root.Load()
+
+	if err := data.Insert(netip.MustParsePrefix("2001:db8:bbbb::/48"), 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := data.Delete(netip.MustParsePrefix("2001:db8:aaaa::/48")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// the old trie is untouched and still answers like before
+	old := &Data{}
+	old.root.Store(oldRoot)
+	want := []string{"2001:db8::/32 100", "2001:db8:aaaa::/48 100"}
+	if got := collectRules(old.All()); !slices.Equal(got, want) {
+		t.Errorf("old trie changed:\ngot  %v\nwant %v", got, want)
+	}
+	want = []string{"2001:db8::/32 100", "2001:db8:bbbb::/48 100"}
+	if got := collectRules(data.All()); !slices.Equal(got, want) {
+		t.Errorf("new trie:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 100, "")
+	ecs := mustParseCIDR(t, "2001:db8:aaaa::/64")
+	prefix := netip.MustParsePrefix("2001:db8:aaaa::/48")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// every answer is either from the /32 or from the /48, never anything in between
+				if pop, scope := data.Route(ecs); pop != 100 || (scope != 32 && scope != 48) {
+					t.Errorf("inconsistent answer pop %d scope %d", pop, scope)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := data.Insert(prefix, 100); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if err := data.Delete(prefix); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,27 @@
+package optimised
+
+import "time"
+
+// Observer is notified about lookups, loads and rejected rules, e.g. to collect metrics.
+// Implementations must be safe for concurrent use and cheap, ObserveRoute runs on every lookup.
+type Observer interface {
+	// ObserveRoute is called after every Route with the returned PoP and whether any rule matched
+	ObserveRoute(pop uint16, matched bool, duration time.Duration)
+	// ObserveLoad is called when LoadRoutingData (reload false) or ReloadRoutingData (reload true) finishes
+	ObserveLoad(reload bool, duration time.Duration, err error)
+	// ObserveConflict is called for every rule rejected because it conflicts with an existing rule
+	ObserveConflict(err error)
+}
+
+// SetObserver installs the hook, nil removes it. Set it before the table is shared between goroutines.
+func (data *Data) SetObserver(observer Observer) {
+	data.observer = observer
+}
+
+// pass a conflict error through the observer
+func (data *Data) conflict(err error) error {
+	if data.observer != nil {
+		data.observer.ObserveConflict(err)
+	}
+	return err
+}
@@ -60,10 +60,11 @@ func TestNewData(t *testing.T) {
 	if data == nil {
 		t.Fatal("NewData() returned nil")
 	}
-	if data.root == nil {
+	root := data.root.Load()
+	if root == nil {
 		t.Fatal("NewData().root is nil")
 	}
-	if data.root.ruleInfo != nil || data.root.children[0] != nil || data.root.children[1] != nil {
+	if root.ruleInfo != nil || root.children[0] != nil || root.children[1] != nil {
 		t.Error("NewData().root should be empty")
 	}
 }
@@ -207,6 +208,22 @@ func TestInsertAndRoute(t *testing.T) {
 		checkRoute(t, data, "2001:db8::2/128", broadPop, 32)
 	})
 }
+
+// RouteRule reports the matched rule along with the PoP and scope
+func TestRouteRule(t *testing.T) {
+	data := NewData()
+	checkInsert(t, data, "2001:db8::/32", 7, "")
+	checkInsert(t, data, "2001:db8:aaaa::/48", 7, "")
+
+	pop, scope, rule := data.RouteRule(mustParseCIDR(t, "2001:db8:aaaa:1::/64"))
+	if pop != 7 || scope != 48 || rule.String() != "2001:db8:aaaa::/48" {
+		t.Errorf("RouteRule: got PoP %d scope %d rule %s, want 7, 48, 2001:db8:aaaa::/48", pop, scope, rule)
+	}
+	if _, scope, rule := data.RouteRule(mustParseCIDR(t, "2002::/16")); scope != -1 || rule.IsValid() {
+		t.Errorf("RouteRule without a match: got scope %d rule %s", scope, rule)
+	}
+}
+
 func TestInsertConflicts(t *testing.T) {
 	t.Run("AncestorConflict", func(t *testing.T) {
 		data := NewData()
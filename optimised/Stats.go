@@ -0,0 +1,41 @@
+package optimised
+
+import "unsafe"
+
+// Stats describes the size and shape of the trie
+type Stats struct {
+	Nodes int
+	Rules int
+	// nodes with no rule and a single child, path compression (radix trie) would remove these
+	CompressibleNodes int
+	// number of nodes at each depth, indexed by depth (root is depth 0)
+	DepthHistogram [129]int
+	// number of rules with each prefix length, indexed by prefix length
+	PrefixLenHistogram [129]int
+	// approximate heap usage of nodes and rules, allocator overhead not included
+	EstimatedBytes int
+}
+
+func (data *Data) Stats() Stats {
+	var stats Stats
+	root := data.currentRoot()
+	if root == nil {
+		return stats
+	}
+
+	var path [16]byte
+	walk(root, &path, 0, func(node *TrieNode, path *[16]byte, depth int) bool {
+		stats.Nodes++
+		stats.DepthHistogram[depth]++
+		if node.ruleInfo != nil {
+			stats.Rules++
+			stats.PrefixLenHistogram[depth]++
+		} else if (node.children[0] == nil) != (node.children[1] == nil) {
+			stats.CompressibleNodes++
+		}
+		return true
+	})
+
+	stats.EstimatedBytes = stats.Nodes*int(unsafe.Sizeof(TrieNode{})) + stats.Rules*int(unsafe.Sizeof(RuleInfo{}))
+	return stats
+}
@@ -0,0 +1,46 @@
+package optimised
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		stats := NewData().Stats()
+		if stats.Nodes != 1 || stats.Rules != 0 || stats.CompressibleNodes != 0 || stats.DepthHistogram[0] != 1 {
+			t.Errorf("expected only the empty root, got %+v", stats)
+		}
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		checkInsert(t, data, "2001:db8:aaab::/48", 100, "")
+
+		stats := data.Stats()
+		// root + 32 nodes down to /32 + 2 separate paths below /47 split (15 shared nodes, then 1 node each)
+		wantNodes := 1 + 32 + 15 + 2
+		if stats.Nodes != wantNodes {
+			t.Errorf("Nodes: got %d, want %d", stats.Nodes, wantNodes)
+		}
+		if stats.Rules != 3 {
+			t.Errorf("Rules: got %d, want 3", stats.Rules)
+		}
+		// every node without a rule has a single child except the /47 split point
+		if want := wantNodes - 3 - 1; stats.CompressibleNodes != want {
+			t.Errorf("CompressibleNodes: got %d, want %d", stats.CompressibleNodes, want)
+		}
+		if stats.PrefixLenHistogram[32] != 1 || stats.PrefixLenHistogram[48] != 2 {
+			t.Errorf("PrefixLenHistogram: got /32 %d, /48 %d, want 1 and 2", stats.PrefixLenHistogram[32], stats.PrefixLenHistogram[48])
+		}
+		if stats.DepthHistogram[47] != 1 || stats.DepthHistogram[48] != 2 || stats.DepthHistogram[49] != 0 {
+			t.Errorf("DepthHistogram: got /47 %d, /48 %d, /49 %d, want 1, 2, 0", stats.DepthHistogram[47], stats.DepthHistogram[48], stats.DepthHistogram[49])
+		}
+		wantBytes := wantNodes*int(unsafe.Sizeof(TrieNode{})) + 3*int(unsafe.Sizeof(RuleInfo{}))
+		if stats.EstimatedBytes != wantBytes {
+			t.Errorf("EstimatedBytes: got %d, want %d", stats.EstimatedBytes, wantBytes)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package optimised
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Weight is one PoP of a weighted rule with its share of the traffic
+type Weight struct {
+	PoP    uint16
+	Weight uint32
+}
+
+// Target is what a rule routes to: a single PoP or a weighted set of PoPs, e.g. to split a prefix 70/30 during a migration,
+// optionally with a backup PoP taking over while the PoP is down (see Health) and a time window outside which the rule is ignored.
+// Targets are comparable, two targets are == exactly when they are the same rule target (routesLike ignores the backup and the window).
+type Target struct {
+	// the single PoP, for a weighted set the PoP with the largest weight (lowest PoP ID on a tie)
+	PoP uint16
+	// nil for a single PoP, weighted sets are interned so that identical sets share the pointer
+	set *weightSet
+	// backup PoP, only meaningful with hasBackup
+	backup    uint16
+	hasBackup bool
+	// window the rule is active in as unix seconds, both ends included, 0 for no bound
+	notBefore, notAfter int64
+}
+
+type weightSet struct {
+	// sorted by PoP ID
+	weights []Weight
+	total   uint64
+	// canonical "pop:weight,..." form
+	key string
+}
+
+var (
+	weightSetsMu sync.Mutex
+	// canonical form -> interned set, there are only ever a handful of distinct sets
+	weightSets = map[string]*weightSet{}
+)
+
+// NewWeightedTarget builds a target splitting traffic between PoPs by weight.
+// Weights must be positive and PoPs distinct, a single entry is the plain single PoP target.
+func NewWeightedTarget(weights []Weight) (Target, error) {
+	if len(weights) == 0 {
+		return Target{}, fmt.Errorf("weighted target needs at least one PoP")
+	}
+	sorted := slices.Clone(weights)
+	slices.SortFunc(sorted, func(a, b Weight) int { return int(a.PoP) - int(b.PoP) })
+	primary := sorted[0]
+	var total uint64
+	var key strings.Builder
+	for i, w := range sorted {
+		if w.Weight == 0 {
+			return Target{}, fmt.Errorf("weight of PoP %d must be positive", w.PoP)
+		}
+		if i > 0 && sorted[i-1].PoP == w.PoP {
+			return Target{}, fmt.Errorf("PoP %d is listed more than once", w.PoP)
+		}
+		if w.Weight > primary.Weight {
+			primary = w
+		}
+		total += uint64(w.Weight)
+		if i > 0 {
+			key.WriteByte(',')
+		}
+		fmt.Fprintf(&key, "%d:%d", w.PoP, w.Weight)
+	}
+	if len(sorted) == 1 {
+		return Target{PoP: primary.PoP}, nil
+	}
+
+	weightSetsMu.Lock()
+	defer weightSetsMu.Unlock()
+	set, ok := weightSets[key.String()]
+	if !ok {
+		set = &weightSet{weights: sorted, total: total, key: key.String()}
+		weightSets[set.key] = set
+	}
+	return Target{PoP: primary.PoP, set: set}, nil
+}
+
+// ParseTarget reads the routing data form of a target: "12" for a single PoP, "1:70,2:30" for a weighted set,
+// optionally followed by "backup=13" and the window "not-before=2026-03-01T00:00:00Z not-after=2026-03-02T00:00:00Z" (RFC 3339)
+func ParseTarget(s string) (Target, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Target{}, fmt.Errorf("empty target")
+	}
+	target, err := parsePoPs(fields[0])
+	if err != nil {
+		return Target{}, err
+	}
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "backup":
+			backup, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return Target{}, fmt.Errorf("failed to parse backup PoP ID '%s': %w", value, err)
+			}
+			target = target.WithBackup(uint16(backup))
+		case "not-before", "not-after":
+			bound, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return Target{}, fmt.Errorf("failed to parse %s time '%s': %w", key, value, err)
+			}
+			notBefore, notAfter := target.Window()
+			if key == "not-before" {
+				notBefore = bound
+			} else {
+				notAfter = bound
+			}
+			target = target.WithWindow(notBefore, notAfter)
+		default:
+			return Target{}, fmt.Errorf("unknown rule option '%s'", option)
+		}
+	}
+	if err := target.checkWindow(); err != nil {
+		return Target{}, err
+	}
+	return target, nil
+}
+
+// the PoP or weighted set part of a target
+func parsePoPs(s string) (Target, error) {
+	if !strings.Contains(s, ":") {
+		popID, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return Target{}, fmt.Errorf("failed to parse PoP ID '%s': %w", s, err)
+		}
+		return Target{PoP: uint16(popID)}, nil
+	}
+
+	var weights []Weight
+	for _, part := range strings.Split(s, ",") {
+		popStr, weightStr, _ := strings.Cut(part, ":")
+		popID, err := strconv.ParseUint(popStr, 10, 16)
+		if err != nil {
+			return Target{}, fmt.Errorf("failed to parse PoP ID '%s' in '%s': %w", popStr, s, err)
+		}
+		weight, err := strconv.ParseUint(weightStr, 10, 32)
+		if err != nil {
+			return Target{}, fmt.Errorf("failed to parse weight '%s' in '%s': %w", weightStr, s, err)
+		}
+		weights = append(weights, Weight{PoP: uint16(popID), Weight: uint32(weight)})
+	}
+	target, err := NewWeightedTarget(weights)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid weighted target '%s': %w", s, err)
+	}
+	return target, nil
+}
+
+// WithBackup returns the target with popID as its backup PoP
+func (t Target) WithBackup(popID uint16) Target {
+	t.backup, t.hasBackup = popID, true
+	return t
+}
+
+// Backup returns the backup PoP, ok is false when the target has none
+func (t Target) Backup() (popID uint16, ok bool) {
+	return t.backup, t.hasBackup
+}
+
+// WithWindow returns the target active from notBefore to notAfter (both included, to the second),
+// a zero time leaves that end open and two zero times make the rule permanent
+func (t Target) WithWindow(notBefore, notAfter time.Time) Target {
+	t.notBefore, t.notAfter = 0, 0
+	if !notBefore.IsZero() {
+		t.notBefore = notBefore.Unix()
+	}
+	if !notAfter.IsZero() {
+		t.notAfter = notAfter.Unix()
+	}
+	return t
+}
+
+// Window returns the times the rule is active between, zero for an open end
+func (t Target) Window() (notBefore, notAfter time.Time) {
+	if t.notBefore != 0 {
+		notBefore = time.Unix(t.notBefore, 0).UTC()
+	}
+	if t.notAfter != 0 {
+		notAfter = time.Unix(t.notAfter, 0).UTC()
+	}
+	return notBefore, notAfter
+}
+
+// reports whether the rule has a window at all, permanent rules never need the time
+func (t Target) timed() bool {
+	return t.notBefore|t.notAfter != 0
+}
+
+// the window with open ends as the extreme times
+func (t Target) bounds() (notBefore, notAfter int64) {
+	notBefore, notAfter = math.MinInt64, math.MaxInt64
+	if t.notBefore != 0 {
+		notBefore = t.notBefore
+	}
+	if t.notAfter != 0 {
+		notAfter = t.notAfter
+	}
+	return notBefore, notAfter
+}
+
+func (t Target) checkWindow() error {
+	if notBefore, notAfter := t.bounds(); notAfter < notBefore {
+		return fmt.Errorf("rule window ends before it starts (not-before %s, not-after %s)",
+			time.Unix(notBefore, 0).UTC().Format(time.RFC3339), time.Unix(notAfter, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ActiveAt reports whether the rule is in effect at now
+func (t Target) ActiveAt(now time.Time) bool {
+	if !t.timed() {
+		return true
+	}
+	notBefore, notAfter := t.bounds()
+	return notBefore <= now.Unix() && now.Unix() <= notAfter
+}
+
+// ExpiredAt reports whether the rule's window is over at now, it will never be in effect again
+func (t Target) ExpiredAt(now time.Time) bool {
+	return t.notAfter != 0 && now.Unix() > t.notAfter
+}
+
+// reports whether two targets route the same way while their PoPs are up,
+// nested rules only have to agree on this, their backups may differ
+func (t Target) routesLike(other Target) bool {
+	return t.PoP == other.PoP && t.set == other.set
+}
+
+// reports whether nested rules with the two targets conflict: they route differently at some point in time.
+// Rules whose windows never overlap are never in effect together, so they may route differently.
+func (t Target) conflictsWith(other Target) bool {
+	if t.routesLike(other) {
+		return false
+	}
+	notBefore, notAfter := t.bounds()
+	otherNotBefore, otherNotAfter := other.bounds()
+	return notBefore <= otherNotAfter && otherNotBefore <= notAfter
+}
+
+// Weighted reports whether the target splits traffic between several PoPs
+func (t Target) Weighted() bool {
+	return t.set != nil
+}
+
+// Weights returns the PoPs of a weighted target sorted by PoP ID, nil for a single PoP
+func (t Target) Weights() []Weight {
+	if t.set == nil {
+		return nil
+	}
+	return slices.Clone(t.set.weights)
+}
+
+// PoPs returns the PoP part of the routing data form: "12" or "1:70,2:30"
+func (t Target) PoPs() string {
+	if t.set == nil {
+		return strconv.Itoa(int(t.PoP))
+	}
+	return t.set.key
+}
+
+// String returns the routing data form, see ParseTarget
+func (t Target) String() string {
+	s := t.PoPs()
+	if t.hasBackup {
+		s += " backup=" + strconv.Itoa(int(t.backup))
+	}
+	notBefore, notAfter := t.Window()
+	if !notBefore.IsZero() {
+		s += " not-before=" + notBefore.Format(time.RFC3339)
+	}
+	if !notAfter.IsZero() {
+		s += " not-after=" + notAfter.Format(time.RFC3339)
+	}
+	return s
+}
+
+// pick the PoP for a client subnet, the same subnet always gets the same PoP as long as the set does not change
+func (t Target) pick(ecs *net.IPNet) uint16 {
+	if t.set == nil {
+		return t.PoP
+	}
+	point := subnetHash(ecs, "") % t.set.total
+	for _, w := range t.set.weights {
+		if point < uint64(w.Weight) {
+			return w.PoP
+		}
+		point -= uint64(w.Weight)
+	}
+	return t.PoP
+}
+
+// hash the client subnet (its masked address and length), salt keeps independent uses of the hash uncorrelated
+func subnetHash(ecs *net.IPNet, salt string) uint64 {
+	ones, _ := ecs.Mask.Size()
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write(ecs.IP.To16().Mask(net.CIDRMask(ones+128-len(ecs.Mask)*8, 128)))
+	h.Write([]byte{byte(ones)})
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
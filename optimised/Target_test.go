@@ -0,0 +1,141 @@
+package optimised
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		input, want, wantErr string
+		primary              uint16
+	}{
+		{input: "12", want: "12", primary: 12},
+		{input: "2:30,1:70", want: "1:70,2:30", primary: 1},
+		// a tie goes to the lowest PoP ID
+		{input: "5:50,3:50", want: "3:50,5:50", primary: 3},
+		{input: "7:100", want: "7", primary: 7},
+		{input: "2:30,1:70 backup=3", want: "1:70,2:30 backup=3", primary: 1},
+		{input: "4 not-after=2026-03-02T00:00:00+01:00 not-before=2026-03-01T00:00:00Z", want: "4 not-before=2026-03-01T00:00:00Z not-after=2026-03-01T23:00:00Z", primary: 4},
+		{input: "x", wantErr: "failed to parse PoP ID 'x'"},
+		{input: "4 not-after=tomorrow", wantErr: "failed to parse not-after time 'tomorrow'"},
+		{input: "4 not-before=2026-03-02T00:00:00Z not-after=2026-03-01T00:00:00Z", wantErr: "rule window ends before it starts"},
+		{input: "12 backup=x", wantErr: "failed to parse backup PoP ID 'x'"},
+		{input: "12 spare=13", wantErr: "unknown rule option 'spare=13'"},
+		{input: "1:70,2", wantErr: "failed to parse weight ''"},
+		{input: "1:70,2:0", wantErr: "weight of PoP 2 must be positive"},
+		{input: "1:70,1:30", wantErr: "PoP 1 is listed more than once"},
+	} {
+		target, err := ParseTarget(tc.input)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ParseTarget(%q): expected error containing %q, got %v", tc.input, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || target.String() != tc.want || target.PoP != tc.primary {
+			t.Errorf("ParseTarget(%q): got %s (primary %d) %v, want %s (primary %d)", tc.input, target, target.PoP, err, tc.want, tc.primary)
+		}
+	}
+
+	// identical sets are the same target
+	a, _ := ParseTarget("1:70,2:30")
+	b, _ := NewWeightedTarget([]Weight{{PoP: 2, Weight: 30}, {PoP: 1, Weight: 70}})
+	c, _ := ParseTarget("1:60,2:40")
+	if a != b || a == c || !a.Weighted() || a == (Target{PoP: 1}) {
+		t.Errorf("unexpected target equality: %v %v %v", a, b, c)
+	}
+}
+
+// insert prefix -> target as a single published change
+func insertTarget(data *Data, prefix, target string) error {
+	parsed, err := ParseTarget(target)
+	if err != nil {
+		return err
+	}
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+	m := data.newMutation()
+	if err := m.insert(netip.MustParsePrefix(prefix), parsed, false); err != nil {
+		return err
+	}
+	m.publish("insert " + prefix + " " + target)
+	return nil
+}
+
+func TestWeightedRules(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "routing.txt")
+	content := "2001:db8::/32 1:70,2:30\n2001:db8:aaaa::/48 2:30,1:70\n2001:db9::/32 3\n"
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	data := NewData()
+	if err := data.LoadRoutingData(filePath); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+
+	t.Run("Conflicts", func(t *testing.T) {
+		// the identical set does not conflict, a different set or a single PoP below a weighted rule does
+		if err := insertTarget(data, "2001:db8:bbbb::/48", "2:30,1:70"); err != nil {
+			t.Errorf("identical weighted set: unexpected error %v", err)
+		}
+		checkInsert(t, data, "2001:db8:cccc::/48", 1, "conflicts with broader rule at scope /32 (PoP 1:70,2:30)")
+		var conflict *ConflictError
+		err := insertTarget(data, "2001:db8:dddd::/48", "1:50,2:50")
+		if !errors.As(err, &conflict) || conflict.Weights != "1:50,2:50" || conflict.ExistingWeights != "1:70,2:30" || conflict.ExistingPoP != 1 {
+			t.Errorf("different weighted set: expected conflict, got %v", err)
+		}
+		if err := insertTarget(data, "2001:db9::/32", "3:50,4:50"); !errors.As(err, &conflict) || conflict.Kind != ConflictExact || conflict.ExistingWeights != "" {
+			t.Errorf("different set for an existing rule: expected conflict, got %v", err)
+		}
+	})
+
+	t.Run("Route", func(t *testing.T) {
+		// deterministic per subnet, scoped to the client subnet
+		counts := map[uint16]int{}
+		const subnets = 10000
+		for i := range subnets {
+			ecs := mustParseCIDR(t, fmt.Sprintf("2001:db8:%x:%x::/64", i>>8, i&0xff))
+			pop, scope := data.Route(ecs)
+			if again, _ := data.Route(ecs); again != pop {
+				t.Fatalf("Route(%s) is not deterministic: %d then %d", ecs, pop, again)
+			}
+			if scope != 64 {
+				t.Fatalf("Route(%s): got scope %d, want 64", ecs, scope)
+			}
+			counts[pop]++
+		}
+		if len(counts) != 2 || math.Abs(float64(counts[1])/subnets-0.7) > 0.03 {
+			t.Errorf("expected a 70/30 split between PoPs 1 and 2, got %v", counts)
+		}
+
+		// a subnet broader than the rule keeps the rule's scope
+		if _, scope := data.Route(mustParseCIDR(t, "2001:db8::/32")); scope != 32 {
+			t.Errorf("subnet of the rule's size: got scope %d, want 32", scope)
+		}
+		checkRoute(t, data, "2001:db9::/48", 3, 32)
+		_, ipv4, _ := net.ParseCIDR("10.0.0.0/24")
+		if pop, scope := data.Route(ipv4); pop != 0 || scope != -1 {
+			t.Errorf("unmatched IPv4 subnet: got %d %d", pop, scope)
+		}
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		exported := filepath.Join(t.TempDir(), "exported.txt")
+		if err := data.ExportRoutingData(exported); err != nil {
+			t.Fatalf("ExportRoutingData failed: %v", err)
+		}
+		got, _ := os.ReadFile(exported)
+		want := "2001:db8::/32 1:70,2:30\n2001:db8:aaaa::/48 1:70,2:30\n2001:db8:bbbb::/48 1:70,2:30\n2001:db9::/32 3\n"
+		if string(got) != want {
+			t.Errorf("ExportRoutingData:\ngot:\n%swant:\n%s", got, want)
+		}
+	})
+}
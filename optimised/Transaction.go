@@ -0,0 +1,180 @@
+package optimised
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Tx stages rule inserts and deletes that are validated and published together.
+// Conflicts are only checked against the final state, so intermediate states of a multi rule move
+// (e.g. a broad rule and its narrower rules changing PoP together) never trip the checks or get served.
+type Tx struct {
+	data    *Data
+	changes []Change
+	source  string
+	actor   string
+}
+
+// TxError is returned when a transaction is rejected, it lists every problem found and nothing is published
+type TxError struct {
+	Errors []error
+}
+
+func (e *TxError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("transaction rejected (%d problems): %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *TxError) Unwrap() []error {
+	return e.Errors
+}
+
+// Conflicts returns the conflicting rules among the problems
+func (e *TxError) Conflicts() []*ConflictError {
+	var conflicts []*ConflictError
+	for _, err := range e.Errors {
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
+
+// Begin starts a transaction, nothing is visible before Commit
+func (data *Data) Begin() *Tx {
+	return data.As(SystemActor).Begin()
+}
+
+// Insert stages the rule prefix -> popID, replacing the PoP of an existing rule for prefix
+func (tx *Tx) Insert(prefix netip.Prefix, popID uint16) {
+	tx.changes = append(tx.changes, Change{Prefix: prefix, PoP: popID})
+}
+
+// InsertBounded stages the rule prefix -> popID in effect from notBefore to notAfter, see Data.InsertBounded
+func (tx *Tx) InsertBounded(prefix netip.Prefix, popID uint16, notBefore, notAfter time.Time) {
+	tx.changes = append(tx.changes, Change{Prefix: prefix, PoP: popID, NotBefore: notBefore, NotAfter: notAfter})
+}
+
+// Delete stages the removal of the rule for prefix, the rule must exist when the transaction reaches it
+func (tx *Tx) Delete(prefix netip.Prefix) {
+	tx.changes = append(tx.changes, Change{Prefix: prefix, Delete: true})
+}
+
+// SetSource sets the description of the transaction in the version history
+func (tx *Tx) SetSource(source string) {
+	tx.source = source
+}
+
+// Commit applies the staged changes in order, validates the result and publishes it atomically.
+// On failure a *TxError with all invalid operations and conflicts is returned and the table is unchanged.
+func (tx *Tx) Commit() error {
+	tx.data.writeMu.Lock()
+	defer tx.data.writeMu.Unlock()
+
+	m := tx.data.newMutation()
+	m.actor = tx.actor
+	changes, problems := m.apply(tx.changes, false)
+	if len(problems) > 0 {
+		return &TxError{Errors: problems}
+	}
+	source := tx.source
+	if source == "" {
+		source = fmt.Sprintf("transaction of %d changes", len(changes))
+	}
+	return m.commitChanges(source, changes)
+}
+
+// apply changes in order and check every inserted rule against the final trie, returns the changes with their
+// prefixes masked and all invalid changes and conflicts. With replay the changes are read back from a journal:
+// deleting a missing rule is skipped and rules with weights or a backup may be replaced.
+func (m *mutation) apply(changes []Change, replay bool) ([]Change, []error) {
+	var problems []error
+	// final target of every prefix inserted by the changes
+	inserted := map[netip.Prefix]Target{}
+	var insertOrder []netip.Prefix
+
+	applied := make([]Change, 0, len(changes))
+	for _, change := range changes {
+		prefix, err := triePrefix(change.Prefix)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		change.Prefix = prefix
+		if change.Delete {
+			err := m.remove(prefix)
+			switch {
+			case err == nil:
+			case replay && errors.Is(err, ErrRuleNotFound):
+				continue
+			default:
+				problems = append(problems, err)
+			}
+			applied = append(applied, change)
+			delete(inserted, prefix)
+			continue
+		}
+		applied = append(applied, change)
+		target, err := change.target()
+		if err == nil {
+			err = target.checkWindow()
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("cannot insert %s: %w", prefix, err))
+			continue
+		}
+		if !replay {
+			if err := m.checkRoutingDataTarget(prefix, target); err != nil {
+				problems = append(problems, err)
+				continue
+			}
+		}
+		m.set(prefix, target)
+		if _, ok := inserted[prefix]; !ok {
+			insertOrder = append(insertOrder, prefix)
+		}
+		inserted[prefix] = target
+	}
+
+	// only inserted rules can take part in a new conflict, check each of them against the final trie
+	reported := map[[2]netip.Prefix]bool{}
+	for _, prefix := range insertOrder {
+		target, ok := inserted[prefix]
+		if !ok {
+			continue // deleted again later
+		}
+		for _, conflict := range m.allConflicts(prefix, target) {
+			// a conflict between two inserted rules is found from both sides, report it once
+			pair := [2]netip.Prefix{conflict.Prefix, conflict.Existing}
+			if reported[pair] || reported[[2]netip.Prefix{pair[1], pair[0]}] {
+				continue
+			}
+			reported[pair] = true
+			problems = append(problems, m.data.conflict(conflict))
+		}
+	}
+	return applied, problems
+}
+
+// list every rule conflicting with the stored rule prefix -> target (broader and narrower ones)
+func (m *mutation) allConflicts(prefix netip.Prefix, target Target) []*ConflictError {
+	var conflicts []*ConflictError
+	for existing, existingTarget := range m.covering(prefix) {
+		if existing != prefix && existingTarget.conflictsWith(target) {
+			conflicts = append(conflicts, newConflictError(ConflictBroader, prefix, target, existing, existingTarget))
+		}
+	}
+	for existing, existingTarget := range m.within(prefix) {
+		if existing != prefix && existingTarget.conflictsWith(target) {
+			conflicts = append(conflicts, newConflictError(ConflictNarrower, prefix, target, existing, existingTarget))
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,128 @@
+package optimised
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	newTable := func(t *testing.T) *Data {
+		data := NewData()
+		checkInsert(t, data, "2001:db8::/32", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+		checkInsert(t, data, "2001:db8:aaaa:bb00::/56", 100, "")
+		checkInsert(t, data, "2001:db9::/32", 200, "")
+		return data
+	}
+
+	t.Run("MoveRegion", func(t *testing.T) {
+		data := newTable(t)
+		// one at a time every step conflicts with the rules not moved yet
+		tx := data.Begin()
+		tx.Insert(netip.MustParsePrefix("2001:db8:aaaa:bb00::/56"), 300)
+		tx.Insert(netip.MustParsePrefix("2001:db8::/32"), 300)
+		tx.Insert(netip.MustParsePrefix("2001:db8:aaaa::/48"), 300)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		checkRoute(t, data, "2001:db8:aaaa:bb00::/64", 300, 56)
+		checkRoute(t, data, "2001:db8:aaaa:cc00::/64", 300, 48)
+		checkRoute(t, data, "2001:db8:bbbb::/64", 300, 32)
+		checkRoute(t, data, "2001:db9::/64", 200, 32)
+	})
+
+	t.Run("InsertAndDelete", func(t *testing.T) {
+		data := newTable(t)
+		tx := data.Begin()
+		tx.Delete(netip.MustParsePrefix("2001:db8:aaaa::/48"))
+		tx.Delete(netip.MustParsePrefix("2001:db8:aaaa:bb00::/56"))
+		tx.Insert(netip.MustParsePrefix("2001:db8:cccc::/48"), 100)
+		// inserted and removed again, never part of the final state
+		tx.Insert(netip.MustParsePrefix("2001:db9:aaaa::/48"), 300)
+		tx.Delete(netip.MustParsePrefix("2001:db9:aaaa::/48"))
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		want := []string{"2001:db8::/32 100", "2001:db8:cccc::/48 100", "2001:db9::/32 200"}
+		if got := collectRules(data.All()); !slices.Equal(got, want) {
+			t.Errorf("rules after commit:\ngot  %v\nwant %v", got, want)
+		}
+	})
+
+	t.Run("RejectAllConflicts", func(t *testing.T) {
+		data := newTable(t)
+		before := collectRules(data.All())
+
+		tx := data.Begin()
+		tx.Insert(netip.MustParsePrefix("2001:db8:cccc::/48"), 300) // under /32 100
+		tx.Insert(netip.MustParsePrefix("2001:db9::/32"), 400)      // fine on its own
+		tx.Insert(netip.MustParsePrefix("2001:db9:aaaa::/48"), 500) // conflicts with the staged /32 400
+		tx.Delete(netip.MustParsePrefix("2001:dba::/32"))           // does not exist
+		tx.Insert(netip.MustParsePrefix("10.0.0.0/8"), 1)           // not IPv6
+		err := tx.Commit()
+
+		var txErr *TxError
+		if !errors.As(err, &txErr) {
+			t.Fatalf("expected TxError, got %v", err)
+		}
+		if len(txErr.Errors) != 4 {
+			t.Errorf("expected 4 problems, got %d: %v", len(txErr.Errors), txErr)
+		}
+		if !errors.Is(err, ErrRuleNotFound) {
+			t.Errorf("expected the missing delete to be reported: %v", err)
+		}
+
+		conflicts := txErr.Conflicts()
+		want := []ConflictError{
+			{Kind: ConflictBroader, Prefix: netip.MustParsePrefix("2001:db8:cccc::/48"), PoP: 300, Existing: netip.MustParsePrefix("2001:db8::/32"), ExistingPoP: 100},
+			{Kind: ConflictNarrower, Prefix: netip.MustParsePrefix("2001:db9::/32"), PoP: 400, Existing: netip.MustParsePrefix("2001:db9:aaaa::/48"), ExistingPoP: 500},
+		}
+		if len(conflicts) != len(want) {
+			t.Fatalf("expected %d conflicts (pair of staged rules reported once), got %v", len(want), conflicts)
+		}
+		for i := range want {
+			if *conflicts[i] != want[i] {
+				t.Errorf("conflict %d: got %+v, want %+v", i, *conflicts[i], want[i])
+			}
+		}
+
+		if after := collectRules(data.All()); !slices.Equal(after, before) {
+			t.Errorf("rejected transaction changed the table:\ngot  %v\nwant %v", after, before)
+		}
+	})
+
+	t.Run("RoutingDataTargets", func(t *testing.T) {
+		data := loadString(t, "2001:db8::/32 1 backup=5\n2001:db9::/32 1:70,2:30\n")
+
+		// the same PoP would still drop the backup and the weights
+		tx := data.Begin()
+		tx.Insert(netip.MustParsePrefix("2001:db8::/32"), 1)
+		tx.Insert(netip.MustParsePrefix("2001:db9::/32"), 1)
+		err := tx.Commit()
+		var txErr *TxError
+		if !errors.As(err, &txErr) || len(txErr.Errors) != 2 || !errors.Is(err, ErrRoutingDataTarget) {
+			t.Fatalf("expected both inserts rejected with ErrRoutingDataTarget, got %v", err)
+		}
+		if got := exportString(t, data); got != "2001:db8::/32 1 backup=5\n2001:db9::/32 1:70,2:30\n" {
+			t.Errorf("rejected transaction changed the table:\n%s", got)
+		}
+
+		// deleted first the rule is replaced on purpose
+		tx = data.Begin()
+		tx.Delete(netip.MustParsePrefix("2001:db9::/32"))
+		tx.Insert(netip.MustParsePrefix("2001:db9::/32"), 1)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		checkRoute(t, data, "2001:db9::/64", 1, 32)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		data := newTable(t)
+		if err := data.Begin().Commit(); err != nil {
+			t.Errorf("empty Commit failed: %v", err)
+		}
+	})
+}
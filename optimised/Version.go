@@ -0,0 +1,105 @@
+package optimised
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultHistoryLimit is the number of published tables kept for rollback unless SetHistoryLimit says otherwise
+const DefaultHistoryLimit = 16
+
+// ErrVersionNotFound is returned when rolling back to a serial that is not (or no longer) in the history
+var ErrVersionNotFound = errors.New("version not found")
+
+// Version describes one published table
+type Version struct {
+	// increases by one with every publish, rollbacks included
+	Serial    uint64
+	Published time.Time
+	// what produced the table, e.g. "load routing-data.txt" or "delete 2001:db8::/32"
+	Source string
+}
+
+// a published table, copy-on-write never modifies a published trie so keeping the root keeps the whole table
+type version struct {
+	Version
+	root *TrieNode
+}
+
+// SetHistoryLimit sets how many published tables are kept for rollback (the served one included), at least 1
+func (data *Data) SetHistoryLimit(limit int) {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+	data.historyLimit = max(limit, 1)
+	data.trimHistory()
+}
+
+// Serial returns the serial of the table currently served
+func (data *Data) Serial() uint64 {
+	return data.serial.Load()
+}
+
+// Published returns when the table currently served was published
+func (data *Data) Published() time.Time {
+	return time.Unix(0, data.published.Load())
+}
+
+// Versions lists the kept tables, oldest first, the last one is served
+func (data *Data) Versions() []Version {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+
+	versions := make([]Version, len(data.history))
+	for i, v := range data.history {
+		versions[i] = v.Version
+	}
+	return versions
+}
+
+// Rollback publishes the kept table with the given serial again, atomically and under a new serial.
+// The rules come back exactly as they were, hit counters of rules unchanged since then included.
+func (data *Data) Rollback(serial uint64) error {
+	return data.As(SystemActor).Rollback(serial)
+}
+
+func (data *Data) rollback(actor string, serial uint64) error {
+	data.writeMu.Lock()
+	defer data.writeMu.Unlock()
+
+	for _, v := range data.history {
+		if v.Serial == serial {
+			m := data.newMutation()
+			m.root = v.root
+			m.actor = actor
+			return m.commitTable(fmt.Sprintf("rollback to serial %d", serial), data.base)
+		}
+	}
+	return fmt.Errorf("cannot roll back to serial %d: %w", serial, ErrVersionNotFound)
+}
+
+// record a newly published root in the history, must be called while holding writeMu
+func (data *Data) recordVersion(root *TrieNode, source string) {
+	serial := data.serial.Load() + 1
+	published := time.Now()
+	data.history = append(data.history, version{
+		Version: Version{Serial: serial, Published: published, Source: source},
+		root:    root,
+	})
+	data.trimHistory()
+	data.published.Store(published.UnixNano())
+	data.serial.Store(serial)
+}
+
+// drop the oldest versions beyond the limit so their tries can be garbage collected
+func (data *Data) trimHistory() {
+	limit := data.historyLimit
+	if limit == 0 {
+		limit = DefaultHistoryLimit
+	}
+	if excess := len(data.history) - limit; excess > 0 {
+		// clear the dropped entries so the backing array does not keep their tries alive
+		clear(data.history[:excess])
+		data.history = data.history[excess:]
+	}
+}
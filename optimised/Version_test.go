@@ -0,0 +1,77 @@
+package optimised
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	data := NewData()
+	filePath := filepath.Join(t.TempDir(), "routing.txt")
+	if err := os.WriteFile(filePath, []byte("2001:db8::/32 100\n2001:db9::/32 200\n"), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	if err := data.LoadRoutingData(filePath); err != nil {
+		t.Fatalf("LoadRoutingData failed: %v", err)
+	}
+	loaded := data.Serial()
+	checkInsert(t, data, "2001:db8:aaaa::/48", 100, "")
+	if err := data.Delete(netip.MustParsePrefix("2001:db9::/32")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// a rejected change publishes nothing
+	checkInsert(t, data, "2001:db8:bbbb::/48", 300, "conflicts with broader rule")
+
+	var sources []string
+	for i, v := range data.Versions() {
+		if v.Serial != uint64(i+1) || v.Published.IsZero() {
+			t.Errorf("unexpected version %+v at %d", v, i)
+		}
+		sources = append(sources, v.Source)
+	}
+	want := []string{"empty table", "load " + filePath, "insert 2001:db8:aaaa::/48 100", "delete 2001:db9::/32"}
+	if !slices.Equal(sources, want) {
+		t.Errorf("sources:\ngot  %v\nwant %v", sources, want)
+	}
+	if data.Serial() != 4 {
+		t.Errorf("expected serial 4, got %d", data.Serial())
+	}
+
+	if err := data.Rollback(loaded); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if data.Serial() != 5 {
+		t.Errorf("rollback must publish under a new serial, got %d", data.Serial())
+	}
+	if got := collectRules(data.All()); !slices.Equal(got, []string{"2001:db8::/32 100", "2001:db9::/32 200"}) {
+		t.Errorf("rolled back table: %v", got)
+	}
+	if versions := data.Versions(); versions[len(versions)-1].Source != "rollback to serial 2" {
+		t.Errorf("unexpected rollback source %q", versions[len(versions)-1].Source)
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		if err := data.Rollback(42); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("expected ErrVersionNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		data.SetHistoryLimit(2)
+		versions := data.Versions()
+		if len(versions) != 2 || versions[0].Serial != 4 || versions[1].Serial != 5 {
+			t.Fatalf("expected serials 4 and 5 to be kept, got %+v", versions)
+		}
+		checkInsert(t, data, "2001:dba::/32", 300, "")
+		if versions := data.Versions(); len(versions) != 2 || versions[0].Serial != 5 {
+			t.Errorf("expected the oldest version to be dropped, got %+v", versions)
+		}
+		if err := data.Rollback(loaded); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("expected dropped version to be gone, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package prober
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check is a probe of one PoP address, Kind is "tcp" (Target is host:port and must accept a connection)
+// or "http" (Target is a URL and a GET must answer with a 2xx or 3xx status)
+type Check struct {
+	PoP    uint16
+	Kind   string
+	Target string
+	// zero values take the prober's defaults
+	Interval time.Duration
+	Timeout  time.Duration
+	// consecutive results needed to change the check's verdict, the gap between them is the hysteresis
+	// that keeps a flapping address from flipping the PoP on every probe
+	Rise int
+	Fall int
+}
+
+// Defaults are the settings of checks that do not set their own
+type Defaults struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+}
+
+var DefaultSettings = Defaults{Interval: 10 * time.Second, Timeout: 2 * time.Second, Rise: 2, Fall: 3}
+
+// Prober runs the checks and feeds their verdicts into a Health: a PoP is up while at least one of its checks passes
+// and down once all of them fail. It only writes a PoP's state when its own verdict changes,
+// so a state set by hand (eg. draining through the admin API) stays until the probes disagree with the previous verdict.
+type Prober struct {
+	health *optimised.Health
+	checks []*checkState
+	client *http.Client
+
+	mu sync.Mutex
+	// PoP -> whether the prober last reported it up
+	verdicts map[uint16]bool
+}
+
+type checkState struct {
+	Check
+	// guarded by Prober.mu
+	up        bool
+	successes int
+	failures  int
+}
+
+// New creates a prober for checks, settings missing in a check are taken from defaults.
+// Every check starts passing, like PoPs start up in a Health.
+func New(health *optimised.Health, checks []Check, defaults Defaults) (*Prober, error) {
+	p := &Prober{
+		health: health,
+		// every check has its own timeout, redirects are not followed so that a 3xx counts as an answer
+		client:   &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		verdicts: map[uint16]bool{},
+	}
+	for _, check := range checks {
+		if check.Kind != "tcp" && check.Kind != "http" {
+			return nil, fmt.Errorf("unknown check kind '%s' for PoP %d (expected tcp or http)", check.Kind, check.PoP)
+		}
+		if check.Interval == 0 {
+			check.Interval = defaults.Interval
+		}
+		if check.Timeout == 0 {
+			check.Timeout = defaults.Timeout
+		}
+		if check.Rise == 0 {
+			check.Rise = defaults.Rise
+		}
+		if check.Fall == 0 {
+			check.Fall = defaults.Fall
+		}
+		if check.Interval <= 0 || check.Timeout <= 0 || check.Rise <= 0 || check.Fall <= 0 {
+			return nil, fmt.Errorf("check %s %s of PoP %d needs a positive interval, timeout, rise and fall", check.Kind, check.Target, check.PoP)
+		}
+		p.checks = append(p.checks, &checkState{Check: check, up: true})
+		p.verdicts[check.PoP] = true
+	}
+	return p, nil
+}
+
+// Run probes every check on its own interval until ctx is done
+func (p *Prober) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, check := range p.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(check.Interval)
+			defer ticker.Stop()
+			for {
+				p.probe(ctx, check)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ProbeOnce runs every check once, concurrently, and applies the results
+func (p *Prober) ProbeOnce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, check := range p.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probe(ctx, check)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Prober) probe(ctx context.Context, check *checkState) {
+	probeCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+	err := p.run(probeCtx, check.Check)
+	cancel()
+	if ctx.Err() != nil {
+		// shutting down, not a result
+		return
+	}
+	p.record(check, err)
+}
+
+// run a single probe, nil means it passed
+func (p *Prober) run(ctx context.Context, check Check) error {
+	switch check.Kind {
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// count the result towards the check's verdict and update the PoP when its verdict changes
+func (p *Prober) record(check *checkState, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		check.successes++
+		check.failures = 0
+		if check.up || check.successes < check.Rise {
+			return
+		}
+		check.up = true
+		log.Printf("%s check %s of PoP %d passes again", check.Kind, check.Target, check.PoP)
+	} else {
+		check.failures++
+		check.successes = 0
+		if !check.up || check.failures < check.Fall {
+			return
+		}
+		check.up = false
+		log.Printf("%s check %s of PoP %d fails: %v", check.Kind, check.Target, check.PoP, err)
+	}
+
+	up := false
+	for _, other := range p.checks {
+		if other.PoP == check.PoP && other.up {
+			up = true
+			break
+		}
+	}
+	if up == p.verdicts[check.PoP] {
+		return
+	}
+	p.verdicts[check.PoP] = up
+	state := optimised.PoPDown
+	if up {
+		state = optimised.PoPUp
+	}
+	p.health.Set(check.PoP, state)
+	log.Printf("PoP %d marked %s by the prober", check.PoP, state)
+}
+
+// LoadChecks reads a file of "PoP kind target [interval=10s] [timeout=2s] [rise=2] [fall=3]" lines
+func LoadChecks(filename string) ([]Check, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checks file '%s': %w", filename, err)
+	}
+	defer file.Close()
+
+	var checks []Check
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		check, err := parseCheck(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		checks = append(checks, check)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading checks file '%s': %w", filename, err)
+	}
+	return checks, nil
+}
+
+func parseCheck(fields []string) (Check, error) {
+	if len(fields) < 3 {
+		return Check{}, fmt.Errorf("expected at least 3 fields (PoP, kind, target), got %d", len(fields))
+	}
+	popID, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return Check{}, fmt.Errorf("failed to parse PoP ID '%s': %w", fields[0], err)
+	}
+	check := Check{PoP: uint16(popID), Kind: fields[1], Target: fields[2]}
+	for _, option := range fields[3:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "interval", "timeout":
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return Check{}, fmt.Errorf("failed to parse %s '%s': %w", key, value, err)
+			}
+			if key == "interval" {
+				check.Interval = duration
+			} else {
+				check.Timeout = duration
+			}
+		case "rise", "fall":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return Check{}, fmt.Errorf("failed to parse %s '%s': %w", key, value, err)
+			}
+			if key == "rise" {
+				check.Rise = count
+			} else {
+				check.Fall = count
+			}
+		default:
+			return Check{}, fmt.Errorf("unknown check option '%s'", option)
+		}
+	}
+	return check, nil
+}
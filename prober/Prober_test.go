@@ -0,0 +1,168 @@
+package prober
+
+import (
+	"CDN77-DNS/optimised"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newProber(t *testing.T, health *optimised.Health, checks ...Check) *Prober {
+	t.Helper()
+	p, err := New(health, checks, Defaults{Interval: time.Second, Timeout: time.Second, Rise: 2, Fall: 3})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return p
+}
+
+func TestHTTPCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	health := optimised.NewHealth()
+	p := newProber(t, health, Check{PoP: 7, Kind: "http", Target: server.URL + "/health"})
+	ctx := context.Background()
+
+	// fall 3: two failures are not enough
+	status.Store(http.StatusServiceUnavailable)
+	for i, want := range []optimised.PoPState{optimised.PoPUp, optimised.PoPUp, optimised.PoPDown, optimised.PoPDown} {
+		p.ProbeOnce(ctx)
+		if got := health.State(7); got != want {
+			t.Fatalf("after %d failures: got %s, want %s", i+1, got, want)
+		}
+	}
+
+	// rise 2, a failure in between starts over
+	status.Store(http.StatusFound)
+	p.ProbeOnce(ctx)
+	status.Store(http.StatusInternalServerError)
+	p.ProbeOnce(ctx)
+	status.Store(http.StatusOK)
+	p.ProbeOnce(ctx)
+	if got := health.State(7); got != optimised.PoPDown {
+		t.Fatalf("flapping check brought the PoP up: %s", got)
+	}
+	p.ProbeOnce(ctx)
+	if got := health.State(7); got != optimised.PoPUp {
+		t.Fatalf("after 2 successes: got %s, want up", got)
+	}
+}
+
+func TestTCPCheck(t *testing.T) {
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer healthy.Close()
+	go func() {
+		for {
+			conn, err := healthy.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// a port nothing listens on any more
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	health := optimised.NewHealth()
+	p := newProber(t, health,
+		// PoP 1 has one healthy address left, PoP 2 none
+		Check{PoP: 1, Kind: "tcp", Target: healthy.Addr().String()},
+		Check{PoP: 1, Kind: "tcp", Target: closedAddr, Fall: 1},
+		Check{PoP: 2, Kind: "tcp", Target: closedAddr, Fall: 1},
+	)
+	p.ProbeOnce(context.Background())
+	if states := health.States(); len(states) != 1 || states[2] != optimised.PoPDown {
+		t.Errorf("got states %v, want only PoP 2 down", states)
+	}
+
+	t.Run("ManualState", func(t *testing.T) {
+		// the prober does not undo a state set by hand while its verdict stays the same
+		health.Set(1, optimised.PoPDraining)
+		p.ProbeOnce(context.Background())
+		if got := health.State(1); got != optimised.PoPDraining {
+			t.Errorf("got %s, want draining", got)
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	health := optimised.NewHealth()
+	p := newProber(t, health, Check{PoP: 3, Kind: "http", Target: server.URL, Interval: 5 * time.Millisecond, Fall: 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for health.State(3) != optimised.PoPDown && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if got := health.State(3); got != optimised.PoPDown {
+		t.Errorf("got %s, want down", got)
+	}
+}
+
+func TestLoadChecks(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "checks.txt")
+	content := "# PoP kind target options\n1 tcp 192.0.2.1:443\n\n2 http http://192.0.2.2/health interval=5s timeout=1s rise=1 fall=2\n"
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write checks: %v", err)
+	}
+	checks, err := LoadChecks(filePath)
+	if err != nil {
+		t.Fatalf("LoadChecks failed: %v", err)
+	}
+	want := []Check{
+		{PoP: 1, Kind: "tcp", Target: "192.0.2.1:443"},
+		{PoP: 2, Kind: "http", Target: "http://192.0.2.2/health", Interval: 5 * time.Second, Timeout: time.Second, Rise: 1, Fall: 2},
+	}
+	if len(checks) != len(want) || checks[0] != want[0] || checks[1] != want[1] {
+		t.Errorf("got %+v, want %+v", checks, want)
+	}
+
+	for _, tc := range []struct{ line, want string }{
+		{"1 tcp", "expected at least 3 fields"},
+		{"x tcp 192.0.2.1:443", "failed to parse PoP ID 'x'"},
+		{"1 tcp 192.0.2.1:443 interval=soon", "failed to parse interval 'soon'"},
+		{"1 tcp 192.0.2.1:443 retries=3", "unknown check option 'retries=3'"},
+	} {
+		if err := os.WriteFile(filePath, []byte(tc.line+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write checks: %v", err)
+		}
+		if _, err := LoadChecks(filePath); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.line, tc.want, err)
+		}
+	}
+	if _, err := New(optimised.NewHealth(), []Check{{PoP: 1, Kind: "icmp", Target: "192.0.2.1"}}, DefaultSettings); err == nil {
+		t.Error("expected error for unknown check kind")
+	}
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"CDN77-DNS/optimised"
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Table is a named routing table serving the query names under its zones
+type Table struct {
+	Name string
+	// routing data file the table is loaded and reloaded from
+	File  string
+	Zones []string
+	Data  *optimised.Data
+}
+
+// Registry holds several routing tables and picks one per query name by the longest matching zone,
+// e.g. video hostnames can steer differently from static asset hostnames.
+// The set of tables and zones is fixed once built, only the tables' rules change (see Reload).
+type Registry struct {
+	tables map[string]*Table
+	// normalised zone -> table
+	zones map[string]*Table
+	// run on every added table before its routing data is loaded, see LoadWith
+	setup func(*Table)
+}
+
+func New() *Registry {
+	return &Registry{tables: map[string]*Table{}, zones: map[string]*Table{}}
+}
+
+// Add loads filename as the table name serving zones, the root zone "." makes it the default for all other names.
+// A zone can only belong to one table.
+func (r *Registry) Add(name, filename string, zones ...string) error {
+	if _, ok := r.tables[name]; ok {
+		return fmt.Errorf("table '%s' already exists", name)
+	}
+	if len(zones) == 0 {
+		return fmt.Errorf("table '%s' has no zones", name)
+	}
+	table := &Table{Name: name, File: filename, Data: optimised.NewData()}
+	for _, zone := range zones {
+		normalised := normaliseName(zone)
+		if other, ok := r.zones[normalised]; ok {
+			return fmt.Errorf("zone '%s' of table '%s' already belongs to table '%s'", zone, name, other.Name)
+		}
+		table.Zones = append(table.Zones, normalised+".")
+	}
+	if r.setup != nil {
+		r.setup(table)
+	}
+	if err := table.Data.LoadRoutingData(filename); err != nil {
+		return fmt.Errorf("failed to load table '%s': %w", name, err)
+	}
+
+	r.tables[name] = table
+	for _, zone := range table.Zones {
+		r.zones[normaliseName(zone)] = table
+	}
+	return nil
+}
+
+// Load builds a registry from a config file of "name routing-data-file zone [zone...]" lines,
+// relative file names are relative to the config file
+func Load(configFile string) (*Registry, error) {
+	return LoadWith(configFile, nil)
+}
+
+// LoadWith is Load running setup on every table before its routing data is loaded,
+// e.g. to install an observer that records the initial load
+func LoadWith(configFile string, setup func(*Table)) (*Registry, error) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry config '%s': %w", configFile, err)
+	}
+	defer file.Close()
+
+	r := New()
+	r.setup = setup
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("expected at least 3 fields (name, file, zone...), got %d on line %d", len(parts), lineNumber)
+		}
+		filename := parts[1]
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(configFile), filename)
+		}
+		if err := r.Add(parts[0], filename, parts[2:]...); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading registry config '%s': %w", configFile, err)
+	}
+	if len(r.tables) == 0 {
+		return nil, fmt.Errorf("registry config '%s' contains no tables", configFile)
+	}
+	return r, nil
+}
+
+// Lookup returns the table of the longest zone qname is in (a zone includes all names below it)
+func (r *Registry) Lookup(qname string) (*Table, bool) {
+	name := normaliseName(qname)
+	for {
+		if table, ok := r.zones[name]; ok {
+			return table, true
+		}
+		if name == "" {
+			return nil, false
+		}
+		// drop the leftmost label, ending with the root zone
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			parent = ""
+		}
+		name = parent
+	}
+}
+
+// Route answers ecs from the table qname belongs to, ok is false when no table serves qname
+func (r *Registry) Route(qname string, ecs *net.IPNet) (table *Table, pop uint16, scope int, ok bool) {
+	table, ok = r.Lookup(qname)
+	if !ok {
+		return nil, 0, -1, false
+	}
+	pop, scope = table.Data.Route(ecs)
+	return table, pop, scope, true
+}
+
+// Table returns the table called name
+func (r *Registry) Table(name string) (*Table, bool) {
+	table, ok := r.tables[name]
+	return table, ok
+}
+
+// Tables returns all tables sorted by name
+func (r *Registry) Tables() []*Table {
+	tables := make([]*Table, 0, len(r.tables))
+	for _, table := range r.tables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// SetHealth makes every table fail over from the PoPs health reports as not up, see optimised.Data.SetHealth
+func (r *Registry) SetHealth(health *optimised.Health) {
+	for _, table := range r.tables {
+		table.Data.SetHealth(health)
+	}
+}
+
+// Reload replaces the rules of the table called name with its file, on error the old rules stay
+func (r *Registry) Reload(name string) error {
+	table, ok := r.tables[name]
+	if !ok {
+		return fmt.Errorf("no table '%s'", name)
+	}
+	if err := table.Data.ReloadRoutingData(table.File); err != nil {
+		return fmt.Errorf("failed to reload table '%s': %w", name, err)
+	}
+	return nil
+}
+
+// ReloadAll reloads every table independently, a failed table keeps its old rules and does not stop the others
+func (r *Registry) ReloadAll() error {
+	var errs []error
+	for _, table := range r.Tables() {
+		errs = append(errs, r.Reload(table.Name))
+	}
+	return errors.Join(errs...)
+}
+
+// lowercase without the trailing dot, the root zone is ""
+func normaliseName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	filePath := filepath.Join(dir, name)
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write '%s': %v", filePath, err)
+	}
+	return filePath
+}
+
+func testRegistry(t *testing.T) (*Registry, string) {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, dir, "video.txt", "2001:db8::/32 1\n")
+	writeFile(t, dir, "static.txt", "2001:db8::/32 2\n")
+	writeFile(t, dir, "default.txt", "::/0 3\n")
+	config := writeFile(t, dir, "tables.txt", "video video.txt video.example.com live.example.com.\n\nstatic static.txt Static.Example.com\ndefault default.txt .\n")
+	r, err := Load(config)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return r, dir
+}
+
+func TestLookup(t *testing.T) {
+	r, _ := testRegistry(t)
+	_, ecs, _ := net.ParseCIDR("2001:db8::/56")
+	tests := []struct {
+		qname string
+		table string
+		pop   uint16
+	}{
+		{"video.example.com.", "video", 1},
+		{"edge1.VIDEO.example.com", "video", 1},
+		{"a.b.live.example.com.", "video", 1},
+		{"img.static.example.com.", "static", 2},
+		// label boundaries, not string suffixes
+		{"xvideo.example.com.", "default", 3},
+		{"example.com.", "default", 3},
+		{".", "default", 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.qname, func(t *testing.T) {
+			table, pop, scope, ok := r.Route(tc.qname, ecs)
+			if !ok || table.Name != tc.table || pop != tc.pop || scope < 0 {
+				t.Errorf("Route(%s): got %v %d %d %v, want table %s PoP %d", tc.qname, table, pop, scope, ok, tc.table, tc.pop)
+			}
+		})
+	}
+
+	t.Run("NoDefault", func(t *testing.T) {
+		dir := t.TempDir()
+		r := New()
+		if err := r.Add("video", writeFile(t, dir, "video.txt", "2001:db8::/32 1\n"), "video.example.com"); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		if _, ok := r.Lookup("www.example.com."); ok {
+			t.Error("expected no table outside the zones")
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	r, dir := testRegistry(t)
+	_, ecs, _ := net.ParseCIDR("2001:db8::/56")
+
+	writeFile(t, dir, "video.txt", "2001:db8::/32 10\n")
+	writeFile(t, dir, "static.txt", "2001:db8::/32 20\n2001:db8::/48 21\n")
+	err := r.ReloadAll()
+	if err == nil || !strings.Contains(err.Error(), "failed to reload table 'static'") {
+		t.Fatalf("expected the conflicting static table to fail, got %v", err)
+	}
+	// each table reloads on its own
+	if _, pop, _, _ := r.Route("video.example.com.", ecs); pop != 10 {
+		t.Errorf("video table not reloaded: PoP %d", pop)
+	}
+	if _, pop, _, _ := r.Route("static.example.com.", ecs); pop != 2 {
+		t.Errorf("static table must keep its old rules: PoP %d", pop)
+	}
+
+	if err := r.Reload("missing"); err == nil {
+		t.Error("expected error for unknown table")
+	}
+	video, _ := r.Table("video")
+	if stats := video.Data.Stats(); stats.Rules != 1 {
+		t.Errorf("expected 1 rule in the video table, got %d", stats.Rules)
+	}
+}
+
+func TestLoadWith(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "video.txt", "2001:db8::/32 1\n")
+	writeFile(t, dir, "default.txt", "::/0 3\n")
+	config := writeFile(t, dir, "tables.txt", "video video.txt video.example.com\ndefault default.txt .\n")
+
+	var set []string
+	r, err := LoadWith(config, func(table *Table) {
+		// nothing is loaded yet
+		if table.Data.Stats().Rules != 0 {
+			t.Errorf("setup of table '%s' ran after its load", table.Name)
+		}
+		set = append(set, table.Name)
+	})
+	if err != nil {
+		t.Fatalf("LoadWith failed: %v", err)
+	}
+	if strings.Join(set, ",") != "video,default" {
+		t.Errorf("setup ran for %v, want every table in config order", set)
+	}
+	if table, _ := r.Table("video"); table.Data.Stats().Rules != 1 {
+		t.Error("table not loaded after setup")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.txt", "2001:db8::/32 1\n")
+	for _, tc := range []struct{ config, want string }{
+		{"a a.txt\n", "expected at least 3 fields"},
+		{"a a.txt example.com\nb a.txt EXAMPLE.com.\n", "already belongs to table 'a'"},
+		{"a a.txt example.com\na a.txt other.com\n", "table 'a' already exists"},
+		{"a missing.txt example.com\n", "failed to load table 'a'"},
+		{"\n", "contains no tables"},
+	} {
+		if _, err := Load(writeFile(t, dir, "tables.txt", tc.config)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("config %q: expected error containing %q, got %v", tc.config, tc.want, err)
+		}
+	}
+}
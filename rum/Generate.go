@@ -0,0 +1,247 @@
+// Package rum turns real user monitoring latency measurements into routing rules
+package rum
+
+import (
+	"CDN77-DNS/optimised"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Measurement is the latency from one client subnet to one PoP as aggregated by the RUM pipeline
+type Measurement struct {
+	Subnet netip.Prefix
+	PoP    uint16
+	// median round trip time in milliseconds
+	RTT     float64
+	Samples int
+}
+
+// Options are the confidence thresholds a subnet's best PoP has to pass to get a rule
+type Options struct {
+	// measurements with fewer samples are ignored
+	MinSamples int
+	// the best PoP's RTT must be lower than the runner-up's by this fraction, eg. 0.05 -> 5% faster
+	MinMargin float64
+}
+
+// DefaultOptions are the thresholds the generate command uses unless told otherwise
+var DefaultOptions = Options{MinSamples: 50, MinMargin: 0.05}
+
+// Report counts what happened to the measured subnets
+type Report struct {
+	// distinct subnets in the measurements
+	Subnets int
+	// subnets that got a rule
+	Chosen int
+	// subnets without a PoP measured with enough samples
+	LowSamples int
+	// subnets whose best PoP did not win by the margin
+	Ambiguous int
+	// rules in the generated table after aggregation
+	Rules int
+}
+
+// ReadCSV reads "subnet,pop,median_rtt_ms,samples" records, a header line is skipped.
+// Subnets must be IPv6 (the routing table is IPv6 only) and are masked.
+func ReadCSV(reader io.Reader) ([]Measurement, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = 4
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	var measurements []Measurement
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read measurements: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "subnet") {
+			continue
+		}
+		m, err := parseRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, nil
+}
+
+func parseRecord(record []string) (Measurement, error) {
+	subnet, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+	if err != nil {
+		return Measurement{}, fmt.Errorf("failed to parse subnet '%s': %w", record[0], err)
+	}
+	if !subnet.Addr().Is6() || subnet.Addr().Is4In6() {
+		return Measurement{}, fmt.Errorf("expected IPv6 subnet, got %s", subnet)
+	}
+	popID, err := strconv.ParseUint(strings.TrimSpace(record[1]), 10, 16)
+	if err != nil {
+		return Measurement{}, fmt.Errorf("failed to parse PoP ID '%s': %w", record[1], err)
+	}
+	rtt, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+	if err != nil || rtt < 0 {
+		return Measurement{}, fmt.Errorf("failed to parse median RTT '%s'", record[2])
+	}
+	samples, err := strconv.Atoi(strings.TrimSpace(record[3]))
+	if err != nil || samples < 0 {
+		return Measurement{}, fmt.Errorf("failed to parse sample count '%s'", record[3])
+	}
+	return Measurement{Subnet: subnet.Masked(), PoP: uint16(popID), RTT: rtt, Samples: samples}, nil
+}
+
+// LoadCSV reads the measurements in filename, see ReadCSV
+func LoadCSV(filename string) ([]Measurement, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open measurements file '%s': %w", filename, err)
+	}
+	defer file.Close()
+	measurements, err := ReadCSV(file)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", filename, err)
+	}
+	return measurements, nil
+}
+
+// Generate picks the best PoP of every measured subnet and builds a table routing each subnet there.
+// A measured subnet inside another one takes its part of the address space over, the broader subnet's PoP
+// is kept for the rest of it, so the rules never overlap and the table is conflict free by construction.
+// Adjacent ranges with the same PoP are then merged into larger prefixes (Data.Minimise).
+// Address space without confident measurements gets no rule.
+func Generate(measurements []Measurement, options Options) (*optimised.Data, Report, error) {
+	// subnet -> PoP -> measurement
+	bySubnet := map[netip.Prefix]map[uint16]Measurement{}
+	var order []netip.Prefix
+	for _, m := range measurements {
+		pops, ok := bySubnet[m.Subnet]
+		if !ok {
+			pops = map[uint16]Measurement{}
+			bySubnet[m.Subnet] = pops
+			order = append(order, m.Subnet)
+		}
+		if _, duplicate := pops[m.PoP]; duplicate {
+			return nil, Report{}, fmt.Errorf("duplicate measurement of %s to PoP %d", m.Subnet, m.PoP)
+		}
+		pops[m.PoP] = m
+	}
+
+	report := Report{Subnets: len(bySubnet)}
+	root := &node{}
+	for _, subnet := range order {
+		popID, result := choose(bySubnet[subnet], options)
+		switch result {
+		case lowSamples:
+			report.LowSamples++
+		case ambiguous:
+			report.Ambiguous++
+		default:
+			report.Chosen++
+			root.paint(subnet, popID)
+		}
+	}
+
+	data := optimised.NewData()
+	var err error
+	root.emit(netip.PrefixFrom(netip.IPv6Unspecified(), 0), 0, false, func(prefix netip.Prefix, popID uint16) {
+		if err == nil {
+			err = data.Insert(prefix, popID)
+		}
+	})
+	if err != nil {
+		return nil, Report{}, fmt.Errorf("failed to build generated table: %w", err)
+	}
+	aggregated, err := data.Minimise(false)
+	if err != nil {
+		return nil, Report{}, err
+	}
+	report.Rules = aggregated.Stats().Rules
+	return aggregated, report, nil
+}
+
+type choice int
+
+const (
+	chosen choice = iota
+	lowSamples
+	ambiguous
+)
+
+// the PoP with the lowest RTT among those measured with enough samples, if it wins by the margin
+func choose(pops map[uint16]Measurement, options Options) (uint16, choice) {
+	var best, runnerUp *Measurement
+	for _, m := range pops {
+		if m.Samples < options.MinSamples {
+			continue
+		}
+		switch {
+		case best == nil || m.RTT < best.RTT || (m.RTT == best.RTT && m.PoP < best.PoP):
+			best, runnerUp = &m, best
+		case runnerUp == nil || m.RTT < runnerUp.RTT:
+			runnerUp = &m
+		}
+	}
+	if best == nil {
+		return 0, lowSamples
+	}
+	if runnerUp != nil && best.RTT > runnerUp.RTT*(1-options.MinMargin) {
+		return 0, ambiguous
+	}
+	return best.PoP, chosen
+}
+
+// node of the binary trie the chosen subnets are painted into, narrower subnets on top of broader ones
+type node struct {
+	children [2]*node
+	popID    uint16
+	painted  bool
+}
+
+func (n *node) paint(subnet netip.Prefix, popID uint16) {
+	addr := subnet.Addr().As16()
+	current := n
+	for depth := 0; depth < subnet.Bits(); depth++ {
+		bit := addr[depth/8] >> (7 - depth%8) & 1
+		if current.children[bit] == nil {
+			current.children[bit] = &node{}
+		}
+		current = current.children[bit]
+	}
+	current.popID, current.painted = popID, true
+}
+
+// emit disjoint prefixes covering the painted address space with the PoP of the narrowest subnet painted over them,
+// inheritedPoP is the PoP painted above n (painted reports whether there is one)
+func (n *node) emit(prefix netip.Prefix, inheritedPoP uint16, painted bool, fn func(prefix netip.Prefix, popID uint16)) {
+	if n.painted {
+		inheritedPoP, painted = n.popID, true
+	}
+	if n.children[0] == nil && n.children[1] == nil {
+		if painted {
+			fn(prefix, inheritedPoP)
+		}
+		return
+	}
+	addr := prefix.Addr().As16()
+	for bit := range 2 {
+		if bit == 1 {
+			addr[prefix.Bits()/8] |= 1 << (7 - prefix.Bits()%8)
+		}
+		half := netip.PrefixFrom(netip.AddrFrom16(addr), prefix.Bits()+1)
+		if child := n.children[bit]; child != nil {
+			child.emit(half, inheritedPoP, painted, fn)
+		} else if painted {
+			fn(half, inheritedPoP)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package rum
+
+import (
+	"CDN77-DNS/optimised"
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const measurements = `subnet,pop,median_rtt_ms,samples
+# two adjacent /48s on PoP 1 merge into a /47
+2001:db8::/48,1,20,500
+2001:db8::/48,2,30,500
+2001:db8:1::/48,1,21,400
+2001:db8:1::/48,2,35,400
+# PoP 3 looks best but has too few samples, PoP 2 is the only confident measurement
+2001:db8:2::/48,3,10,10
+2001:db8:2::/48,2,40,100
+# 20.5 is not 5% slower than 20
+2001:db8:3::/48,1,20,100
+2001:db8:3::/48,2,20.5,100
+# too few samples everywhere
+2001:db8:4::/48,1,20,3
+# a /64 inside the /32 prefers another PoP
+2001:db9::/32,4,15,1000
+2001:db9:0:1::/64,5,8,200
+`
+
+func route(t *testing.T, data *optimised.Data, ecs string) (uint16, int) {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(ecs)
+	if err != nil {
+		t.Fatalf("failed to parse '%s': %v", ecs, err)
+	}
+	return data.Route(subnet)
+}
+
+func TestGenerate(t *testing.T) {
+	parsed, err := ReadCSV(strings.NewReader(measurements))
+	if err != nil {
+		t.Fatalf("ReadCSV failed: %v", err)
+	}
+	if len(parsed) != 11 || parsed[0] != (Measurement{Subnet: netip.MustParsePrefix("2001:db8::/48"), PoP: 1, RTT: 20, Samples: 500}) {
+		t.Fatalf("unexpected measurements %+v", parsed)
+	}
+
+	data, report, err := Generate(parsed, DefaultOptions)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	// the /32 minus the /64 takes one rule per level in between
+	want := Report{Subnets: 7, Chosen: 5, LowSamples: 1, Ambiguous: 1, Rules: 1 + 1 + 32 + 1}
+	if report != want {
+		t.Errorf("got report %+v, want %+v", report, want)
+	}
+	for _, tc := range []struct {
+		ecs   string
+		pop   uint16
+		scope int
+	}{
+		{"2001:db8:1::/56", 1, 47},
+		{"2001:db8:2::/56", 2, 48},
+		{"2001:db8:3::/56", 0, -1},
+		{"2001:db8:4::/56", 0, -1},
+		{"2001:db9:0:1::/80", 5, 64},
+		{"2001:db9:0:2::/80", 4, 63},
+		{"2001:db9:8000::/56", 4, 33},
+	} {
+		if pop, scope := route(t, data, tc.ecs); pop != tc.pop || scope != tc.scope {
+			t.Errorf("Route(%s): got PoP %d scope %d, want PoP %d scope %d", tc.ecs, pop, scope, tc.pop, tc.scope)
+		}
+	}
+
+	// the output loads back as it is, every rule passes the conflict checks
+	var out bytes.Buffer
+	if err := data.WriteRoutingData(&out); err != nil {
+		t.Fatalf("WriteRoutingData failed: %v", err)
+	}
+	filePath := filepath.Join(t.TempDir(), "routing-data.txt")
+	if err := os.WriteFile(filePath, out.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write routing data: %v", err)
+	}
+	if err := optimised.NewData().LoadRoutingData(filePath); err != nil {
+		t.Errorf("generated table does not load: %v", err)
+	}
+
+	t.Run("Thresholds", func(t *testing.T) {
+		_, report, err := Generate(parsed, Options{MinSamples: 1, MinMargin: 0})
+		if err != nil {
+			t.Fatalf("Generate failed: %v", err)
+		}
+		if report.Chosen != 7 || report.LowSamples != 0 || report.Ambiguous != 0 {
+			t.Errorf("got report %+v, want every subnet chosen", report)
+		}
+	})
+}
+
+func TestReadCSVErrors(t *testing.T) {
+	for _, tc := range []struct{ input, want string }{
+		{"192.0.2.0/24,1,20,100\n", "line 1: expected IPv6 subnet"},
+		{"2001:db8::/48,1,20,100\n2001:db8::/48,x,20,100\n", "line 2: failed to parse PoP ID 'x'"},
+		{"2001:db8::/48,1,fast,100\n", "failed to parse median RTT 'fast'"},
+		{"2001:db8::/48,1,20\n", "wrong number of fields"},
+	} {
+		if _, err := ReadCSV(strings.NewReader(tc.input)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.input, tc.want, err)
+		}
+	}
+	duplicate := []Measurement{
+		{Subnet: netip.MustParsePrefix("2001:db8::/48"), PoP: 1, RTT: 20, Samples: 100},
+		{Subnet: netip.MustParsePrefix("2001:db8::/48"), PoP: 1, RTT: 25, Samples: 100},
+	}
+	if _, _, err := Generate(duplicate, DefaultOptions); err == nil || !strings.Contains(err.Error(), "duplicate measurement") {
+		t.Errorf("expected duplicate measurement error, got %v", err)
+	}
+}